@@ -15,6 +15,10 @@ var (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "translate" {
+		os.Exit(translate(os.Args[2:]))
+	}
+
 	flag.Set("logtostderr", "true")
 	flag.Parse()
 
@@ -0,0 +1,395 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/golang/glog"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	// DefaultAMQPBufferSize is the number of messages kept while RabbitMQ is unreachable
+	DefaultAMQPBufferSize = 10000
+
+	// maximum number of messages published before waiting for their confirms
+	amqpMaxInFlight = 100
+
+	amqpConfirmTimeout = 10 * time.Second
+	amqpMinBackoff     = 500 * time.Millisecond
+	amqpMaxBackoff     = 30 * time.Second
+)
+
+var (
+	errAMQPBufferFull = errors.New("amqp buffer is full")
+	errAMQPClosed     = errors.New("amqp publisher is closed")
+)
+
+// amqpPublisherConfig identifies a publisher. Publishers with the same
+// settings are shared between relays.
+type amqpPublisherConfig struct {
+	URL        string
+	Exchange   string
+	RoutingKey string
+	BufferSize int
+	// Transient declares the queue non-durable
+	Transient bool
+}
+
+type amqpMessage struct {
+	body []byte
+	done chan error
+}
+
+func (m *amqpMessage) finish(err error) {
+	if m.done != nil {
+		m.done <- err
+	}
+}
+
+// amqpSession is a long lived connection to a RabbitMQ server, shared by
+// all the publishers of that server. Every publisher uses its own channel.
+type amqpSession struct {
+	url string
+
+	mu     sync.Mutex
+	conn   *amqp.Connection
+	closed chan *amqp.Error
+	refs   int
+}
+
+// channel opens a channel, dialing again if the connection was lost
+func (s *amqpSession) channel() (*amqp.Channel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != nil {
+		select {
+		case <-s.closed:
+			s.conn = nil
+		default:
+		}
+	}
+
+	if s.conn == nil {
+		conn, err := amqp.Dial(s.url)
+		if err != nil {
+			return nil, err
+		}
+		s.conn = conn
+		s.closed = conn.NotifyClose(make(chan *amqp.Error, 1))
+	}
+
+	ch, err := s.conn.Channel()
+	if err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return nil, err
+	}
+
+	return ch, nil
+}
+
+func (s *amqpSession) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// amqpPublisher publishes messages with publisher confirms. Messages are
+// buffered in memory while RabbitMQ is down and published once the
+// connection is back; unconfirmed messages are published again, so
+// consumers may see duplicates.
+type amqpPublisher struct {
+	cfg     amqpPublisherConfig
+	session *amqpSession
+	refs    int
+
+	queue chan *amqpMessage
+	// messages published but not yet confirmed, owned by run
+	pending []*amqpMessage
+
+	// up is 1 while a channel to RabbitMQ is open
+	up int32
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+var (
+	amqpMu         sync.Mutex
+	amqpSessions   = make(map[string]*amqpSession)
+	amqpPublishers = make(map[amqpPublisherConfig]*amqpPublisher)
+)
+
+// getAMQPPublisher returns the running publisher for the given settings,
+// starting one if needed. Every call must be paired with release.
+func getAMQPPublisher(cfg amqpPublisherConfig) *amqpPublisher {
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = DefaultAMQPBufferSize
+	}
+
+	amqpMu.Lock()
+	defer amqpMu.Unlock()
+
+	if p, ok := amqpPublishers[cfg]; ok {
+		p.refs++
+		return p
+	}
+
+	s, ok := amqpSessions[cfg.URL]
+	if !ok {
+		s = &amqpSession{url: cfg.URL}
+		amqpSessions[cfg.URL] = s
+	}
+	s.refs++
+
+	p := &amqpPublisher{
+		cfg:     cfg,
+		session: s,
+		refs:    1,
+		queue:   make(chan *amqpMessage, cfg.BufferSize),
+		closing: make(chan struct{}),
+	}
+	amqpPublishers[cfg] = p
+
+	p.wg.Add(1)
+	go p.run()
+
+	return p
+}
+
+// release stops the publisher and closes its connection once no relay uses them
+func (p *amqpPublisher) release() {
+	amqpMu.Lock()
+	p.refs--
+	last := p.refs == 0
+	lastSession := false
+	if last {
+		delete(amqpPublishers, p.cfg)
+		p.session.refs--
+		lastSession = p.session.refs == 0
+		if lastSession {
+			delete(amqpSessions, p.cfg.URL)
+		}
+	}
+	amqpMu.Unlock()
+
+	if !last {
+		return
+	}
+
+	close(p.closing)
+	p.wg.Wait()
+
+	if lastSession {
+		p.session.close()
+	}
+}
+
+// available reports whether RabbitMQ is reachable
+func (p *amqpPublisher) available() bool {
+	return atomic.LoadInt32(&p.up) == 1
+}
+
+// publish queues a message without waiting for it to be confirmed
+func (p *amqpPublisher) publish(body []byte) error {
+	select {
+	case p.queue <- &amqpMessage{body: body}:
+		return nil
+	default:
+		return errAMQPBufferFull
+	}
+}
+
+// publishWait queues a message and waits until RabbitMQ confirms it or the
+// timeout expires. After a timeout the message stays queued.
+func (p *amqpPublisher) publishWait(body []byte, timeout time.Duration) error {
+	m := &amqpMessage{body: body, done: make(chan error, 1)}
+
+	select {
+	case p.queue <- m:
+	default:
+		return errAMQPBufferFull
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case err := <-m.done:
+		return err
+	case <-t.C:
+		return fmt.Errorf("no confirm from rabbitmq after %v", timeout)
+	}
+}
+
+func (p *amqpPublisher) run() {
+	defer p.wg.Done()
+
+	backoff := amqpMinBackoff
+	for {
+		err := p.serve(&backoff)
+		if err == errAMQPClosed {
+			break
+		}
+
+		log.Errorf("Problem publishing to rabbitmq (exchange %q, routing key %q), retrying in %v: %v",
+			p.cfg.Exchange, p.cfg.RoutingKey, backoff, err)
+
+		select {
+		case <-p.closing:
+		case <-time.After(backoff):
+			backoff *= 2
+			if backoff > amqpMaxBackoff {
+				backoff = amqpMaxBackoff
+			}
+			continue
+		}
+		break
+	}
+
+	for _, m := range p.pending {
+		m.finish(errAMQPClosed)
+	}
+	if n := len(p.pending) + len(p.queue); n > 0 {
+		log.Warningf("Dropping %d unpublished messages for rabbitmq routing key %q", n, p.cfg.RoutingKey)
+	}
+}
+
+// declare sets up the durable exchange and queue the messages are routed to
+func (p *amqpPublisher) declare(ch *amqp.Channel) error {
+	if _, err := ch.QueueDeclare(
+		p.cfg.RoutingKey, // name
+		!p.cfg.Transient, // durable
+		false,            // delete when unused
+		false,            // exclusive
+		false,            // no-wait
+		nil,              // arguments
+	); err != nil {
+		return err
+	}
+
+	if p.cfg.Exchange == "" {
+		return nil
+	}
+
+	if err := ch.ExchangeDeclare(
+		p.cfg.Exchange, // name
+		"direct",       // type
+		true,           // durable
+		false,          // auto-deleted
+		false,          // internal
+		false,          // no-wait
+		nil,            // arguments
+	); err != nil {
+		return err
+	}
+
+	return ch.QueueBind(p.cfg.RoutingKey, p.cfg.RoutingKey, p.cfg.Exchange, false, nil)
+}
+
+// serve publishes messages over a single channel until it fails
+func (p *amqpPublisher) serve(backoff *time.Duration) error {
+	ch, err := p.session.channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	if err := p.declare(ch); err != nil {
+		return err
+	}
+
+	if err := ch.Confirm(false); err != nil {
+		return err
+	}
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, amqpMaxInFlight))
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	*backoff = amqpMinBackoff
+	atomic.StoreInt32(&p.up, 1)
+	defer atomic.StoreInt32(&p.up, 0)
+
+	for {
+		// messages left unconfirmed by a previous channel go first
+		if len(p.pending) == 0 {
+			select {
+			case m := <-p.queue:
+				p.pending = append(p.pending, m)
+			case err := <-closed:
+				if err == nil {
+					return errors.New("channel closed")
+				}
+				return err
+			case <-p.closing:
+				return errAMQPClosed
+			}
+		}
+
+	fill:
+		for len(p.pending) < amqpMaxInFlight {
+			select {
+			case m := <-p.queue:
+				p.pending = append(p.pending, m)
+			default:
+				break fill
+			}
+		}
+
+		for _, m := range p.pending {
+			err := ch.Publish(
+				p.cfg.Exchange,   // exchange
+				p.cfg.RoutingKey, // routing key
+				false,            // mandatory
+				false,            // immediate
+				amqp.Publishing{
+					ContentType:  "text/plain",
+					DeliveryMode: amqp.Persistent,
+					Timestamp:    time.Now(),
+					Body:         m.body,
+				})
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := p.waitConfirms(confirms); err != nil {
+			return err
+		}
+	}
+}
+
+// waitConfirms waits for the confirms of all pending messages, in order
+func (p *amqpPublisher) waitConfirms(confirms chan amqp.Confirmation) error {
+	t := time.NewTimer(amqpConfirmTimeout)
+	defer t.Stop()
+
+	for len(p.pending) > 0 {
+		select {
+		case c, ok := <-confirms:
+			if !ok {
+				return errors.New("channel closed while waiting for confirms")
+			}
+			if !c.Ack {
+				return fmt.Errorf("message %d was nacked", c.DeliveryTag)
+			}
+			p.pending[0].finish(nil)
+			p.pending = p.pending[1:]
+		case <-t.C:
+			return errors.New("timed out waiting for confirms")
+		case <-p.closing:
+			return errAMQPClosed
+		}
+	}
+
+	return nil
+}
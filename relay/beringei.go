@@ -1,7 +1,6 @@
 package relay
 
 import (
-	"bytes"
 	"compress/gzip"
 	"crypto/tls"
 	"encoding/json"
@@ -9,17 +8,13 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"runtime"
 	"strconv"
-	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
-	"unicode/utf8"
 
 	"github.com/influxdata/influxdb/models"
-	"github.com/influxdata/telegraf"
-	"github.com/influxdata/telegraf/plugins/outputs/graphite"
-	cache "github.com/patrickmn/go-cache"
-	"github.com/streadway/amqp"
 )
 
 // Beringei is a relay for Beringei writes
@@ -31,19 +26,34 @@ type Beringei struct {
 	cert    string
 	ampqURL string
 
-	beringeiUpdateURL string
+	// the publishers are created by Run
+	publisherCfg amqpPublisherConfig
+	migrationCfg *amqpPublisherConfig
+	publisher    *amqpPublisher
+	series       *beringeiSeries
 
 	closing int64
 	l       net.Listener
 
-	backends        []*beringeiBackend
+	// writes waiting for a worker, mu guards sending against closing
+	mu      sync.RWMutex
+	queue   chan models.Points
+	workers int
+	wg      sync.WaitGroup
+
+	// output is nil without backends
+	output *beringeiOutput
+
 	graphiteBackend string
+	graphite        *graphiteWriter
 
-	beringeiEnabled bool
 	graphiteEnabled bool
 }
 
-var pointsCh chan *BeringeiPoint
+const (
+	// DefaultBeringeiQueueSize is the number of writes waiting for a worker
+	DefaultBeringeiQueueSize = 1024
+)
 
 func NewBeringei(cfg BeringeiConfig) (Relay, error) {
 	b := new(Beringei)
@@ -59,30 +69,94 @@ func NewBeringei(cfg BeringeiConfig) (Relay, error) {
 	}
 
 	b.ampqURL = cfg.AMQPUrl
-	b.beringeiUpdateURL = cfg.BeringeiUpdateURL
 	b.graphiteBackend = cfg.GraphiteOutput
 
-	for i := range cfg.Outputs {
-		backend, err := NewBeringeiBackend(&cfg.Outputs[i])
+	outputs := cfg.Outputs
+	if len(outputs) == 0 && cfg.BeringeiUpdateURL != "" {
+		outputs = []BeringeiOutputConfig{{Location: cfg.BeringeiUpdateURL}}
+	}
+
+	var backends []*beringeiBackend
+	for i := range outputs {
+		backend, err := NewBeringeiBackend(&outputs[i])
 		if err != nil {
 			return nil, err
 		}
 
-		b.backends = append(b.backends, backend)
+		backends = append(backends, backend)
 	}
 
-	if len(b.backends) > 0 {
-		b.beringeiEnabled = true
-	} else {
-		b.beringeiEnabled = false
+	if len(backends) > 0 {
+		batch := DefaultBeringeiBatchSizeKB * KB
+		if cfg.BatchSizeKB > 0 {
+			batch = cfg.BatchSizeKB * KB
+		}
+
+		interval := DefaultBeringeiFlushInterval
+		if cfg.FlushInterval != "" {
+			t, err := time.ParseDuration(cfg.FlushInterval)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing flush-interval '%v'", err)
+			}
+			interval = t
+		}
+
+		b.output = newBeringeiOutput(b.Name(), backends, batch, interval)
 	}
 
 	if b.graphiteBackend != "" {
 		b.graphiteEnabled = true
+		g, err := newGraphiteWriter([]GraphiteOutputConfig{{Location: b.graphiteBackend}})
+		if err != nil {
+			return nil, err
+		}
+		b.graphite = g
 	} else {
 		b.graphiteEnabled = false
 	}
 
+	var ttl time.Duration
+	if cfg.SeriesCacheTTL != "" {
+		t, err := time.ParseDuration(cfg.SeriesCacheTTL)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing series-cache-ttl '%v'", err)
+		}
+		ttl = t
+	}
+
+	version, err := parseSeriesIDVersion(cfg.SeriesID)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.SeriesIDMigration && (version == SeriesIDLegacy || b.ampqURL == "") {
+		return nil, fmt.Errorf("series-id-migration needs series-id \"v1\" and an amqp-url")
+	}
+	if version == SeriesIDv1 && !cfg.SeriesIDMigration {
+		log.Printf("Relay %q writes v1 series IDs without series-id-migration, points written under legacy IDs will not be mapped to them", b.Name())
+	}
+
+	registry, err := newSeriesRegistry(cfg.SeriesCacheSize, ttl, cfg.SeriesIndexFile)
+	if err != nil {
+		return nil, err
+	}
+	b.series = &beringeiSeries{version: version, registry: registry}
+
+	b.publisherCfg = amqpConfig(cfg.AMQPUrl, cfg.AMQPExchange, cfg.AMQPRoutingKey, cfg.AMQPBufferSize, cfg.AMQPTransientQueue, "beringei")
+	if cfg.SeriesIDMigration {
+		m := amqpConfig(cfg.AMQPUrl, cfg.AMQPExchange, cfg.SeriesIDMigrationRoutingKey, cfg.AMQPBufferSize, cfg.AMQPTransientQueue, "beringei-migration")
+		b.migrationCfg = &m
+	}
+
+	b.workers = cfg.Workers
+	if b.workers <= 0 {
+		b.workers = runtime.NumCPU()
+	}
+	queueSize := cfg.QueueSize
+	if queueSize <= 0 {
+		queueSize = DefaultBeringeiQueueSize
+	}
+	b.queue = make(chan models.Points, queueSize)
+
 	return b, nil
 
 }
@@ -113,6 +187,23 @@ func (b *Beringei) Run() error {
 	}
 	b.l = l
 
+	if b.ampqURL != "" {
+		b.publisher = getAMQPPublisher(b.publisherCfg)
+		b.series.publisher = b.publisher
+	}
+	if b.migrationCfg != nil {
+		b.series.migration = getAMQPPublisher(*b.migrationCfg)
+	}
+
+	if b.output != nil {
+		b.output.start()
+	}
+
+	b.wg.Add(b.workers)
+	for i := 0; i < b.workers; i++ {
+		go b.work()
+	}
+
 	log.Printf("Starting Beringei relay %q on %v", b.Name(), b.addr)
 	err = http.Serve(l, b)
 	if atomic.LoadInt64(&b.closing) != 0 {
@@ -124,52 +215,34 @@ func (b *Beringei) Run() error {
 // Stop stops the Beringei Relay
 func (b *Beringei) Stop() error {
 	atomic.StoreInt64(&b.closing, 1)
-	return b.l.Close()
-}
+	err := b.l.Close()
 
-func (b *Beringei) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// let the workers finish the queued writes before closing their outputs
+	b.mu.Lock()
+	close(b.queue)
+	b.mu.Unlock()
+	b.wg.Wait()
 
-	start := time.Now()
-
-	g := &graphite.Graphite{
-		Servers: []string{b.graphiteBackend},
-		Prefix:  "bucky",
+	if b.output != nil {
+		b.output.stop()
 	}
-
-	if b.graphiteEnabled {
-		err := g.Connect()
-		if err != nil {
-			log.Fatalf("Could not connect to graphite: %s", err)
-		}
+	if b.publisher != nil {
+		b.publisher.release()
 	}
+	b.series.close()
+	return err
+}
 
-	queryParams := r.URL.Query()
+func (b *Beringei) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
-	log.Println(r.Header)
-	// fail early if we cannot connect to Rabbitmq
-	conn, err := amqp.Dial(b.ampqURL)
-	if err != nil {
-		log.Fatalf("%s: %s", "Could not connect to Rabbitmq", err)
-	}
-	// defer conn.Close()
+	start := time.Now()
 
-	rabbitmqCh, err := conn.Channel()
-	if err != nil {
-		log.Fatalf("%s: %s", "Could not open a channel", err)
+	if r.URL.Path == "/query" {
+		b.serveQuery(w, r)
+		return
 	}
 
-	_, err = rabbitmqCh.QueueDeclare(
-		"beringei", // name
-		false,      // durable
-		false,      // delete when usused
-		false,      // exclusive
-		false,      // no-wait
-		nil,        // arguments
-	)
-
-	if err != nil {
-		log.Fatalf("%s: %s", "Failed to declare Queue", err)
-	}
+	queryParams := r.URL.Query()
 
 	// fail early if we're missing the database
 	if queryParams.Get("db") == "" {
@@ -177,20 +250,25 @@ func (b *Beringei) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// new series could not be announced
+	if b.publisher != nil && !b.publisher.available() {
+		jsonError(w, http.StatusServiceUnavailable, "rabbitmq is unavailable")
+		return
+	}
+
 	var body = r.Body
 	if r.Header.Get("Content-Encoding") == "gzip" {
 		b, err := gzip.NewReader(r.Body)
 		if err != nil {
 			jsonError(w, http.StatusBadRequest, "unable to decode gzip body")
+			return
 		}
 		defer b.Close()
 		body = b
 	}
 
-	// log.Println(body)
-
 	bodyBuf := getBuf()
-	_, err = bodyBuf.ReadFrom(body)
+	_, err := bodyBuf.ReadFrom(body)
 	if err != nil {
 		putBuf(bodyBuf)
 		jsonError(w, http.StatusInternalServerError, "problem reading request body")
@@ -204,84 +282,66 @@ func (b *Beringei) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		jsonError(w, http.StatusBadRequest, "unable to parse points")
 		return
 	}
-	// for _, p := range points {
-	// 	log.Print(p)
-	// }
-	go pushPoints(points, b.ampqURL, g, b.beringeiUpdateURL, b.beringeiEnabled, b.graphiteEnabled)
 
-}
+	b.mu.RLock()
+	if atomic.LoadInt64(&b.closing) != 0 {
+		b.mu.RUnlock()
+		jsonError(w, http.StatusServiceUnavailable, "relay is shutting down")
+		return
+	}
 
-// type poster interface {
-// 	post([]byte, string, string) (*responseData, error)
-// }
+	select {
+	case b.queue <- points:
+		b.mu.RUnlock()
+	default:
+		b.mu.RUnlock()
+		jsonError(w, http.StatusServiceUnavailable, "too many pending writes")
+		log.Printf("Rejecting write to Beringei relay %q, the queue is full", b.Name())
+		return
+	}
 
-type beringeiBackend struct {
-	// poster
-	name string
+	w.WriteHeader(http.StatusNoContent)
 }
 
-// NewBeringeiBackend Initializes a new Beringei Backend
-func NewBeringeiBackend(cfg *BeringeiOutputConfig) (*beringeiBackend, error) {
-	if cfg.Name == "" {
-		cfg.Name = cfg.Location
+// work processes queued writes until the queue is closed
+func (b *Beringei) work() {
+	defer b.wg.Done()
+
+	for points := range b.queue {
+		pushPoints(points, b.series, b.output, b.graphite, b.graphiteEnabled)
 	}
+}
 
-	return &beringeiBackend{
-		name: cfg.Name,
-	}, nil
+func pushPoints(points []models.Point, series *beringeiSeries, out *beringeiOutput, g *graphiteWriter, graphiteEnabled bool) {
+	if graphiteEnabled {
+		if err := g.write(points, graphiteSource{SourceType: ProfileLinux}); err != nil {
+			log.Println(err)
+		}
+	}
 
-}
+	if out == nil {
+		return
+	}
 
-func pushPoints(points []models.Point, amqpURL string, g *graphite.Graphite, beringeiUpdateURL string, beringeiEnabled, graphiteEnabled bool) {
 	for _, p := range points {
 		tags := make(map[string]string)
 		for _, v := range p.Tags() {
 			tags[string(v.Key)] = string(v.Value)
 		}
-		parsedPoints := make([]string, 0, len(points))
-		graphiteMetrics := make([]telegraf.Metric, 0, len(points))
 		fi := p.FieldIterator()
 		for fi.Next() {
 			switch fi.Type() {
 			case models.Float:
 				v, _ := fi.FloatValue()
 				tmpPoint := NewBeringeiPoint(string(p.Name()), string(fi.FieldKey()), p.UnixNano(), tags, v)
-				if graphiteEnabled {
-					if utf8.ValidString(string(fi.FieldKey())) {
-						grphPoint := GraphiteMetric(string(p.Name()), tags, p.UnixNano(), v, string(fi.FieldKey()))
-						if grphPoint != nil {
-							graphiteMetrics = append(graphiteMetrics, grphPoint)
-						}
-					}
-				}
-
-				if beringeiEnabled {
-					tmpPoint.generateID(tmpPoint, p.Key())
-					pushToCache(tmpPoint, amqpURL)
-					if tmpPoint.ID != "" {
-						s := tmpPoint.ID + " " + strconv.FormatFloat(v, 'E', -1, 64) + " " + strconv.FormatInt(tmpPoint.Timestamp, 10)
-						parsedPoints = append(parsedPoints, s)
-					}
+				if series.identify(tmpPoint, p.Key()) {
+					out.add(tmpPoint.ID, strconv.FormatFloat(v, 'E', -1, 64), tmpPoint.Timestamp)
 				}
 			case models.Integer:
 				v, _ := fi.IntegerValue()
 				tmpPoint := NewBeringeiPoint(string(p.Name()), string(fi.FieldKey()), p.UnixNano(), tags, v)
-				if graphiteEnabled {
-					if utf8.ValidString(string(fi.FieldKey())) {
-						grphPoint := GraphiteMetric(string(p.Name()), tags, p.UnixNano(), v, string(fi.FieldKey()))
-						if grphPoint != nil {
-							graphiteMetrics = append(graphiteMetrics, grphPoint)
-						}
-					}
-				}
-
-				if beringeiEnabled {
-					tmpPoint.generateID(tmpPoint, p.Key())
-					pushToCache(tmpPoint, amqpURL)
-					if tmpPoint.ID != "" {
-						s := tmpPoint.ID + " " + strconv.FormatInt(v, 10) + " " + strconv.FormatInt(tmpPoint.Timestamp, 10)
-						parsedPoints = append(parsedPoints, s)
-					}
+				if series.identify(tmpPoint, p.Key()) {
+					out.add(tmpPoint.ID, strconv.FormatInt(v, 10), tmpPoint.Timestamp)
 				}
 				// case models.String:
 				// 	log.Println("String values not supported")
@@ -293,73 +353,15 @@ func pushPoints(points []models.Point, amqpURL string, g *graphite.Graphite, ber
 				// 	log.Println("Unknown value type")
 			}
 		}
-
-		if beringeiEnabled {
-			pushToBeringei(parsedPoints, beringeiUpdateURL)
-		}
-		if graphiteEnabled {
-			err := g.Write(graphiteMetrics)
-			if err != nil {
-				log.Println(err)
-			}
-		}
-	}
-
-}
-
-func pushToBeringei(points []string, targetURL string) {
-	var bodyString string
-	for _, p := range points {
-		bodyString += p + "\n"
 	}
-	// This needs to be done, as beringei plain server does not accept empty line
-	bodyString = strings.Trim(bodyString, "\n")
-
-	bodyBuf := bytes.NewBufferString(bodyString)
-
-	http.Post(targetURL, "", bodyBuf)
-	return
 }
 
-func pushToCache(p *BeringeiPoint, amqpURL string) {
-	if _, found := RelayCache.Get(p.ID); found {
-		return
-	}
-
-	RelayCache.Set(p.ID, p.Value, cache.DefaultExpiration)
-	pushToRabbitmq(p, amqpURL)
-	return
-}
-
-func pushToRabbitmq(p *BeringeiPoint, amqpURL string) {
-	// fail early if we cannot connect to Rabbitmq
-	conn, err := amqp.Dial(amqpURL)
-	if err != nil {
-		log.Fatalf("%s: %s", "Could not connect to Rabbitmq", err)
-	}
-	defer conn.Close()
-
-	ch, err := conn.Channel()
-	if err != nil {
-		log.Fatalf("%s: %s", "Could not open a channel", err)
+// pushToRabbitmq announces a new series
+func pushToRabbitmq(p *BeringeiPoint, publisher *amqpPublisher) error {
+	if publisher == nil {
+		return nil
 	}
-	defer ch.Close()
 
 	b, _ := json.Marshal(p)
-	err = ch.Publish(
-		"",         // exchange
-		"beringei", // routing Key
-		false,      // mandatory
-		false,      // immediate
-		amqp.Publishing{
-			ContentType: "text/plain",
-			Body:        b,
-		})
-
-	if err != nil {
-		log.Println(err)
-	} else {
-		// log.Println("Success pushing to Rabbitmq")
-	}
-
+	return publisher.publish(b)
 }
@@ -0,0 +1,264 @@
+package relay
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultBeringeiBatchSizeKB is the size at which datapoints are flushed
+	DefaultBeringeiBatchSizeKB = 64
+
+	// DefaultBeringeiFlushInterval is how long datapoints wait for a batch to fill
+	DefaultBeringeiFlushInterval = time.Second
+
+	// batches waiting for a backend before new ones are dropped
+	beringeiBackendQueueSize = 64
+)
+
+type beringeiBackend struct {
+	poster
+	name     string
+	location string
+
+	queue chan []byte
+
+	// retry is set if failed writes are buffered
+	retry *retryBuffer
+
+	// client and queryLocation serve queries
+	client        *http.Client
+	queryLocation string
+}
+
+// NewBeringeiBackend Initializes a new Beringei Backend
+func NewBeringeiBackend(cfg *BeringeiOutputConfig) (*beringeiBackend, error) {
+	if cfg.Name == "" {
+		cfg.Name = cfg.Location
+	}
+
+	location := cfg.Location
+	if !strings.Contains(location, "://") {
+		location = "http://" + location + "/update"
+	}
+
+	timeout := DefaultHTTPTimeout
+	if cfg.Timeout != "" {
+		t, err := time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing Beringei timeout '%v'", err)
+		}
+		timeout = t
+	}
+
+	queryLocation := cfg.QueryLocation
+	if queryLocation == "" {
+		queryLocation = strings.TrimSuffix(location, "/update") + "/query"
+	}
+
+	simple := newSimplePoster(location, timeout, cfg.SkipTLSVerification)
+	var (
+		p     poster = beringeiPoster{simple}
+		retry *retryBuffer
+	)
+
+	// like influxdb backends, retries are serialized per backend
+	if cfg.BufferSizeMB > 0 {
+		max := DefaultMaxDelayInterval
+		if cfg.MaxDelayInterval != "" {
+			m, err := time.ParseDuration(cfg.MaxDelayInterval)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing max retry time %v", err)
+			}
+			max = m
+		}
+
+		batch := DefaultBatchSizeKB * KB
+		if cfg.MaxBatchKB > 0 {
+			batch = cfg.MaxBatchKB * KB
+		}
+
+		retry = newRetryBuffer(cfg.BufferSizeMB*MB, batch, max, p)
+		p = retry
+	}
+
+	return &beringeiBackend{
+		poster:   p,
+		name:     cfg.Name,
+		location: location,
+		queue:    make(chan []byte, beringeiBackendQueueSize),
+		retry:    retry,
+
+		client:        simple.client,
+		queryLocation: queryLocation,
+	}, nil
+}
+
+// beringeiPoster strips the newline ending a batch, the Beringei plain
+// server does not accept empty lines
+type beringeiPoster struct {
+	poster
+}
+
+func (p beringeiPoster) post(buf []byte, query string, auth string, org string) (*responseData, error) {
+	return p.poster.post(bytes.TrimRight(buf, "\n"), query, auth, org)
+}
+
+// beringeiOutput batches the datapoints of all requests and posts every
+// batch to all backends. Each backend has a bounded queue of batches; a
+// batch that does not fit is dropped for that backend.
+type beringeiOutput struct {
+	relay    string
+	backends []*beringeiBackend
+	maxBatch int
+	interval time.Duration
+
+	mu  sync.Mutex
+	buf []byte
+
+	closing chan struct{}
+	// abort is closed once stopping gave up on the remaining batches
+	abort chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newBeringeiOutput(relay string, backends []*beringeiBackend, maxBatch int, interval time.Duration) *beringeiOutput {
+	return &beringeiOutput{
+		relay:    relay,
+		backends: backends,
+		maxBatch: maxBatch,
+		interval: interval,
+		buf:      make([]byte, 0, maxBatch),
+		closing:  make(chan struct{}),
+		abort:    make(chan struct{}),
+	}
+}
+
+// start posts batches in the background
+func (o *beringeiOutput) start() {
+	o.wg.Add(1 + len(o.backends))
+	go o.run()
+	for _, b := range o.backends {
+		go o.serve(b)
+	}
+}
+
+// stop flushes the datapoints added so far and waits for every backend to
+// take them. Backends that are still down after retryDrainTimeout lose
+// their remaining batches.
+func (o *beringeiOutput) stop() {
+	o.flush()
+	close(o.closing)
+	if waitTimeout(&o.wg, retryDrainTimeout) {
+		return
+	}
+
+	log.Printf("Backends of relay %q did not take the remaining datapoints within %v, dropping them", o.relay, retryDrainTimeout)
+	close(o.abort)
+	for _, b := range o.backends {
+		if b.retry != nil {
+			b.retry.stop()
+		}
+	}
+	o.wg.Wait()
+}
+
+// add queues a datapoint
+func (o *beringeiOutput) add(id, value string, timestamp int64) {
+	o.mu.Lock()
+	o.buf = append(o.buf, id...)
+	o.buf = append(o.buf, ' ')
+	o.buf = append(o.buf, value...)
+	o.buf = append(o.buf, ' ')
+	o.buf = strconv.AppendInt(o.buf, timestamp, 10)
+	o.buf = append(o.buf, '\n')
+	full := len(o.buf) >= o.maxBatch
+	o.mu.Unlock()
+
+	if full {
+		o.flush()
+	}
+}
+
+// flush hands the current batch to every backend
+func (o *beringeiOutput) flush() {
+	o.mu.Lock()
+	batch := o.buf
+	if len(batch) == 0 {
+		o.mu.Unlock()
+		return
+	}
+	o.buf = make([]byte, 0, o.maxBatch)
+	o.mu.Unlock()
+
+	for _, b := range o.backends {
+		select {
+		case b.queue <- batch:
+		default:
+			log.Printf("Dropping %d bytes of datapoints for relay %q backend %q, the queue is full", len(batch), o.relay, b.name)
+		}
+	}
+}
+
+func (o *beringeiOutput) run() {
+	defer o.wg.Done()
+
+	t := time.NewTicker(o.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			o.flush()
+		case <-o.closing:
+			return
+		}
+	}
+}
+
+// serve posts the batches of a backend one at a time
+func (o *beringeiOutput) serve(b *beringeiBackend) {
+	defer o.wg.Done()
+
+	for {
+		select {
+		case batch := <-b.queue:
+			o.post(b, batch)
+		case <-o.closing:
+			for {
+				select {
+				case <-o.abort:
+					if n := len(b.queue); n > 0 {
+						log.Printf("Dropping %d batches of datapoints for relay %q backend %q", n, o.relay, b.name)
+					}
+					return
+				default:
+				}
+
+				select {
+				case batch := <-b.queue:
+					o.post(b, batch)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (o *beringeiOutput) post(b *beringeiBackend, batch []byte) {
+	resp, err := b.post(batch, "", "", "")
+	if err != nil {
+		log.Printf("Problem posting to relay %q backend %q: %v", o.relay, b.name, err)
+		return
+	}
+	if resp.StatusCode/100 != 2 {
+		log.Printf("%d response for relay %q backend %q: %s", resp.StatusCode, o.relay, b.name, bytes.TrimSpace(resp.Body))
+	}
+}
@@ -0,0 +1,133 @@
+package relay
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// beringeiServer records the bodies it is posted, answering the first
+// failures requests with a 503
+type beringeiServer struct {
+	mu       sync.Mutex
+	failures int
+	bodies   []string
+}
+
+func (s *beringeiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failures > 0 {
+		s.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	s.bodies = append(s.bodies, string(body))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *beringeiServer) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.bodies...)
+}
+
+func newTestBeringeiBackend(t *testing.T, cfg BeringeiOutputConfig) *beringeiBackend {
+	t.Helper()
+	b, err := NewBeringeiBackend(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestBeringeiOutputBatches(t *testing.T) {
+	s1, s2 := new(beringeiServer), new(beringeiServer)
+	srv1, srv2 := httptest.NewServer(s1), httptest.NewServer(s2)
+	defer srv1.Close()
+	defer srv2.Close()
+
+	o := newBeringeiOutput("relay", []*beringeiBackend{
+		newTestBeringeiBackend(t, BeringeiOutputConfig{Location: srv1.URL + "/update"}),
+		newTestBeringeiBackend(t, BeringeiOutputConfig{Location: srv2.URL + "/update"}),
+	}, KB, time.Hour)
+	o.start()
+
+	o.add("v1:aa", "1", 100)
+	o.add("v1:bb", "2.5", 200)
+	o.stop()
+
+	// every backend gets the batch, without the trailing newline
+	want := "v1:aa 1 100\nv1:bb 2.5 200"
+	for i, s := range []*beringeiServer{s1, s2} {
+		if got := s.received(); len(got) != 1 || got[0] != want {
+			t.Errorf("backend %d received %q, want [%q]", i, got, want)
+		}
+	}
+}
+
+func TestBeringeiOutputFlushesFullBatches(t *testing.T) {
+	s := new(beringeiServer)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	// room for about two datapoints per batch
+	o := newBeringeiOutput("relay", []*beringeiBackend{
+		newTestBeringeiBackend(t, BeringeiOutputConfig{Location: srv.URL + "/update"}),
+	}, 20, time.Hour)
+	o.start()
+
+	for i := 0; i < 5; i++ {
+		o.add("v1:aa", "1", 100)
+	}
+	o.stop()
+
+	got := s.received()
+	if len(got) != 3 {
+		t.Fatalf("received %d batches, want 3: %q", len(got), got)
+	}
+	if n := strings.Count(strings.Join(got, "\n"), "v1:aa"); n != 5 {
+		t.Errorf("received %d datapoints, want 5", n)
+	}
+}
+
+func TestBeringeiOutputRetries(t *testing.T) {
+	s := &beringeiServer{failures: 1}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	o := newBeringeiOutput("relay", []*beringeiBackend{
+		newTestBeringeiBackend(t, BeringeiOutputConfig{Location: srv.URL + "/update", BufferSizeMB: 1}),
+	}, KB, time.Hour)
+	o.start()
+
+	o.add("v1:aa", "1", 100)
+	o.stop()
+
+	if got := s.received(); len(got) != 1 || got[0] != "v1:aa 1 100" {
+		t.Errorf("received %q after a failed write", got)
+	}
+}
+
+func TestNewBeringeiBackendLocations(t *testing.T) {
+	b := newTestBeringeiBackend(t, BeringeiOutputConfig{Location: "beringei:9999"})
+	if b.location != "http://beringei:9999/update" || b.queryLocation != "http://beringei:9999/query" || b.name != "beringei:9999" {
+		t.Errorf("host:port resolved to %q, %q named %q", b.location, b.queryLocation, b.name)
+	}
+
+	b = newTestBeringeiBackend(t, BeringeiOutputConfig{Name: "b", Location: "https://b/write", QueryLocation: "https://b/read"})
+	if b.location != "https://b/write" || b.queryLocation != "https://b/read" {
+		t.Errorf("URLs resolved to %q, %q", b.location, b.queryLocation)
+	}
+
+	if _, err := NewBeringeiBackend(&BeringeiOutputConfig{Location: "b:1", Timeout: "soon"}); err == nil {
+		t.Error("expected an error for an invalid timeout")
+	}
+}
@@ -0,0 +1,282 @@
+package relay
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maximum number of series a query may read
+	beringeiMaxQuerySeries = 1000
+
+	// time range of a query without start
+	beringeiDefaultQueryRange = time.Hour
+)
+
+type beringeiQuerySeries struct {
+	ID          string               `json:"id"`
+	Measurement string               `json:"measurement,omitempty"`
+	Tags        map[string]string    `json:"tags,omitempty"`
+	Field       string               `json:"field,omitempty"`
+	Points      []beringeiQueryPoint `json:"points"`
+}
+
+// beringeiQueryPoint is a [timestamp, value] pair in JSON
+type beringeiQueryPoint struct {
+	Timestamp int64
+	Value     float64
+}
+
+func (p beringeiQueryPoint) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{p.Timestamp, p.Value})
+}
+
+func (p *beringeiQueryPoint) UnmarshalJSON(data []byte) error {
+	var pair []json.Number
+	if err := json.Unmarshal(data, &pair); err != nil {
+		return err
+	}
+	if len(pair) != 2 {
+		return fmt.Errorf("expected [timestamp, value], got %s", data)
+	}
+
+	ts, err := pair[0].Int64()
+	if err != nil {
+		return err
+	}
+	v, err := pair[1].Float64()
+	if err != nil {
+		return err
+	}
+
+	p.Timestamp, p.Value = ts, v
+	return nil
+}
+
+type beringeiQueryResponse struct {
+	Start  int64                  `json:"start"`
+	End    int64                  `json:"end"`
+	Series []*beringeiQuerySeries `json:"series"`
+	Errors []string               `json:"errors,omitempty"`
+}
+
+// serveQuery reads the points of series from every backend and merges
+// them. Series are given by id, or by measurement, tag (key=value) and
+// field matched against the series the relay has seen; start and end are
+// unix timestamps in nanoseconds, like the datapoints written.
+func (b *Beringei) serveQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		w.Header().Set("Allow", "GET, POST")
+		jsonError(w, http.StatusMethodNotAllowed, "invalid query method")
+		return
+	}
+
+	if b.output == nil {
+		jsonError(w, http.StatusNotFound, "no beringei outputs")
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		jsonError(w, http.StatusBadRequest, "unable to parse query")
+		return
+	}
+
+	end := time.Now().UnixNano()
+	if s := r.Form.Get("end"); s != "" {
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, "invalid end")
+			return
+		}
+		end = v
+	}
+	start := end - int64(beringeiDefaultQueryRange)
+	if s := r.Form.Get("start"); s != "" {
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, "invalid start")
+			return
+		}
+		start = v
+	}
+	if start > end {
+		jsonError(w, http.StatusBadRequest, "start is after end")
+		return
+	}
+
+	series, err := b.querySeries(r.Form)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	resp := &beringeiQueryResponse{Start: start, End: end, Series: series}
+	if len(series) > 0 {
+		resp.Errors = b.output.query(series, start, end)
+		if len(resp.Errors) == len(b.output.backends) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadGateway)
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// querySeries resolves the series of a query
+func (b *Beringei) querySeries(form url.Values) ([]*beringeiQuerySeries, error) {
+	series := make([]*beringeiQuerySeries, 0)
+
+	if ids := form["id"]; len(ids) > 0 {
+		if len(ids) > beringeiMaxQuerySeries {
+			return nil, fmt.Errorf("too many series, the limit is %d", beringeiMaxQuerySeries)
+		}
+		for _, id := range ids {
+			s := &beringeiQuerySeries{ID: id}
+			if canonical, ok := b.series.registry.value(id); ok {
+				s.Measurement, s.Tags, s.Field, _ = parseCanonicalSeries(canonical)
+			}
+			series = append(series, s)
+		}
+		return series, nil
+	}
+
+	measurement := form.Get("measurement")
+	if measurement == "" {
+		return nil, fmt.Errorf("missing parameter: id or measurement")
+	}
+
+	tags := make(map[string]string)
+	for _, t := range form["tag"] {
+		i := strings.IndexByte(t, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid tag %q, expected key=value", t)
+		}
+		tags[t[:i]] = t[i+1:]
+	}
+
+	fields := make(map[string]bool)
+	for _, f := range form["field"] {
+		fields[f] = true
+	}
+
+	match := func(canonical string) bool {
+		name, t, field, ok := parseCanonicalSeries(canonical)
+		if !ok || name != measurement {
+			return false
+		}
+		if len(fields) > 0 && !fields[field] {
+			return false
+		}
+		for k, v := range tags {
+			if t[k] != v {
+				return false
+			}
+		}
+		return true
+	}
+
+	ids := b.series.registry.match(match, beringeiMaxQuerySeries+1)
+	if len(ids) > beringeiMaxQuerySeries {
+		return nil, fmt.Errorf("too many series, the limit is %d", beringeiMaxQuerySeries)
+	}
+	for _, id := range ids {
+		s := &beringeiQuerySeries{ID: id}
+		if canonical, ok := b.series.registry.value(id); ok {
+			s.Measurement, s.Tags, s.Field, _ = parseCanonicalSeries(canonical)
+		}
+		series = append(series, s)
+	}
+
+	sort.Slice(series, func(i, j int) bool { return series[i].ID < series[j].ID })
+	return series, nil
+}
+
+// query reads the points of the series from every backend and merges
+// them into the series, returning the errors of the backends that failed
+func (o *beringeiOutput) query(series []*beringeiQuerySeries, start, end int64) []string {
+	q := url.Values{
+		"start": []string{strconv.FormatInt(start, 10)},
+		"end":   []string{strconv.FormatInt(end, 10)},
+	}
+	for _, s := range series {
+		q.Add("key", s.ID)
+	}
+	query := q.Encode()
+
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		errs   []string
+		merged = make(map[string]map[int64]float64)
+	)
+
+	wg.Add(len(o.backends))
+	for _, b := range o.backends {
+		b := b
+		go func() {
+			defer wg.Done()
+
+			points, err := b.query(query)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("backend %q: %v", b.name, err))
+				return
+			}
+			for id, ps := range points {
+				m, ok := merged[id]
+				if !ok {
+					m = make(map[int64]float64)
+					merged[id] = m
+				}
+				for _, p := range ps {
+					m[p.Timestamp] = p.Value
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, s := range series {
+		s.Points = make([]beringeiQueryPoint, 0, len(merged[s.ID]))
+		for ts, v := range merged[s.ID] {
+			s.Points = append(s.Points, beringeiQueryPoint{Timestamp: ts, Value: v})
+		}
+		sort.Slice(s.Points, func(i, j int) bool { return s.Points[i].Timestamp < s.Points[j].Timestamp })
+	}
+
+	sort.Strings(errs)
+	return errs
+}
+
+// query asks a backend for points, expecting a JSON object of
+// [timestamp, value] pairs by series ID
+func (b *beringeiBackend) query(query string) (map[string][]beringeiQueryPoint, error) {
+	resp, err := b.client.Get(b.queryLocation + "?" + query)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%d response", resp.StatusCode)
+	}
+
+	var points map[string][]beringeiQueryPoint
+	if err := json.NewDecoder(resp.Body).Decode(&points); err != nil {
+		return nil, err
+	}
+	return points, nil
+}
@@ -0,0 +1,178 @@
+package relay
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+// queryBackend answers Beringei queries with fixed points, recording the
+// queries it was sent
+func queryBackend(t *testing.T, status int, points string, queries chan<- url.Values) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/query" {
+			t.Errorf("query sent to %q", r.URL.Path)
+		}
+		if queries != nil {
+			queries <- r.URL.Query()
+		}
+		w.WriteHeader(status)
+		fmt.Fprint(w, points)
+	}))
+}
+
+func newQueryBeringei(t *testing.T, servers ...*httptest.Server) *Beringei {
+	t.Helper()
+	var outputs []BeringeiOutputConfig
+	for _, s := range servers {
+		outputs = append(outputs, BeringeiOutputConfig{Location: s.URL + "/update"})
+	}
+	return newTestBeringei(t, BeringeiConfig{Name: "b", SeriesID: "v1", Outputs: outputs})
+}
+
+func getQuery(b *Beringei, query string) (int, *beringeiQueryResponse) {
+	w := httptest.NewRecorder()
+	b.ServeHTTP(w, httptest.NewRequest("GET", "/query?"+query, nil))
+
+	resp := new(beringeiQueryResponse)
+	json.Unmarshal(w.Body.Bytes(), resp)
+	return w.Code, resp
+}
+
+func TestBeringeiQueryMergesOutputs(t *testing.T) {
+	queries := make(chan url.Values, 2)
+	s1 := queryBackend(t, http.StatusOK, `{"v1:aa": [[100, 1], [200, 2]]}`, queries)
+	defer s1.Close()
+	s2 := queryBackend(t, http.StatusOK, `{"v1:aa": [[200, 2], [300, 3.5]], "v1:bb": [[100, 7]]}`, queries)
+	defer s2.Close()
+
+	b := newQueryBeringei(t, s1, s2)
+
+	code, resp := getQuery(b, "id=v1:aa&id=v1:bb&start=50&end=400")
+	if code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", code, http.StatusOK)
+	}
+
+	for i := 0; i < 2; i++ {
+		q := <-queries
+		if !reflect.DeepEqual(q["key"], []string{"v1:aa", "v1:bb"}) || q.Get("start") != "50" || q.Get("end") != "400" {
+			t.Errorf("backend queried with %v", q)
+		}
+	}
+
+	if resp.Start != 50 || resp.End != 400 || len(resp.Errors) != 0 {
+		t.Errorf("got range %d-%d and errors %v", resp.Start, resp.End, resp.Errors)
+	}
+	if len(resp.Series) != 2 {
+		t.Fatalf("got %d series, want 2", len(resp.Series))
+	}
+	want := []beringeiQueryPoint{{100, 1}, {200, 2}, {300, 3.5}}
+	if got := resp.Series[0].Points; resp.Series[0].ID != "v1:aa" || !reflect.DeepEqual(got, want) {
+		t.Errorf("series %q has points %v, want %v", resp.Series[0].ID, got, want)
+	}
+	if got := resp.Series[1].Points; resp.Series[1].ID != "v1:bb" || !reflect.DeepEqual(got, []beringeiQueryPoint{{100, 7}}) {
+		t.Errorf("series %q has points %v", resp.Series[1].ID, got)
+	}
+}
+
+func TestBeringeiQueryBySeries(t *testing.T) {
+	queries := make(chan url.Values, 1)
+	s := queryBackend(t, http.StatusOK, `{}`, queries)
+	defer s.Close()
+
+	b := newQueryBeringei(t, s)
+
+	ids := make(map[string]string)
+	for _, canonical := range []string{
+		"cpu,host=a usage_idle",
+		"cpu,host=a usage_user",
+		"cpu,host=b usage_idle",
+		"mem,host=a free",
+	} {
+		id, sum := seriesIDv1(canonical)
+		b.series.registry.observeSum(id, sum, canonical)
+		ids[canonical] = id
+	}
+
+	code, resp := getQuery(b, "measurement=cpu&tag=host=a&field=usage_idle")
+	if code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", code, http.StatusOK)
+	}
+	if got := (<-queries)["key"]; !reflect.DeepEqual(got, []string{ids["cpu,host=a usage_idle"]}) {
+		t.Errorf("queried keys %v", got)
+	}
+
+	if len(resp.Series) != 1 {
+		t.Fatalf("got %d series, want 1", len(resp.Series))
+	}
+	got := resp.Series[0]
+	if got.Measurement != "cpu" || got.Field != "usage_idle" || !reflect.DeepEqual(got.Tags, map[string]string{"host": "a"}) {
+		t.Errorf("series described as %+v", got)
+	}
+	if got.Points == nil {
+		t.Error("series without points must have an empty list")
+	}
+
+	// every field of the matching series
+	_, resp = getQuery(b, "measurement=cpu&tag=host=a")
+	if len(resp.Series) != 2 {
+		t.Errorf("got %d series, want 2", len(resp.Series))
+	}
+	<-queries
+}
+
+func TestBeringeiQueryOutputErrors(t *testing.T) {
+	ok := queryBackend(t, http.StatusOK, `{"v1:aa": [[100, 1]]}`, nil)
+	defer ok.Close()
+	failing := queryBackend(t, http.StatusInternalServerError, ``, nil)
+	defer failing.Close()
+
+	// a failing output is reported next to the points of the others
+	code, resp := getQuery(newQueryBeringei(t, ok, failing), "id=v1:aa")
+	if code != http.StatusOK {
+		t.Errorf("got status %d, want %d", code, http.StatusOK)
+	}
+	if len(resp.Errors) != 1 || len(resp.Series) != 1 || len(resp.Series[0].Points) != 1 {
+		t.Errorf("got %+v", resp)
+	}
+
+	code, resp = getQuery(newQueryBeringei(t, failing), "id=v1:aa")
+	if code != http.StatusBadGateway {
+		t.Errorf("got status %d, want %d", code, http.StatusBadGateway)
+	}
+	if len(resp.Errors) != 1 {
+		t.Errorf("got errors %v", resp.Errors)
+	}
+}
+
+func TestBeringeiQueryInvalid(t *testing.T) {
+	s := queryBackend(t, http.StatusOK, `{}`, nil)
+	defer s.Close()
+	b := newQueryBeringei(t, s)
+
+	for _, query := range []string{
+		"",
+		"id=v1:aa&start=x",
+		"id=v1:aa&end=x",
+		"id=v1:aa&start=200&end=100",
+		"measurement=cpu&tag=host",
+	} {
+		if code, _ := getQuery(b, query); code != http.StatusBadRequest {
+			t.Errorf("%q: got status %d, want %d", query, code, http.StatusBadRequest)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	b.ServeHTTP(w, httptest.NewRequest("DELETE", "/query?id=v1:aa", nil))
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, POST" {
+		t.Errorf("DELETE: got status %d, Allow %q", w.Code, w.Header().Get("Allow"))
+	}
+
+	if code, _ := getQuery(newTestBeringei(t, BeringeiConfig{Name: "b"}), "id=v1:aa"); code != http.StatusNotFound {
+		t.Errorf("without outputs: got status %d, want %d", code, http.StatusNotFound)
+	}
+}
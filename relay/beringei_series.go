@@ -0,0 +1,96 @@
+package relay
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// beringeiSeries names the series of a Beringei relay and announces new
+// ones to Rabbitmq
+type beringeiSeries struct {
+	version  int
+	registry *seriesRegistry
+
+	publisher *amqpPublisher
+
+	// migration receives legacy to current ID mappings, nil unless migrating
+	migration *amqpPublisher
+}
+
+// seriesIDMapping tells consumers the ID a series had in older releases
+type seriesIDMapping struct {
+	OldID   string            `json:"oldId"`
+	NewID   string            `json:"newId"`
+	Version int               `json:"version"`
+	Name    string            `json:"name"`
+	Tags    map[string]string `json:"tags"`
+	Field   string            `json:"field"`
+}
+
+// parseSeriesIDVersion parses the series-id setting. Legacy IDs stay the
+// default so upgrades keep writing the existing series.
+func parseSeriesIDVersion(s string) (int, error) {
+	switch s {
+	case "", "legacy":
+		return SeriesIDLegacy, nil
+	case "v1":
+		return SeriesIDv1, nil
+	}
+	return 0, fmt.Errorf("unknown series-id %q", s)
+}
+
+// identify sets the ID of a point and announces its series if it is new.
+// It returns false if the ID already belongs to another series, in which
+// case the point must not be written. A series that could not be announced
+// is forgotten, so it is announced again with the next point.
+func (s *beringeiSeries) identify(p *BeringeiPoint, key []byte) bool {
+	canonical := canonicalSeries(p.Name, p.Tags, p.Field)
+
+	var sum uint64
+	if s.version == SeriesIDv1 {
+		p.ID, sum = seriesIDv1(canonical)
+	} else {
+		p.ID = legacySeriesID(key, p.Field)
+	}
+
+	// the canonical series lets queries find IDs by measurement and tags
+	isNew, collision := s.registry.observeSum(p.ID, sum, canonical)
+	if collision {
+		log.Printf("Series ID %s of %s is already used by another series, dropping the point", p.ID, canonical)
+		return false
+	}
+	if !isNew {
+		return true
+	}
+
+	if err := pushToRabbitmq(p, s.publisher); err != nil {
+		log.Println(err)
+		s.registry.forget(p.ID)
+		return true
+	}
+
+	if s.migration != nil {
+		b, _ := json.Marshal(&seriesIDMapping{
+			OldID:   legacySeriesID(key, p.Field),
+			NewID:   p.ID,
+			Version: s.version,
+			Name:    p.Name,
+			Tags:    p.Tags,
+			Field:   p.Field,
+		})
+		if err := s.migration.publish(b); err != nil {
+			log.Println(err)
+			s.registry.forget(p.ID)
+		}
+	}
+
+	return true
+}
+
+func (s *beringeiSeries) close() {
+	s.registry.close()
+	if s.migration != nil {
+		s.migration.release()
+	}
+}
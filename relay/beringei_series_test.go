@@ -0,0 +1,32 @@
+package relay
+
+import "testing"
+
+func TestBeringeiSeriesForgetsUnannounced(t *testing.T) {
+	registry, err := newSeriesRegistry(10, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the buffer holds a single announcement while Rabbitmq is unreachable
+	publisher := getAMQPPublisher(amqpPublisherConfig{URL: unreachableAMQP, RoutingKey: "identify-test", BufferSize: 1})
+	defer publisher.release()
+
+	s := &beringeiSeries{version: SeriesIDv1, registry: registry, publisher: publisher}
+
+	first := &BeringeiPoint{Name: "cpu", Tags: map[string]string{"host": "a"}, Field: "usage_idle"}
+	if !s.identify(first, []byte("cpu,host=a")) {
+		t.Fatal("identify rejected the first series")
+	}
+
+	second := &BeringeiPoint{Name: "cpu", Tags: map[string]string{"host": "b"}, Field: "usage_idle"}
+	if !s.identify(second, []byte("cpu,host=b")) {
+		t.Fatal("a series that could not be announced must still be written")
+	}
+
+	if _, ok := registry.value(first.ID); !ok {
+		t.Error("the announced series was forgotten")
+	}
+	if _, ok := registry.value(second.ID); ok {
+		t.Error("the series that could not be announced is still registered")
+	}
+}
@@ -0,0 +1,123 @@
+package relay
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestBeringei(t *testing.T, cfg BeringeiConfig) *Beringei {
+	t.Helper()
+	r, err := NewBeringei(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r.(*Beringei)
+}
+
+func postBeringei(b *Beringei, query, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	b.ServeHTTP(w, httptest.NewRequest("POST", "/write?"+query, strings.NewReader(body)))
+	return w
+}
+
+func TestBeringeiRejectsWritesWhenQueueIsFull(t *testing.T) {
+	// without Run no worker drains the queue
+	b := newTestBeringei(t, BeringeiConfig{Name: "b", QueueSize: 2})
+
+	for i := 0; i < 2; i++ {
+		if w := postBeringei(b, "db=test", "cpu,host=a usage_idle=1 1600000000000000000"); w.Code != http.StatusNoContent {
+			t.Fatalf("write %d: got status %d, want %d", i, w.Code, http.StatusNoContent)
+		}
+	}
+
+	w := postBeringei(b, "db=test", "cpu,host=a usage_idle=1 1600000000000000000")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if !strings.Contains(w.Body.String(), "too many pending writes") {
+		t.Errorf("unexpected body %q", w.Body.String())
+	}
+}
+
+func TestBeringeiRejectsBadWrites(t *testing.T) {
+	b := newTestBeringei(t, BeringeiConfig{Name: "b"})
+
+	if w := postBeringei(b, "", "cpu usage_idle=1"); w.Code != http.StatusBadRequest {
+		t.Errorf("missing db: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := postBeringei(b, "db=test", "cpu"); w.Code != http.StatusBadRequest {
+		t.Errorf("unparseable body: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if n := len(b.queue); n != 0 {
+		t.Errorf("%d rejected writes were queued", n)
+	}
+}
+
+func TestBeringeiUnavailableWithoutRabbitmq(t *testing.T) {
+	b := newTestBeringei(t, BeringeiConfig{Name: "b", AMQPUrl: unreachableAMQP})
+	b.publisher = getAMQPPublisher(b.publisherCfg)
+	defer b.publisher.release()
+
+	w := postBeringei(b, "db=test", "cpu,host=a usage_idle=1 1600000000000000000")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if len(b.queue) != 0 {
+		t.Error("a write was queued although new series cannot be announced")
+	}
+}
+
+func TestBeringeiStopDrainsQueue(t *testing.T) {
+	s := new(beringeiServer)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	b := newTestBeringei(t, BeringeiConfig{
+		Name:    "b",
+		Workers: 2,
+		Outputs: []BeringeiOutputConfig{{Location: srv.URL + "/update"}},
+	})
+
+	// queue the writes first, then start what Run starts besides serving
+	for _, body := range []string{
+		"cpu,host=a usage_idle=1.5,usage_user=2i 1600000000000000000",
+		"mem,host=a free=10i 1600000000000000000",
+	} {
+		if w := postBeringei(b, "db=test", body); w.Code != http.StatusNoContent {
+			t.Fatalf("got status %d, want %d", w.Code, http.StatusNoContent)
+		}
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.l = l
+	b.output.start()
+	b.wg.Add(b.workers)
+	for i := 0; i < b.workers; i++ {
+		go b.work()
+	}
+
+	if err := b.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []string
+	for _, body := range s.received() {
+		lines = append(lines, strings.Split(body, "\n")...)
+	}
+	if len(lines) != 3 {
+		t.Fatalf("got %d datapoints %q, want 3", len(lines), lines)
+	}
+	if got := strings.Join(lines, "\n"); !strings.Contains(got, " 1.5E+00 ") || !strings.Contains(got, " 10 ") {
+		t.Errorf("missing values in %q", got)
+	}
+
+	if w := postBeringei(b, "db=test", "cpu,host=a usage_idle=1 1600000000000000000"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("write after Stop: got status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
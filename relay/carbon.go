@@ -0,0 +1,573 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/golang/glog"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+const (
+	// maximum number of lines forwarded at once from a carbon TCP connection
+	carbonMaxBatch = 1000
+
+	// length of the longest carbon line accepted over TCP, longer lines
+	// are dropped
+	carbonMaxLineSize = 4 * KB
+
+	// number of carbon UDP packets waiting to be forwarded, beyond which
+	// they are dropped
+	carbonUDPQueueSize = 1024
+
+	// number of goroutines forwarding carbon UDP packets
+	carbonUDPWorkers = 4
+
+	defaultCarbonTemplate  = "measurement*"
+	defaultCarbonSeparator = "."
+)
+
+// carbonLine is a parsed carbon plaintext line
+type carbonLine struct {
+	path      string
+	tags      map[string]string
+	value     float64
+	timestamp int64
+}
+
+var errCarbonFormat = errors.New("expected 'path value timestamp'")
+
+// parseCarbonLine parses a "path value timestamp" line. A missing or
+// negative timestamp means now. Paths may carry graphite tags
+// (name;tag=value).
+func parseCarbonLine(line string, now time.Time) (*carbonLine, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 && len(fields) != 3 {
+		return nil, errCarbonFormat
+	}
+
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q", fields[1])
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil, fmt.Errorf("invalid value %q", fields[1])
+	}
+
+	ts := now.UnixNano()
+	if len(fields) == 3 {
+		t, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp %q", fields[2])
+		}
+		if t >= 0 {
+			ts = int64(t * float64(time.Second))
+		}
+	}
+
+	l := &carbonLine{
+		path:      fields[0],
+		value:     value,
+		timestamp: ts,
+	}
+
+	if i := strings.IndexByte(l.path, ';'); i >= 0 {
+		l.tags = make(map[string]string)
+		for _, kv := range strings.Split(l.path[i+1:], ";") {
+			if j := strings.IndexByte(kv, '='); j > 0 {
+				l.tags[kv[:j]] = kv[j+1:]
+			}
+		}
+		l.path = l.path[:i]
+	}
+
+	return l, nil
+}
+
+// carbonTemplate maps the components of a graphite path to an influx
+// measurement, tags and field, using the same template syntax as
+// InfluxDB's graphite input: "[filter] template [tag=value,...]"
+type carbonTemplate struct {
+	filter    []string
+	parts     []string
+	tags      map[string]string
+	separator string
+}
+
+func newCarbonTemplate(spec, separator string) (*carbonTemplate, error) {
+	fields := strings.Fields(spec)
+
+	t := &carbonTemplate{
+		tags:      make(map[string]string),
+		separator: separator,
+	}
+
+	var tmpl string
+	switch len(fields) {
+	case 1:
+		tmpl = fields[0]
+	case 2:
+		if strings.Contains(fields[1], "=") {
+			tmpl = fields[0]
+			if err := t.parseTags(fields[1]); err != nil {
+				return nil, err
+			}
+		} else {
+			t.filter = strings.Split(fields[0], ".")
+			tmpl = fields[1]
+		}
+	case 3:
+		t.filter = strings.Split(fields[0], ".")
+		tmpl = fields[1]
+		if err := t.parseTags(fields[2]); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("invalid template %q", spec)
+	}
+
+	t.parts = strings.Split(tmpl, ".")
+
+	wildcards := 0
+	for _, p := range t.parts {
+		if p == "measurement*" || p == "field*" {
+			wildcards++
+		}
+	}
+	if wildcards > 1 {
+		return nil, fmt.Errorf("invalid template %q: either 'measurement*' or 'field*' can be used, once", spec)
+	}
+
+	return t, nil
+}
+
+func (t *carbonTemplate) parseTags(s string) error {
+	for _, kv := range strings.Split(s, ",") {
+		i := strings.IndexByte(kv, '=')
+		if i <= 0 || i == len(kv)-1 {
+			return fmt.Errorf("invalid template tag %q", kv)
+		}
+		t.tags[kv[:i]] = kv[i+1:]
+	}
+	return nil
+}
+
+// matches reports whether the filter accepts the path components.
+// A filter component may use path.Match patterns, "*" matches any component.
+func (t *carbonTemplate) matches(parts []string) bool {
+	if len(t.filter) > len(parts) {
+		return false
+	}
+	for i, f := range t.filter {
+		if ok, _ := path.Match(f, parts[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// specificity ranks matching templates, exact filter components win over
+// wildcards and longer filters win over shorter ones
+func (t *carbonTemplate) specificity() int {
+	n := 0
+	for _, f := range t.filter {
+		n += 2
+		if !strings.ContainsAny(f, "*?[") {
+			n++
+		}
+	}
+	return n
+}
+
+// apply returns the measurement, tags and field for the path components
+func (t *carbonTemplate) apply(parts []string) (string, map[string]string, string) {
+	var measurement, field []string
+	tags := make(map[string]string)
+	tagParts := make(map[string][]string)
+
+	for i, tp := range t.parts {
+		if i >= len(parts) {
+			break
+		}
+
+		switch tp {
+		case "":
+		case "measurement":
+			measurement = append(measurement, parts[i])
+		case "measurement*":
+			measurement = append(measurement, parts[i:]...)
+		case "field":
+			field = append(field, parts[i])
+		case "field*":
+			field = append(field, parts[i:]...)
+		default:
+			tagParts[tp] = append(tagParts[tp], parts[i])
+		}
+	}
+
+	for k, v := range t.tags {
+		tags[k] = v
+	}
+	for k, v := range tagParts {
+		tags[k] = strings.Join(v, t.separator)
+	}
+
+	m := strings.Join(measurement, t.separator)
+	if m == "" {
+		m = strings.Join(parts, t.separator)
+	}
+
+	f := strings.Join(field, t.separator)
+	if f == "" {
+		f = "value"
+	}
+
+	return m, tags, f
+}
+
+// carbonParser picks the most specific template for every path
+type carbonParser struct {
+	templates []*carbonTemplate
+}
+
+func newCarbonParser(specs []string, separator string) (*carbonParser, error) {
+	if separator == "" {
+		separator = defaultCarbonSeparator
+	}
+
+	p := new(carbonParser)
+	for _, spec := range specs {
+		t, err := newCarbonTemplate(spec, separator)
+		if err != nil {
+			return nil, err
+		}
+		p.templates = append(p.templates, t)
+	}
+
+	// the default template catches everything no other template matched
+	def, _ := newCarbonTemplate(defaultCarbonTemplate, separator)
+	p.templates = append(p.templates, def)
+
+	sort.SliceStable(p.templates, func(i, j int) bool {
+		return p.templates[i].specificity() > p.templates[j].specificity()
+	})
+
+	return p, nil
+}
+
+// point converts a carbon line to an influx point
+func (p *carbonParser) point(l *carbonLine) (models.Point, error) {
+	parts := strings.Split(l.path, ".")
+
+	for _, t := range p.templates {
+		if !t.matches(parts) {
+			continue
+		}
+
+		measurement, tags, field := t.apply(parts)
+		for k, v := range l.tags {
+			tags[k] = v
+		}
+
+		return models.NewPoint(measurement, models.NewTags(tags), models.Fields{field: l.value}, time.Unix(0, l.timestamp))
+	}
+
+	return nil, fmt.Errorf("no template matched %q", l.path)
+}
+
+// carbonListener accepts carbon plaintext over TCP and UDP
+type carbonListener struct {
+	g    *GraphiteRelay
+	addr string
+
+	l net.Listener
+	c *net.UDPConn
+
+	// packets read from c, waiting to be forwarded
+	queue   chan []*carbonLine
+	dropped int64
+
+	closing int64
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+
+	wg sync.WaitGroup
+}
+
+func (c *carbonListener) run() error {
+	l, err := net.Listen("tcp", c.addr)
+	if err != nil {
+		return err
+	}
+	c.l = l
+
+	addr, err := net.ResolveUDPAddr("udp", c.addr)
+	if err != nil {
+		l.Close()
+		return err
+	}
+
+	uc, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		l.Close()
+		return err
+	}
+	c.c = uc
+
+	log.Infof("Starting carbon listener for relay %q on %v", c.g.Name(), c.addr)
+
+	c.queue = make(chan []*carbonLine, carbonUDPQueueSize)
+	c.conns = make(map[net.Conn]struct{})
+
+	c.wg.Add(2 + carbonUDPWorkers)
+	go c.serveUDP()
+	go c.serveTCP()
+	for i := 0; i < carbonUDPWorkers; i++ {
+		go c.forwardUDP()
+	}
+
+	return nil
+}
+
+func (c *carbonListener) stop() {
+	atomic.StoreInt64(&c.closing, 1)
+
+	if c.l != nil {
+		c.l.Close()
+	}
+	if c.c != nil {
+		c.c.Close()
+	}
+	c.closeConns()
+	c.wg.Wait()
+}
+
+// track registers an open connection, unless the listener is closing
+func (c *carbonListener) track(conn net.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if atomic.LoadInt64(&c.closing) != 0 {
+		return false
+	}
+	c.conns[conn] = struct{}{}
+	c.wg.Add(1)
+	return true
+}
+
+func (c *carbonListener) untrack(conn net.Conn) {
+	c.mu.Lock()
+	delete(c.conns, conn)
+	c.mu.Unlock()
+	c.wg.Done()
+}
+
+// closeConns interrupts the open connections
+func (c *carbonListener) closeConns() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for conn := range c.conns {
+		conn.Close()
+	}
+}
+
+func (c *carbonListener) serveTCP() {
+	defer c.wg.Done()
+
+	for {
+		conn, err := c.l.Accept()
+		if err != nil {
+			if atomic.LoadInt64(&c.closing) == 0 {
+				log.Errorf("Error accepting carbon connection in relay %q: %v", c.g.Name(), err)
+			}
+			return
+		}
+
+		if !c.track(conn) {
+			conn.Close()
+			continue
+		}
+		go c.handleConn(conn)
+	}
+}
+
+// handleConn parses the lines of a connection and forwards them in
+// batches. Lines longer than carbonMaxLineSize are dropped.
+func (c *carbonListener) handleConn(conn net.Conn) {
+	defer c.untrack(conn)
+	defer conn.Close()
+
+	r := bufio.NewReaderSize(conn, carbonMaxLineSize)
+	lines := make([]*carbonLine, 0, carbonMaxBatch)
+
+	skipping := false
+	for {
+		s, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			if !skipping {
+				log.Errorf("Dropping carbon line longer than %d bytes in relay %q from %v", carbonMaxLineSize, c.g.Name(), conn.RemoteAddr())
+			}
+			skipping = true
+			continue
+		}
+
+		// a line cut by a read error is incomplete, only the client
+		// closing the connection ends the last line
+		partial := err != nil && err != io.EOF && len(s) > 0 && s[len(s)-1] != '\n'
+
+		if skipping {
+			// this is the end of the long line
+			skipping = false
+		} else if partial {
+			log.Errorf("Dropping incomplete carbon line in relay %q from %v", c.g.Name(), conn.RemoteAddr())
+		} else if len(s) > 0 {
+			if l, perr := parseCarbonLine(string(s), time.Now()); perr != nil {
+				log.Errorf("Error parsing carbon line in relay %q from %v: %v", c.g.Name(), conn.RemoteAddr(), perr)
+			} else {
+				lines = append(lines, l)
+			}
+		}
+
+		// forward whenever the client pauses or the batch is full
+		if len(lines) > 0 && (err != nil || r.Buffered() == 0 || len(lines) == carbonMaxBatch) {
+			c.g.forwardCarbon(lines)
+			lines = make([]*carbonLine, 0, carbonMaxBatch)
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *carbonListener) serveUDP() {
+	defer c.wg.Done()
+	defer close(c.queue)
+
+	// buffer that can hold the largest possible UDP payload
+	var buf [65536]byte
+
+	reported := time.Now()
+	defer c.reportDrops()
+
+	for {
+		n, remote, err := c.c.ReadFromUDP(buf[:])
+		if err != nil {
+			if atomic.LoadInt64(&c.closing) == 0 {
+				log.Errorf("Error reading carbon packet in relay %q from %v: %v", c.g.Name(), remote, err)
+			}
+			return
+		}
+
+		now := time.Now()
+		var lines []*carbonLine
+		for _, s := range bytes.Split(buf[:n], []byte{'\n'}) {
+			if len(bytes.TrimSpace(s)) == 0 {
+				continue
+			}
+			l, err := parseCarbonLine(string(s), now)
+			if err != nil {
+				log.Errorf("Error parsing carbon line in relay %q from %v: %v", c.g.Name(), remote, err)
+				continue
+			}
+			lines = append(lines, l)
+		}
+
+		if len(lines) > 0 {
+			select {
+			case c.queue <- lines:
+			default:
+				atomic.AddInt64(&c.dropped, 1)
+			}
+		}
+
+		if now.Sub(reported) >= udpDropReportInterval {
+			c.reportDrops()
+			reported = now
+		}
+	}
+}
+
+// forwardUDP forwards the queued packets until the queue is closed
+func (c *carbonListener) forwardUDP() {
+	defer c.wg.Done()
+
+	for lines := range c.queue {
+		c.g.forwardCarbon(lines)
+	}
+}
+
+func (c *carbonListener) reportDrops() {
+	if n := atomic.SwapInt64(&c.dropped, 0); n > 0 {
+		log.Warningf("Relay %q dropped %d carbon packets, the forwarding queue was full", c.g.Name(), n)
+	}
+}
+
+// forwardCarbon writes received carbon lines unchanged to the graphite
+// outputs and, converted through the templates, to the influxdb outputs
+func (g *GraphiteRelay) forwardCarbon(lines []*carbonLine) {
+	gp := make([]graphitePoint, 0, len(lines))
+	for _, l := range lines {
+		p := l.path
+		if len(l.tags) > 0 {
+			p += graphiteTagString(l.tags)
+		}
+		gp = append(gp, graphitePoint{path: p, value: l.value, timestamp: l.timestamp})
+	}
+
+	if err := g.graphite.writeGraphitePoints(gp); err != nil {
+		log.Errorf("Problem forwarding carbon lines in relay %q: %v", g.Name(), err)
+	}
+
+	if len(g.influxdbBackends) == 0 {
+		return
+	}
+
+	buf := getBuf()
+	for _, l := range lines {
+		p, err := g.carbonParser.point(l)
+		if err != nil {
+			log.Errorf("Problem converting carbon line in relay %q: %v", g.Name(), err)
+			continue
+		}
+		buf.WriteString(p.String())
+		buf.WriteByte('\n')
+	}
+
+	if buf.Len() == 0 {
+		putBuf(buf)
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(g.influxdbBackends))
+	for _, b := range g.influxdbBackends {
+		b := b
+		go func() {
+			defer wg.Done()
+			resp, err := pushToInfluxdb(b, buf.Bytes(), g.influxdbQuery, "", "")
+			if err != nil {
+				log.Errorf("Problem posting to relay %q backend %q: %v", g.Name(), b.name, err)
+			} else if resp.StatusCode/100 != 2 {
+				log.Errorf("%d response for relay %q backend %q", resp.StatusCode, g.Name(), b.name)
+			}
+		}()
+	}
+	wg.Wait()
+	putBuf(buf)
+}
@@ -0,0 +1,218 @@
+package relay
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCarbonLine(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+
+	parse := func(line string) *carbonLine {
+		t.Helper()
+		l, err := parseCarbonLine(line, now)
+		if err != nil {
+			t.Fatalf("parseCarbonLine(%q): %v", line, err)
+		}
+		return l
+	}
+
+	if l := parse("servers.web01.load 1.5 1600000010\n"); l.path != "servers.web01.load" || l.value != 1.5 || l.timestamp != 1600000010*int64(time.Second) {
+		t.Errorf("got %+v", l)
+	}
+
+	// missing and negative timestamps mean now
+	if l := parse("servers.web01.load 2"); l.timestamp != now.UnixNano() {
+		t.Errorf("missing timestamp: got %d, want %d", l.timestamp, now.UnixNano())
+	}
+	if l := parse("servers.web01.load 2 -1"); l.timestamp != now.UnixNano() {
+		t.Errorf("negative timestamp: got %d, want %d", l.timestamp, now.UnixNano())
+	}
+
+	if l := parse("servers.web01.load 3 1600000010.5"); l.timestamp != 1600000010500*int64(time.Millisecond) {
+		t.Errorf("fractional timestamp: got %d", l.timestamp)
+	}
+
+	l := parse("disk.used;host=web01;mount=/ 10 1600000000")
+	if l.path != "disk.used" || !reflect.DeepEqual(l.tags, map[string]string{"host": "web01", "mount": "/"}) {
+		t.Errorf("tagged path: got %+v", l)
+	}
+
+	for _, line := range []string{
+		"servers.web01.load",
+		"servers.web01.load 1 2 3",
+		"servers.web01.load abc 1600000000",
+		"servers.web01.load NaN 1600000000",
+		"servers.web01.load 1 yesterday",
+	} {
+		if l, err := parseCarbonLine(line, now); err == nil {
+			t.Errorf("parseCarbonLine(%q) = %+v, want an error", line, l)
+		}
+	}
+}
+
+// carbonPoint converts path with a parser built from templates and returns
+// the measurement, tags and single field name of the point
+func carbonPoint(t *testing.T, templates []string, separator, path string, lineTags map[string]string) (string, map[string]string, string) {
+	t.Helper()
+
+	p, err := newCarbonParser(templates, separator)
+	if err != nil {
+		t.Fatalf("newCarbonParser(%q): %v", templates, err)
+	}
+
+	pt, err := p.point(&carbonLine{path: path, tags: lineTags, value: 1, timestamp: 1600000000 * int64(time.Second)})
+	if err != nil {
+		t.Fatalf("point(%q): %v", path, err)
+	}
+
+	fields, _ := pt.Fields()
+	if len(fields) != 1 {
+		t.Fatalf("point(%q) has fields %v, want one", path, fields)
+	}
+	var field string
+	for k := range fields {
+		field = k
+	}
+
+	return string(pt.Name()), pt.Tags().Map(), field
+}
+
+func TestCarbonTemplates(t *testing.T) {
+	check := func(templates []string, separator, path string, lineTags map[string]string, measurement string, tags map[string]string, field string) {
+		t.Helper()
+		m, tg, f := carbonPoint(t, templates, separator, path, lineTags)
+		if m != measurement || !reflect.DeepEqual(tg, tags) || f != field {
+			t.Errorf("%q with %q = %q %v %q, want %q %v %q", path, templates, m, tg, f, measurement, tags, field)
+		}
+	}
+	none := map[string]string{}
+
+	check(nil, "", "servers.web01.cpu", nil, "servers.web01.cpu", none, "value")
+	check([]string{"host.measurement.field"}, "", "web01.cpu.idle", nil, "cpu", map[string]string{"host": "web01"}, "idle")
+	check([]string{"measurement.field region=us,dc=1"}, "", "cpu.idle", nil, "cpu", map[string]string{"region": "us", "dc": "1"}, "idle")
+	check([]string{"region.region.measurement"}, "", "us.east.cpu", nil, "cpu", map[string]string{"region": "us.east"}, "value")
+	check([]string{"measurement.measurement.field*"}, "_", "disk.sda.read.bytes", nil, "disk_sda", none, "read_bytes")
+
+	// filters skip the empty template component, and a path the filter
+	// does not match falls back to the default template
+	filtered := []string{"servers.* .host.measurement*"}
+	check(filtered, "", "servers.web01.cpu.load", nil, "cpu.load", map[string]string{"host": "web01"}, "value")
+	check(filtered, "", "stats.web01.cpu", nil, "stats.web01.cpu", none, "value")
+
+	// exact filter components win over wildcards
+	specific := []string{"servers.* .host.measurement*", "servers.web01 .host.measurement.field"}
+	check(specific, "", "servers.web01.cpu.idle", nil, "cpu", map[string]string{"host": "web01"}, "idle")
+	check(specific, "", "servers.db01.cpu.idle", nil, "cpu.idle", map[string]string{"host": "db01"}, "value")
+
+	// tags on the line override template tags
+	check([]string{"host.measurement region=us"}, "", "web01.cpu",
+		map[string]string{"host": "web02", "region": "eu"},
+		"cpu", map[string]string{"host": "web02", "region": "eu"}, "value")
+}
+
+func TestCarbonTemplateErrors(t *testing.T) {
+	for _, spec := range []string{
+		"measurement*.field*",
+		"measurement*.measurement*",
+		"servers.* .host.measurement region=",
+		"a b c d",
+	} {
+		if _, err := newCarbonTemplate(spec, defaultCarbonSeparator); err == nil {
+			t.Errorf("newCarbonTemplate(%q): expected an error", spec)
+		}
+	}
+}
+
+// startCarbonListener runs a carbon listener forwarding to a graphite
+// output at location
+func startCarbonListener(t *testing.T, location string) *carbonListener {
+	t.Helper()
+
+	w, err := newGraphiteWriter([]GraphiteOutputConfig{{Name: "out", Location: location}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := &GraphiteRelay{name: "carbon-test", graphite: w}
+	g.carbonParser, _ = newCarbonParser(nil, "")
+
+	c := &carbonListener{g: g, addr: "127.0.0.1:0"}
+	if err := c.run(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCarbonTCPDropsLongLines(t *testing.T) {
+	out, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := out.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		received <- line
+	}()
+
+	c := startCarbonListener(t, out.Addr().String())
+	defer c.stop()
+
+	conn, err := net.Dial("tcp", c.l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("long." + strings.Repeat("x", carbonMaxLineSize) + " 1 1600000000\n"))
+	conn.Write([]byte("short.path 2 1600000000\n"))
+	conn.Close()
+
+	select {
+	case line := <-received:
+		if line != "short.path 2 1600000000\n" {
+			t.Errorf("forwarded %q, want only the short line", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing was forwarded")
+	}
+}
+
+func TestCarbonStopClosesConnections(t *testing.T) {
+	c := startCarbonListener(t, "127.0.0.1:1")
+
+	conn, err := net.Dial("tcp", c.l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// an unterminated line keeps the connection reading
+	conn.Write([]byte("partial.path 1"))
+
+	stopped := make(chan struct{})
+	go func() {
+		c.stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stop did not return while a client was connected")
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("the client connection is still open")
+	}
+}
@@ -0,0 +1,301 @@
+package relay
+
+import (
+	"strings"
+)
+
+// Mappings of telegraf plugins to the paths the equivalent collectd
+// plugins write, so graphite dashboards built for collectd keep working.
+
+// parseProcesses maps the processes input to collectd's processes plugin
+func parseProcesses(field string, value interface{}) (parsedMetric map[string]interface{}, metricNameFixed string) {
+	parsedMetric = map[string]interface{}{field: value}
+
+	switch field {
+	case "blocked",
+		"paging",
+		"running",
+		"sleeping",
+		"stopped",
+		"zombies":
+		return parsedMetric, "processes.ps_state"
+	default:
+		return parsedMetric, "processes_extra"
+	}
+}
+
+// collectd tcpconns states for the netstat input fields
+var tcpconnsStates = map[string]string{
+	"tcp_established": "ESTABLISHED",
+	"tcp_syn_sent":    "SYN_SENT",
+	"tcp_syn_recv":    "SYN_RECV",
+	"tcp_fin_wait1":   "FIN_WAIT1",
+	"tcp_fin_wait2":   "FIN_WAIT2",
+	"tcp_time_wait":   "TIME_WAIT",
+	"tcp_close":       "CLOSED",
+	"tcp_close_wait":  "CLOSE_WAIT",
+	"tcp_last_ack":    "LAST_ACK",
+	"tcp_listen":      "LISTEN",
+	"tcp_closing":     "CLOSING",
+}
+
+// parseNetstat maps the netstat input to collectd's tcpconns plugin
+// with AllPortsSummary enabled
+func parseNetstat(field string, value interface{}) (parsedMetric map[string]interface{}, metricNameFixed string) {
+	if state, ok := tcpconnsStates[field]; ok {
+		return map[string]interface{}{state: value}, "tcpconns.all.tcp_connections"
+	}
+
+	return map[string]interface{}{field: value}, "netstat_extra"
+}
+
+// parseKernel maps the kernel input to collectd's contextswitch,
+// entropy and processes plugins
+func parseKernel(field string, value interface{}) (parsedMetric map[string]interface{}, metricNameFixed string) {
+	switch field {
+	case "context_switches":
+		return map[string]interface{}{"value": value}, "contextswitch.contextswitch"
+	case "entropy_avail":
+		return map[string]interface{}{"value": value}, "entropy.entropy"
+	case "processes_forked":
+		return map[string]interface{}{"value": value}, "processes.fork_rate"
+	default:
+		return map[string]interface{}{field: value}, "kernel_extra"
+	}
+}
+
+// parseDocker maps the docker input per container, following the layout
+// of collectd's cpu, memory, interface and disk plugins
+func parseDocker(tags map[string]string, field, metricName string, value interface{}) (parsedMetric map[string]interface{}, metricNameFixed string) {
+	container := tags["container_name"]
+	fieldFix := field
+
+	switch metricName {
+	case "docker_container_cpu":
+		// per core usage is reported for the host cores, keep the total
+		if tags["cpu"] != "" && tags["cpu"] != "cpu-total" {
+			return nil, ""
+		}
+		metricNameFixed = "docker." + container + ".cpu"
+		switch field {
+		case "usage_percent":
+			fieldFix = "percent"
+		case "usage_in_usermode":
+			fieldFix = "user"
+		case "usage_in_kernelmode":
+			fieldFix = "system"
+		default:
+			metricNameFixed = "docker_extra." + container + ".cpu"
+		}
+	case "docker_container_mem":
+		metricNameFixed = "docker." + container + ".memory"
+		switch field {
+		case "usage":
+			fieldFix = "used"
+		case "cache":
+			fieldFix = "cached"
+		case "limit", "rss":
+		default:
+			metricNameFixed = "docker_extra." + container + ".memory"
+		}
+	case "docker_container_net":
+		network := tags["network"]
+		if network == "" {
+			network = "total"
+		}
+		metricNameFixed, fieldFix = dockerNet(field)
+		if metricNameFixed == "" {
+			metricNameFixed = "docker_extra." + container + ".interface"
+			fieldFix = field
+		} else {
+			metricNameFixed = "docker." + container + ".interface." + network + "." + metricNameFixed
+		}
+	case "docker_container_blkio":
+		metricNameFixed = "docker." + container + ".disk_octets"
+		switch field {
+		case "io_service_bytes_recursive_read":
+			fieldFix = "read"
+		case "io_service_bytes_recursive_write":
+			fieldFix = "write"
+		default:
+			metricNameFixed = "docker_extra." + container + ".disk"
+		}
+	default:
+		metricNameFixed = "docker_extra"
+		if container != "" {
+			metricNameFixed += "." + container
+		}
+	}
+
+	parsedMetric = map[string]interface{}{fieldFix: value}
+	return parsedMetric, metricNameFixed
+}
+
+func dockerNet(field string) (metricName, direction string) {
+	i := strings.IndexByte(field, '_')
+	if i < 0 {
+		return "", ""
+	}
+
+	switch field[:i] {
+	case "rx", "tx":
+		direction = field[:i]
+	default:
+		return "", ""
+	}
+
+	switch field[i+1:] {
+	case "bytes":
+		return "if_octets", direction
+	case "packets":
+		return "if_packets", direction
+	case "errors":
+		return "if_errors", direction
+	case "dropped":
+		return "if_dropped", direction
+	}
+
+	return "", ""
+}
+
+// parseNginx maps the nginx input to collectd's nginx plugin
+func parseNginx(field string, value interface{}) (parsedMetric map[string]interface{}, metricNameFixed string) {
+	switch field {
+	case "active", "reading", "writing", "waiting":
+		return map[string]interface{}{field: value}, "nginx.nginx_connections"
+	case "accepts":
+		return map[string]interface{}{"accepted": value}, "nginx.connections"
+	case "handled":
+		return map[string]interface{}{"handled": value}, "nginx.connections"
+	case "requests":
+		return map[string]interface{}{"value": value}, "nginx.nginx_requests"
+	default:
+		return map[string]interface{}{field: value}, "nginx_extra"
+	}
+}
+
+// parsePostgresql maps the postgresql input to the default queries of
+// collectd's postgresql plugin, per database
+func parsePostgresql(tags map[string]string, field string, value interface{}) (parsedMetric map[string]interface{}, metricNameFixed string) {
+	metricNameFixed = "postgresql." + tags["db"]
+	fieldFix := field
+
+	switch field {
+	case "numbackends":
+		metricNameFixed += ".pg_numbackends"
+		fieldFix = "value"
+	case "xact_commit":
+		metricNameFixed += ".pg_xact"
+		fieldFix = "commit"
+	case "xact_rollback":
+		metricNameFixed += ".pg_xact"
+		fieldFix = "rollback"
+	case "deadlocks":
+		metricNameFixed += ".pg_xact"
+		fieldFix = "num_deadlocks"
+	case "blks_read":
+		metricNameFixed += ".pg_blks"
+		fieldFix = "heap_read"
+	case "blks_hit":
+		metricNameFixed += ".pg_blks"
+		fieldFix = "heap_hit"
+	case "tup_inserted":
+		metricNameFixed += ".pg_n_tup_c"
+		fieldFix = "ins"
+	case "tup_updated":
+		metricNameFixed += ".pg_n_tup_c"
+		fieldFix = "upd"
+	case "tup_deleted":
+		metricNameFixed += ".pg_n_tup_c"
+		fieldFix = "del"
+	default:
+		metricNameFixed = "postgresql_extra." + tags["db"]
+	}
+
+	parsedMetric = map[string]interface{}{fieldFix: value}
+	return parsedMetric, metricNameFixed
+}
+
+// parseMysql maps the mysql input to collectd's mysql plugin
+func parseMysql(field string, value interface{}) (parsedMetric map[string]interface{}, metricNameFixed string) {
+	switch {
+	case strings.HasPrefix(field, "commands_"):
+		return map[string]interface{}{strings.TrimPrefix(field, "commands_"): value}, "mysql.mysql_commands"
+	case strings.HasPrefix(field, "handler_"):
+		return map[string]interface{}{strings.TrimPrefix(field, "handler_"): value}, "mysql.mysql_handler"
+	}
+
+	switch field {
+	case "threads_connected", "threads_running", "threads_cached":
+		return map[string]interface{}{strings.TrimPrefix(field, "threads_"): value}, "mysql.threads"
+	case "threads_created":
+		return map[string]interface{}{"created": value}, "mysql.total_threads"
+	case "bytes_received":
+		return map[string]interface{}{"rx": value}, "mysql.mysql_octets"
+	case "bytes_sent":
+		return map[string]interface{}{"tx": value}, "mysql.mysql_octets"
+	case "qcache_hits":
+		return map[string]interface{}{"hits": value}, "mysql.cache_result.qcache"
+	case "qcache_inserts":
+		return map[string]interface{}{"inserts": value}, "mysql.cache_result.qcache"
+	case "qcache_not_cached":
+		return map[string]interface{}{"not_cached": value}, "mysql.cache_result.qcache"
+	case "qcache_lowmem_prunes":
+		return map[string]interface{}{"prunes": value}, "mysql.cache_result.qcache"
+	default:
+		return map[string]interface{}{field: value}, "mysql_extra"
+	}
+}
+
+// parseRedis maps the redis input to collectd's redis plugin
+func parseRedis(tags map[string]string, field, metricName string, value interface{}) (parsedMetric map[string]interface{}, metricNameFixed string) {
+	if metricName == "redis_keyspace" {
+		return map[string]interface{}{field: value}, "redis.keyspace." + tags["database"]
+	}
+
+	switch field {
+	case "clients":
+		return map[string]interface{}{"clients": value}, "redis.current_connections"
+	case "connected_slaves":
+		return map[string]interface{}{"slaves": value}, "redis.current_connections"
+	case "used_memory":
+		return map[string]interface{}{"value": value}, "redis.memory"
+	case "total_connections_received":
+		return map[string]interface{}{"value": value}, "redis.total_connections"
+	case "total_commands_processed":
+		return map[string]interface{}{"value": value}, "redis.total_operations"
+	case "expired_keys":
+		return map[string]interface{}{"value": value}, "redis.expired_keys"
+	case "evicted_keys":
+		return map[string]interface{}{"value": value}, "redis.evicted_keys"
+	case "keyspace_hits":
+		return map[string]interface{}{"hits": value}, "redis.cache_result"
+	case "keyspace_misses":
+		return map[string]interface{}{"misses": value}, "redis.cache_result"
+	case "uptime":
+		return map[string]interface{}{"value": value}, "redis.uptime"
+	default:
+		return map[string]interface{}{field: value}, "redis_extra"
+	}
+}
+
+// parsePing maps the ping input to collectd's ping plugin. Like collectd's
+// graphite writer, dots in the target host are escaped.
+func parsePing(tags map[string]string, field string, value interface{}) (parsedMetric map[string]interface{}, metricNameFixed string) {
+	host := strings.Replace(tags["url"], ".", "_", -1)
+
+	switch field {
+	case "average_response_ms":
+		return map[string]interface{}{host: value}, "ping.ping"
+	case "standard_deviation_ms":
+		return map[string]interface{}{host: value}, "ping.ping_stddev"
+	case "percent_packet_loss":
+		// collectd reports the drop rate as a ratio
+		if v, ok := graphiteValue(value); ok {
+			value = v / 100
+		}
+		return map[string]interface{}{host: value}, "ping.ping_droprate"
+	default:
+		return map[string]interface{}{field: value}, "ping_extra." + host
+	}
+}
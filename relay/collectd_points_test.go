@@ -0,0 +1,45 @@
+package relay
+
+import "testing"
+
+func TestGraphitePluginMappings(t *testing.T) {
+	const ts = " 1600000000000000000"
+
+	got := translateLines(t, TranslateConfig{MachineID: "m1"},
+		"processes running=3i,zombies=1i,total=10i"+ts,
+		"netstat tcp_established=4i"+ts,
+		"kernel context_switches=100i,interrupts=5i"+ts,
+		"nginx active=2i,requests=10i"+ts,
+		"postgresql,db=app xact_commit=5i,numbackends=3i"+ts,
+		"mysql threads_connected=4i,bytes_received=10i"+ts,
+		"redis used_memory=100i,connected_clients=2i"+ts,
+		"redis_keyspace,database=db0 keys=5i"+ts,
+		"ping,url=example.org average_response_ms=1.5,percent_packet_loss=0"+ts,
+		"docker_container_cpu,container_name=web,cpu=cpu-total usage_percent=5"+ts,
+		"docker_container_mem,container_name=web usage=100i"+ts,
+		"docker_container_net,container_name=web,network=eth0 rx_bytes=7i"+ts,
+	)
+
+	checkLines(t, got,
+		"bucky.m1.processes.ps_state.running 3 1600000000",
+		"bucky.m1.processes.ps_state.zombies 1 1600000000",
+		"bucky.m1.processes_extra.total 10 1600000000",
+		"bucky.m1.tcpconns.all.tcp_connections.ESTABLISHED 4 1600000000",
+		"bucky.m1.contextswitch.contextswitch 100 1600000000",
+		"bucky.m1.kernel_extra.interrupts 5 1600000000",
+		"bucky.m1.nginx.nginx_connections.active 2 1600000000",
+		"bucky.m1.nginx.nginx_requests 10 1600000000",
+		"bucky.m1.postgresql.app.pg_xact.commit 5 1600000000",
+		"bucky.m1.postgresql.app.pg_numbackends 3 1600000000",
+		"bucky.m1.mysql.threads.connected 4 1600000000",
+		"bucky.m1.mysql.mysql_octets.rx 10 1600000000",
+		"bucky.m1.redis.memory 100 1600000000",
+		"bucky.m1.redis_extra.connected_clients 2 1600000000",
+		"bucky.m1.redis.keyspace.db0.keys 5 1600000000",
+		"bucky.m1.ping.ping.example_org 1.5 1600000000",
+		"bucky.m1.ping.ping_droprate.example_org 0 1600000000",
+		"bucky.m1.docker.web.cpu.percent 5 1600000000",
+		"bucky.m1.docker.web.memory.used 100 1600000000",
+		"bucky.m1.docker.web.interface.eth0.if_octets.rx 7 1600000000",
+	)
+}
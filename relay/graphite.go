@@ -6,7 +6,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
-	"sync"
+	"net/url"
 	"sync/atomic"
 	"time"
 	"unicode/utf8"
@@ -15,15 +15,8 @@ import (
 
 	"github.com/influxdata/influxdb/models"
 	"github.com/influxdata/telegraf"
-	"github.com/influxdata/telegraf/plugins/outputs/graphite"
-	"github.com/robfig/cron"
 )
 
-// Metering Read-Write mutex
-var mu = &sync.RWMutex{}
-var metering = make(map[string]map[string]int)
-var amqpURL string
-
 // GraphiteRelay is a relay for graphite backends
 type GraphiteRelay struct {
 	addr string
@@ -35,15 +28,23 @@ type GraphiteRelay struct {
 	closing int64
 	l       net.Listener
 
-	enableMetering bool
-	ampqURL        string
+	// metering is nil unless enabled
+	metering *meter
+
+	// meteringQueryToken authorizes GET /metering, disabled if empty
+	meteringQueryToken string
 
 	dropUnauthorized bool
 
-	cronJob      *cron.Cron
-	cronSchedule string
+	defaultSourceType string
+
+	graphite *graphiteWriter
 
-	backends []*graphiteBackend
+	// carbon plaintext input
+	carbon           *carbonListener
+	carbonParser     *carbonParser
+	influxdbBackends []*httpBackend
+	influxdbQuery    string
 }
 
 func (g *GraphiteRelay) Name() string {
@@ -57,9 +58,8 @@ func (g *GraphiteRelay) Name() string {
 func (g *GraphiteRelay) Run() error {
 	l, err := net.Listen("tcp", g.addr)
 
-	if g.cronSchedule != "" {
-		g.cronJob.AddFunc(g.cronSchedule, pushToAmqp)
-		g.cronJob.Start()
+	if g.metering != nil {
+		g.metering.start()
 	}
 
 	if err != nil {
@@ -79,6 +79,13 @@ func (g *GraphiteRelay) Run() error {
 	}
 	g.l = l
 
+	if g.carbon != nil {
+		if err := g.carbon.run(); err != nil {
+			l.Close()
+			return err
+		}
+	}
+
 	log.Infof("Starting Graphite relay %q on %v", g.Name(), g.addr)
 	err = http.Serve(l, g)
 	if atomic.LoadInt64(&g.closing) != 0 {
@@ -90,8 +97,11 @@ func (g *GraphiteRelay) Run() error {
 
 func (g *GraphiteRelay) Stop() error {
 	atomic.StoreInt64(&g.closing, 1)
-	if g.cronSchedule != "" {
-		g.cronJob.Stop()
+	if g.metering != nil {
+		g.metering.stop()
+	}
+	if g.carbon != nil {
+		g.carbon.stop()
 	}
 	return g.l.Close()
 
@@ -110,88 +120,95 @@ func NewGraphiteRelay(cfg GraphiteConfig) (Relay, error) {
 		g.schema = "https"
 	}
 
-	for i := range cfg.Outputs {
-		backend, err := NewGraphiteBackend(&cfg.Outputs[i])
+	w, err := newGraphiteWriter(cfg.Outputs)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cfg.Routing {
+	case "", "random":
+	case "consistent-hashing":
+		if err := w.useConsistentHashing(cfg.HashType, cfg.ReplicationFactor); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown graphite routing %q", cfg.Routing)
+	}
+	g.graphite = w
+
+	if cfg.CarbonAddr != "" {
+		g.carbon = &carbonListener{g: g, addr: cfg.CarbonAddr}
+
+		g.carbonParser, err = newCarbonParser(cfg.Templates, cfg.Separator)
 		if err != nil {
 			return nil, err
 		}
 
-		g.backends = append(g.backends, backend)
-	}
+		for i := range cfg.InfluxDBOutputs {
+			out := &cfg.InfluxDBOutputs[i]
+			out.BackendType = "influxdb"
+			backend, err := newHTTPBackend(out)
+			if err != nil {
+				return nil, err
+			}
 
-	g.enableMetering = cfg.EnableMetering
-	g.ampqURL = cfg.AMQPUrl
-	amqpURL = cfg.AMQPUrl
+			g.influxdbBackends = append(g.influxdbBackends, backend)
+		}
 
-	if g.enableMetering && g.ampqURL == "" {
-		g.enableMetering = false
-		log.Warning("You have to set AMQPUrl in config for metering to work")
+		if len(g.influxdbBackends) > 0 && cfg.InfluxDBDatabase == "" {
+			return nil, fmt.Errorf("missing influxdb-database for relay %q", g.Name())
+		}
+		g.influxdbQuery = url.Values{"db": []string{cfg.InfluxDBDatabase}}.Encode()
+	}
+
+	enableMetering := cfg.EnableMetering
+	if enableMetering && cfg.AMQPUrl == "" && len(cfg.MeteringSinks) == 0 {
+		enableMetering = false
+		log.Warning("You have to set AMQPUrl or a metering-sink in config for metering to work")
 		log.Warning("Disabling metering for now")
 	}
 
 	g.dropUnauthorized = cfg.DropUnauthorized
+	g.meteringQueryToken = cfg.MeteringQueryToken
 
-	g.cronSchedule = cfg.CronSchedule
-
-	if g.cronSchedule != "" {
-		g.cronJob = cron.New()
+	g.defaultSourceType = cfg.DefaultSourceType
+	if g.defaultSourceType != "" && !validGraphiteProfile(g.defaultSourceType) {
+		return nil, fmt.Errorf("unknown default-source-type %q", g.defaultSourceType)
 	}
 
-	return g, nil
-}
+	if enableMetering {
+		sinks, err := newMeteringSinks(cfg.MeteringSinks, amqpConfig(cfg.AMQPUrl, cfg.AMQPExchange, cfg.AMQPRoutingKey, cfg.AMQPBufferSize, cfg.AMQPTransientQueue, "metering"))
+		if err != nil {
+			return nil, err
+		}
 
-// NewGraphiteBackend Initializes a new Graphite Backend
-func NewGraphiteBackend(cfg *GraphiteOutputConfig) (*graphiteBackend, error) {
-	if cfg.Name == "" {
-		cfg.Name = cfg.Location
+		m, err := newMeter(g.Name(), cfg.MeteringStateFile, cfg.CronSchedule, sinks)
+		if err != nil {
+			for _, s := range sinks {
+				s.close()
+			}
+			return nil, err
+		}
+		g.metering = m
 	}
 
-	return &graphiteBackend{
-		name:     cfg.Name,
-		location: cfg.Location,
-	}, nil
-}
-
-type graphiteBackend struct {
-	// poster
-	name string
-
-	location string
+	return g, nil
 }
 
 func (g *GraphiteRelay) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 
-	graphiteServers := make([]string, len(g.backends))
-	for i := range g.backends {
-		graphiteServers = append(graphiteServers, g.backends[i].location)
-	}
-	graphiteClient := &graphite.Graphite{
-		Servers: graphiteServers,
-		Prefix:  "bucky",
-	}
+	queryParams := r.URL.Query()
 
-	conErr := graphiteClient.Connect()
-	if conErr != nil {
-		jsonError(w, http.StatusInternalServerError, "unable to connect to graphite")
-		log.Fatalf("Could not connect to graphite: %s", conErr)
+	if r.URL.Path == "/metering" {
+		serveMetering(w, r, g.metering, g.meteringQueryToken)
+		return
 	}
 
-	queryParams := r.URL.Query()
-
-	// if r.URL.Path == "/metrics" {
-	// 	resp := ""
-	// 	t := time.Now().UnixNano()
-	// 	mu.RLock()
-	// 	for orgID, machineMap := range metering {
-	// 		for machineID, samples := range machineMap {
-	// 			resp += fmt.Sprintf("gocky_samples_total{relay=graphite,orgID=%s,machineID=%s} %d %d\n", orgID, machineID, samples, t)
-	// 		}
-	// 	}
-	// 	mu.RUnlock()
-	// 	io.WriteString(w, resp)
-	// 	return
-	// }
+	if r.URL.Path == "/translate" {
+		serveTranslate(w, r, []*graphiteWriter{g.graphite}, g.defaultSourceType)
+		return
+	}
 
 	if r.URL.Path != "/write" {
 		jsonError(w, 204, "Dummy response for db creation")
@@ -235,126 +252,100 @@ func (g *GraphiteRelay) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	sourceType := "unix"
+	orgID := "Unauthorized"
+	if r.Header["X-Gocky-Tag-Org-Id"] != nil {
+		orgID = r.Header["X-Gocky-Tag-Org-Id"][0]
+	}
 
-	if r.Header["X-Gocky-Tag-Source-Type"][0] == "windows" {
-		sourceType = "windows"
+	src := graphiteSource{
+		OrgID:             orgID,
+		MachineID:         machineID,
+		SourceType:        r.Header.Get("X-Gocky-Tag-Source-Type"),
+		DefaultSourceType: g.defaultSourceType,
+	}
+	if src.MachineID == "" {
+		src.MachineID = unknownMachineID(points)
 	}
 
-	go pushToGraphite(points, graphiteClient, machineID, sourceType)
+	go pushToGraphite(points, g.graphite, src)
 
-	if g.enableMetering {
-		orgID := "Unauthorized"
-		if r.Header["X-Gocky-Tag-Org-Id"] != nil {
-			orgID = r.Header["X-Gocky-Tag-Org-Id"][0]
-		}
-		machineID := ""
-		if r.Header["X-Gocky-Tag-Machine-Id"] != nil {
-			machineID = r.Header["X-Gocky-Tag-Machine-Id"][0]
-		}
+	if g.metering != nil {
+		g.metering.add(orgID, machineID, newMeteringUsage(points, bodyBuf.Len()))
+	}
 
-		mu.Lock()
+	// telegraf expects a 204 response on write
+	w.WriteHeader(204)
+}
 
-		_, orgExists := metering[orgID]
-		if !orgExists {
-			metering[orgID] = make(map[string]int)
-		}
+// pushToGraphite writes points to graphite, retrying on failure. Only the
+// backends that failed are retried, so the others never get points twice.
+func pushToGraphite(points []models.Point, g *graphiteWriter, src graphiteSource) error {
+	render := g.renderer(points, src)
+	failed, err := g.writeRoutes(g.route(render), src.MachineID, render)
 
-		_, machExists := metering[orgID][machineID]
-		if !machExists {
-			metering[orgID][machineID] = len(points)
-		} else {
-			metering[orgID][machineID] += len(points)
+	for i := 0; i < 3; i++ {
+		if err == nil {
+			break
 		}
-
-		mu.Unlock()
+		log.Error(err)
+		log.Errorf("Retrying to send datapoints to %d graphite backends, from machine: %s", len(failed), src.MachineID)
+		time.Sleep(1000 * time.Millisecond)
+		failed, err = g.writeRoutes(failed, src.MachineID, render)
 	}
 
-	// telegraf expects a 204 response on write
-	w.WriteHeader(204)
+	return err
 }
 
-func pushToGraphite(points []models.Point, g *graphite.Graphite, machineID, sourceType string) (*responseData, error) {
+// unknownMachineID is the machine id used for points that came without
+// Gocky headers. It is derived from the machine_id tag of the first point.
+func unknownMachineID(points []models.Point) string {
+	if len(points) == 0 {
+		return "Unknown."
+	}
+	return "Unknown." + string(points[0].Tags().Get([]byte("machine_id")))
+}
+
+// graphiteMetrics maps points to graphite compatible metrics, using the
+// mapping profile of their source type.
+// If src.MachineID is set, it overrides the machine_id tag of every point.
+// Tag values and field keys are sanitized with the given policy before
+// they become path components.
+func graphiteMetrics(points []models.Point, src graphiteSource, sanitize string) []telegraf.Metric {
+	graphiteMetrics := make([]telegraf.Metric, 0, len(points))
+
 	for _, p := range points {
 		tags := make(map[string]string)
 		for _, v := range p.Tags() {
-			tags[string(v.Key)] = string(v.Value)
+			tags[string(v.Key)] = sanitizeGraphiteComponent(sanitize, string(v.Value))
 		}
-		if machineID == "" {
-			machineID = "Unknown." + tags["machine_id"]
+		if src.MachineID != "" {
+			tags["machine_id"] = sanitizeGraphiteComponent(sanitize, src.MachineID)
 		}
-		tags["machine_id"] = machineID
-		graphiteMetrics := make([]telegraf.Metric, 0, len(points))
+		mapper := graphiteProfile(src, tags)
+
 		fi := p.FieldIterator()
 		for fi.Next() {
+			var v interface{}
 			switch fi.Type() {
 			case models.Float:
-				v, _ := fi.FloatValue()
-				if utf8.ValidString(string(fi.FieldKey())) {
-					switch sourceType {
-					case "windows":
-						grphPoint := GraphiteWindowsMetric(string(p.Name()), tags, p.UnixNano(), v, string(fi.FieldKey()))
-						if grphPoint != nil {
-							graphiteMetrics = append(graphiteMetrics, grphPoint)
-						}
-					default:
-						grphPoint := GraphiteMetric(string(p.Name()), tags, p.UnixNano(), v, string(fi.FieldKey()))
-						if grphPoint != nil {
-							graphiteMetrics = append(graphiteMetrics, grphPoint)
-						}
-					}
-				}
+				v, _ = fi.FloatValue()
 			case models.Integer:
-				v, _ := fi.IntegerValue()
-				if utf8.ValidString(string(fi.FieldKey())) {
-					switch sourceType {
-					case "windows":
-						grphPoint := GraphiteWindowsMetric(string(p.Name()), tags, p.UnixNano(), v, string(fi.FieldKey()))
-						if grphPoint != nil {
-							graphiteMetrics = append(graphiteMetrics, grphPoint)
-						}
-					default:
-						grphPoint := GraphiteMetric(string(p.Name()), tags, p.UnixNano(), v, string(fi.FieldKey()))
-						if grphPoint != nil {
-							graphiteMetrics = append(graphiteMetrics, grphPoint)
-						}
-					}
-				}
-				// case models.String:
-				// 	log.Println("String values not supported")
-				// case models.Boolean:
-				// 	log.Println("Boolean values not supported")
-				// case models.Empty:
-				// 	log.Println("Empry values not supported")
-				// default:
-				// 	log.Println("Unknown value type")
+				v, _ = fi.IntegerValue()
+			default:
+				continue
 			}
-		}
-
-		err := g.Write(graphiteMetrics)
-		if log.V(5) {
-			log.Infof("Sending datapoints to graphite backend: %s, from machine: %s", g.Servers[0], machineID)
-		}
 
-		for i := 0; i < 3; i++ {
-			if err == nil {
-				break
+			if !utf8.ValidString(string(fi.FieldKey())) {
+				continue
 			}
-			log.Error(err)
-			log.Errorf("Retrying to send datapoints to graphite backend: %s, from machine: %s", g.Servers[0], machineID)
-			time.Sleep(1000 * time.Millisecond)
-			err = g.Write(graphiteMetrics)
-		}
+			field := sanitizeGraphiteComponent(sanitize, string(fi.FieldKey()))
 
-		if err != nil {
-			return nil, err
+			grphPoint := mapper(string(p.Name()), tags, p.UnixNano(), v, field)
+			if grphPoint != nil {
+				graphiteMetrics = append(graphiteMetrics, grphPoint)
+			}
 		}
 	}
 
-	return &responseData{
-		ContentType:     "",
-		ContentEncoding: "",
-		StatusCode:      200,
-		Body:            nil,
-	}, nil
+	return graphiteMetrics
 }
@@ -0,0 +1,141 @@
+package relay
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+)
+
+const (
+	// carbon places every destination 100 times on the ring
+	graphiteRingReplicas = 100
+
+	graphiteHashCarbon = "carbon_ch"
+	graphiteHashFNV1a  = "fnv1a_ch"
+)
+
+type graphiteRingEntry struct {
+	position int
+	node     int
+}
+
+// graphiteHashRing is a port of carbon's ConsistentHashRing, so that paths
+// are routed to the same destinations carbon-relay would pick.
+type graphiteHashRing struct {
+	hashType string
+	nodes    int
+	ring     []graphiteRingEntry
+}
+
+// newGraphiteHashRing builds a ring for the given node keys. Node keys are
+// the (server, instance) pairs of the backends as formatted by carbon.
+func newGraphiteHashRing(hashType string, keys []string) (*graphiteHashRing, error) {
+	switch hashType {
+	case "":
+		hashType = graphiteHashCarbon
+	case graphiteHashCarbon, graphiteHashFNV1a:
+	default:
+		return nil, fmt.Errorf("unknown hash type %q", hashType)
+	}
+
+	r := &graphiteHashRing{
+		hashType: hashType,
+		nodes:    len(keys),
+	}
+
+	taken := make(map[int]bool)
+	for node, key := range keys {
+		for i := 0; i < graphiteRingReplicas; i++ {
+			var replicaKey string
+			if hashType == graphiteHashFNV1a {
+				replicaKey = fmt.Sprintf("%d-%s", i, key)
+			} else {
+				replicaKey = fmt.Sprintf("%s:%d", key, i)
+			}
+
+			position := r.position(replicaKey)
+			for taken[position] {
+				position++
+			}
+			taken[position] = true
+
+			r.ring = append(r.ring, graphiteRingEntry{position, node})
+		}
+	}
+
+	sort.Slice(r.ring, func(i, j int) bool {
+		return r.ring[i].position < r.ring[j].position
+	})
+
+	return r, nil
+}
+
+func (r *graphiteHashRing) position(key string) int {
+	if r.hashType == graphiteHashFNV1a {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		big := h.Sum32()
+		return int((big >> 16) ^ (big & 0xffff))
+	}
+
+	sum := md5.Sum([]byte(key))
+	return int(binary.BigEndian.Uint16(sum[:2]))
+}
+
+// get returns up to n distinct nodes for key, in ring order
+func (r *graphiteHashRing) get(key string, n int) []int {
+	if len(r.ring) == 0 {
+		return nil
+	}
+	if n > r.nodes {
+		n = r.nodes
+	}
+
+	position := r.position(key)
+	index := sort.Search(len(r.ring), func(i int) bool {
+		return r.ring[i].position >= position
+	}) % len(r.ring)
+
+	nodes := make([]int, 0, n)
+	for i := 0; i < len(r.ring) && len(nodes) < n; i++ {
+		node := r.ring[(index+i)%len(r.ring)].node
+		found := false
+		for _, seen := range nodes {
+			if seen == node {
+				found = true
+				break
+			}
+		}
+		if !found {
+			nodes = append(nodes, node)
+		}
+	}
+
+	return nodes
+}
+
+// graphiteNodeKey formats a backend the way carbon formats its
+// (server, instance) destination keys
+func graphiteNodeKey(hashType string, b *graphiteBackend) string {
+	server := b.location
+	if i := strings.LastIndex(server, ":"); i >= 0 {
+		server = server[:i]
+	}
+	server = strings.Trim(server, "[]")
+
+	if hashType == graphiteHashFNV1a {
+		// carbon-c-relay compatible, the instance defaults to server:port
+		if b.instance != "" {
+			return b.instance
+		}
+		return b.location
+	}
+
+	if b.instance == "" {
+		return fmt.Sprintf("('%s', None)", server)
+	}
+	return fmt.Sprintf("('%s', '%s')", server, b.instance)
+}
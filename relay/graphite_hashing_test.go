@@ -0,0 +1,101 @@
+package relay
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGraphiteNodeKey(t *testing.T) {
+	check := func(hashType string, b *graphiteBackend, want string) {
+		t.Helper()
+		if got := graphiteNodeKey(hashType, b); got != want {
+			t.Errorf("graphiteNodeKey(%q, %q/%q) = %q, want %q", hashType, b.location, b.instance, got, want)
+		}
+	}
+
+	check(graphiteHashCarbon, &graphiteBackend{location: "10.0.0.1:2003"}, "('10.0.0.1', None)")
+	check(graphiteHashCarbon, &graphiteBackend{location: "127.0.0.1:2004", instance: "a"}, "('127.0.0.1', 'a')")
+	check(graphiteHashCarbon, &graphiteBackend{location: "[::1]:2003"}, "('::1', None)")
+	check(graphiteHashFNV1a, &graphiteBackend{location: "10.0.0.1:2003"}, "10.0.0.1:2003")
+	check(graphiteHashFNV1a, &graphiteBackend{location: "10.0.0.1:2003", instance: "cache-a"}, "cache-a")
+}
+
+func newTestHashRing(t *testing.T, hashType string, backends ...*graphiteBackend) *graphiteHashRing {
+	t.Helper()
+
+	keys := make([]string, len(backends))
+	for i, b := range backends {
+		keys[i] = graphiteNodeKey(hashType, b)
+	}
+
+	r, err := newGraphiteHashRing(hashType, keys)
+	if err != nil {
+		t.Fatalf("newGraphiteHashRing(%q, %q): %v", hashType, keys, err)
+	}
+	return r
+}
+
+// The expected nodes come from carbon's ConsistentHashRing
+// (lib/carbon/hashing.py) fed with the same destinations, as indexes into
+// the backends.
+func TestGraphiteHashRingPlacement(t *testing.T) {
+	threeHosts := []*graphiteBackend{
+		{location: "10.0.0.1:2003"},
+		{location: "10.0.0.2:2003"},
+		{location: "10.0.0.3:2003"},
+	}
+
+	carbon := newTestHashRing(t, graphiteHashCarbon, threeHosts...)
+	for path, want := range map[string][]int{
+		"bucky.m1.cpu.0.user":             {1, 2},
+		"bucky.m2.memory.free":            {2, 1},
+		"carbon.agents.a.metricsReceived": {0, 2},
+		"x":                               {1, 0},
+		"servers.web01.load.shortterm":    {1, 2},
+	} {
+		if got := carbon.get(path, 2); !reflect.DeepEqual(got, want) {
+			t.Errorf("carbon_ch get(%q, 2) = %v, want %v", path, got, want)
+		}
+		// the first replica is the node a single copy goes to
+		if got := carbon.get(path, 1); !reflect.DeepEqual(got, want[:1]) {
+			t.Errorf("carbon_ch get(%q, 1) = %v, want %v", path, got, want[:1])
+		}
+	}
+
+	fnv := newTestHashRing(t, graphiteHashFNV1a, threeHosts...)
+	for path, want := range map[string][]int{
+		"bucky.m1.cpu.0.user":          {0, 1},
+		"bucky.m2.memory.free":         {2, 0},
+		"x":                            {2, 1},
+		"servers.web01.load.shortterm": {0, 2},
+	} {
+		if got := fnv.get(path, 2); !reflect.DeepEqual(got, want) {
+			t.Errorf("fnv1a_ch get(%q, 2) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestGraphiteHashRingInstances(t *testing.T) {
+	r := newTestHashRing(t, graphiteHashCarbon,
+		&graphiteBackend{location: "127.0.0.1:2003", instance: "a"},
+		&graphiteBackend{location: "127.0.0.1:2103", instance: "b"},
+	)
+
+	if got := r.get("bucky.m1.cpu.0.user", 1); !reflect.DeepEqual(got, []int{0}) {
+		t.Errorf("get(bucky.m1.cpu.0.user) = %v, want [0]", got)
+	}
+	if got := r.get("servers.web01.load.shortterm", 1); !reflect.DeepEqual(got, []int{1}) {
+		t.Errorf("get(servers.web01.load.shortterm) = %v, want [1]", got)
+	}
+
+	// more replicas than backends yields every backend once
+	if got := r.get("x", 3); !reflect.DeepEqual(got, []int{0, 1}) {
+		t.Errorf("get(x, 3) = %v, want [0 1]", got)
+	}
+}
+
+func TestGraphiteHashRingUnknownType(t *testing.T) {
+	if _, err := newGraphiteHashRing("md5", []string{"a"}); err == nil {
+		t.Error("expected an error for an unknown hash type")
+	}
+}
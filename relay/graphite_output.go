@@ -0,0 +1,728 @@
+package relay
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	log "github.com/golang/glog"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/telegraf"
+)
+
+const (
+	DefaultGraphitePrefix  = "bucky"
+	DefaultGraphiteTimeout = 2 * time.Second
+)
+
+// Sanitization policies for the components of a graphite path
+const (
+	// keep tag values and field keys as they are
+	graphiteSanitizeNone = "none"
+	// replace dots and whitespace with underscores
+	graphiteSanitizeUnderscore = "underscore"
+	// replace everything except letters, digits, '-' and '_' with underscores
+	graphiteSanitizeStrict = "strict"
+)
+
+// Graphite output protocols
+const (
+	graphiteProtocolPlaintext = "plaintext"
+	graphiteProtocolPickle    = "pickle"
+	graphiteProtocolUDP       = "udp"
+)
+
+// Graphite output modes
+const (
+	// collectd compatible dotted paths, keyed by machine id
+	graphiteModePath = "path"
+	// graphite 1.1 tagged series, measurement.field;tag=value
+	graphiteModeTagged = "tagged"
+)
+
+// same replacements telegraf's graphite serializer applies to a whole path
+var graphitePathReplacer = strings.NewReplacer("/", "-", "@", "-", "*", "-", " ", "_", "..", ".", `\`, "", ")", "_", "(", "_")
+
+// graphite does not accept these in tag keys and values, and the plaintext
+// protocol is whitespace delimited
+var (
+	graphiteTagKeyReplacer   = strings.NewReplacer(";", "_", "!", "_", "^", "_", "=", "_", " ", "_", "\t", "_", "\n", "_")
+	graphiteTagValueReplacer = strings.NewReplacer(";", "_", " ", "_", "\t", "_", "\n", "_")
+)
+
+// graphiteSource describes where a batch of points came from.
+// Its values can be referenced from graphite prefix templates as
+// {org}, {machine} and {source}.
+type graphiteSource struct {
+	OrgID      string
+	MachineID  string
+	SourceType string
+
+	// DefaultSourceType picks the mapping profile of points when neither
+	// SourceType nor their source_type tag is set
+	DefaultSourceType string
+}
+
+// graphitePoint is a single serialized graphite datapoint
+type graphitePoint struct {
+	path      string
+	value     float64
+	timestamp int64
+}
+
+type graphiteBackend struct {
+	name     string
+	location string
+	instance string
+
+	protocol  string
+	mtu       int
+	mode      string
+	prefix    string
+	sanitize  string
+	precision string
+	timeout   time.Duration
+
+	// addrs resolves location, connections are kept per address
+	addrs *resolver
+	mu    sync.Mutex
+	conns map[string]net.Conn
+	// redialAt is when connections are dialed again in first mode
+	redialAt time.Time
+}
+
+// NewGraphiteBackend Initializes a new Graphite Backend
+func NewGraphiteBackend(cfg *GraphiteOutputConfig) (*graphiteBackend, error) {
+	if cfg.Name == "" {
+		cfg.Name = cfg.Location
+	}
+
+	b := &graphiteBackend{
+		name:      cfg.Name,
+		location:  cfg.Location,
+		instance:  cfg.Instance,
+		protocol:  graphiteProtocolPlaintext,
+		mtu:       defaultMTU,
+		mode:      graphiteModePath,
+		prefix:    DefaultGraphitePrefix,
+		sanitize:  graphiteSanitizeNone,
+		precision: "s",
+		timeout:   DefaultGraphiteTimeout,
+		conns:     make(map[string]net.Conn),
+	}
+
+	if cfg.Prefix != "" {
+		b.prefix = cfg.Prefix
+	}
+
+	switch cfg.Protocol {
+	case "":
+	case graphiteProtocolPlaintext, graphiteProtocolPickle, graphiteProtocolUDP:
+		b.protocol = cfg.Protocol
+	default:
+		return nil, fmt.Errorf("unknown protocol %q for graphite backend %q", cfg.Protocol, cfg.Name)
+	}
+
+	if cfg.MTU > 0 {
+		b.mtu = cfg.MTU
+	}
+
+	switch cfg.Mode {
+	case "":
+	case graphiteModePath, graphiteModeTagged:
+		b.mode = cfg.Mode
+	default:
+		return nil, fmt.Errorf("unknown mode %q for graphite backend %q", cfg.Mode, cfg.Name)
+	}
+
+	switch cfg.Sanitize {
+	case "":
+	case graphiteSanitizeNone, graphiteSanitizeUnderscore, graphiteSanitizeStrict:
+		b.sanitize = cfg.Sanitize
+	default:
+		return nil, fmt.Errorf("unknown sanitize policy %q for graphite backend %q", cfg.Sanitize, cfg.Name)
+	}
+
+	switch cfg.Precision {
+	case "", "s":
+	case "ms":
+		b.precision = cfg.Precision
+	default:
+		return nil, fmt.Errorf("unsupported precision %q for graphite backend %q", cfg.Precision, cfg.Name)
+	}
+
+	if cfg.Timeout != "" {
+		t, err := time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing graphite timeout '%v'", err)
+		}
+		b.timeout = t
+	}
+
+	network := "tcp"
+	if b.protocol == graphiteProtocolUDP {
+		network = "udp"
+	}
+	addrs, err := newResolver(network, cfg.Location, cfg.Resolve, cfg.ResolveInterval)
+	if err != nil {
+		return nil, err
+	}
+	b.addrs = addrs
+
+	return b, nil
+}
+
+// sanitizeGraphiteComponent applies a sanitization policy to a value that
+// will end up as (part of) a single graphite path component
+func sanitizeGraphiteComponent(policy, s string) string {
+	switch policy {
+	case graphiteSanitizeUnderscore:
+		return strings.Map(func(r rune) rune {
+			if r == '.' || unicode.IsSpace(r) {
+				return '_'
+			}
+			return r
+		}, s)
+	case graphiteSanitizeStrict:
+		return strings.Map(func(r rune) rune {
+			if r == '-' || r == '_' || (r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r))) {
+				return r
+			}
+			return '_'
+		}, s)
+	}
+	return s
+}
+
+// renderPrefix expands the prefix template for the given source
+func (b *graphiteBackend) renderPrefix(src graphiteSource) string {
+	if !strings.Contains(b.prefix, "{") {
+		return b.prefix
+	}
+
+	source := src.SourceType
+	if source == "" {
+		source = src.DefaultSourceType
+	}
+	if source == "" {
+		source = DefaultProfile
+	}
+
+	return strings.NewReplacer(
+		"{org}", sanitizeGraphiteComponent(b.sanitize, src.OrgID),
+		"{machine}", sanitizeGraphiteComponent(b.sanitize, src.MachineID),
+		"{source}", sanitizeGraphiteComponent(b.sanitize, source),
+	).Replace(b.prefix)
+}
+
+// graphitePoints maps and serializes points using the backend settings
+func (b *graphiteBackend) graphitePoints(points []models.Point, src graphiteSource) []graphitePoint {
+	prefix := b.renderPrefix(src)
+	if b.mode == graphiteModeTagged {
+		return b.taggedPoints(points, src, prefix)
+	}
+
+	metrics := graphiteMetrics(points, src, b.sanitize)
+
+	out := make([]graphitePoint, 0, len(metrics))
+	for _, m := range metrics {
+		for field, v := range m.Fields() {
+			value, ok := graphiteValue(v)
+			if !ok {
+				continue
+			}
+			out = append(out, graphitePoint{
+				path:      graphitePath(prefix, m, field),
+				value:     value,
+				timestamp: m.Time().UnixNano(),
+			})
+		}
+	}
+
+	return out
+}
+
+// graphitePath builds the path of a metric field the same way telegraf's
+// default "host.tags.measurement.field" template does for our metrics
+func graphitePath(prefix string, m telegraf.Metric, field string) string {
+	parts := make([]string, 0, 4)
+	if prefix != "" {
+		parts = append(parts, prefix)
+	}
+	if id := m.Tags()["id"]; id != "" {
+		parts = append(parts, strings.Replace(id, ".", "_", -1))
+	}
+	parts = append(parts, m.Name())
+	if field != "value" {
+		parts = append(parts, field)
+	}
+
+	return graphitePathReplacer.Replace(strings.Join(parts, "."))
+}
+
+// taggedPoints serializes points as graphite tagged series. The series name
+// is measurement.field and every influx tag becomes a graphite tag.
+func (b *graphiteBackend) taggedPoints(points []models.Point, src graphiteSource, prefix string) []graphitePoint {
+	out := make([]graphitePoint, 0, len(points))
+
+	for _, p := range points {
+		tags := make(map[string]string)
+		for _, t := range p.Tags() {
+			tags[string(t.Key)] = string(t.Value)
+		}
+		if src.MachineID != "" {
+			tags["machine_id"] = src.MachineID
+		}
+		suffix := graphiteTagString(tags)
+
+		measurement := sanitizeGraphiteComponent(b.sanitize, string(p.Name()))
+
+		fi := p.FieldIterator()
+		for fi.Next() {
+			var value float64
+			switch fi.Type() {
+			case models.Float:
+				value, _ = fi.FloatValue()
+			case models.Integer:
+				v, _ := fi.IntegerValue()
+				value = float64(v)
+			default:
+				continue
+			}
+
+			if !utf8.ValidString(string(fi.FieldKey())) {
+				continue
+			}
+
+			parts := make([]string, 0, 3)
+			if prefix != "" {
+				parts = append(parts, prefix)
+			}
+			parts = append(parts, measurement, sanitizeGraphiteComponent(b.sanitize, string(fi.FieldKey())))
+
+			out = append(out, graphitePoint{
+				path:      graphitePathReplacer.Replace(strings.Join(parts, ".")) + suffix,
+				value:     value,
+				timestamp: p.UnixNano(),
+			})
+		}
+	}
+
+	return out
+}
+
+// graphiteTagString formats tags as a sorted ";key=value" list.
+// Characters graphite does not allow in tags are replaced and tags with
+// empty values are skipped.
+func graphiteTagString(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if k != "" && v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, k := range keys {
+		buf.WriteByte(';')
+		buf.WriteString(graphiteTagKeyReplacer.Replace(k))
+		buf.WriteByte('=')
+		v := graphiteTagValueReplacer.Replace(tags[k])
+		if strings.HasPrefix(v, "~") {
+			v = "_" + v[1:]
+		}
+		buf.WriteString(v)
+	}
+	return buf.String()
+}
+
+func graphiteValue(v interface{}) (float64, bool) {
+	switch value := v.(type) {
+	case float64:
+		return value, true
+	case int64:
+		return float64(value), true
+	case uint64:
+		return float64(value), true
+	case bool:
+		if value {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// formatTimestamp formats a unix nano timestamp in the backend precision
+func (b *graphiteBackend) formatTimestamp(ts int64) string {
+	if b.precision == "ms" {
+		ms := ts / int64(time.Millisecond)
+		return fmt.Sprintf("%d.%03d", ms/1000, ms%1000)
+	}
+	return strconv.FormatInt(ts/int64(time.Second), 10)
+}
+
+// plaintext serializes points using the carbon plaintext protocol
+func (b *graphiteBackend) plaintext(points []graphitePoint) []byte {
+	var buf bytes.Buffer
+	for _, p := range points {
+		buf.WriteString(p.path)
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.FormatFloat(p.value, 'f', -1, 64))
+		buf.WriteByte(' ')
+		buf.WriteString(b.formatTimestamp(p.timestamp))
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+func (b *graphiteBackend) writePoints(points []graphitePoint) error {
+	if len(points) == 0 {
+		return nil
+	}
+
+	var (
+		buf  []byte
+		send = b.send
+	)
+	switch b.protocol {
+	case graphiteProtocolPickle:
+		buf = b.pickle(points)
+	case graphiteProtocolUDP:
+		buf = b.plaintext(points)
+		send = b.sendPackets
+	default:
+		buf = b.plaintext(points)
+	}
+
+	addrs, err := b.targets()
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closeStaleConns(addrs)
+
+	// every address gets the points, the last error is returned
+	for _, addr := range addrs {
+		if serr := send(addr, buf); serr != nil {
+			if serr != errPacketTooLarge {
+				b.addrs.invalidate()
+			}
+			err = serr
+		}
+	}
+	return err
+}
+
+// targets returns the addresses writes go to. In first mode that is the
+// location itself, so dialing falls back through all of its addresses
+// and resolves it again on every new connection.
+func (b *graphiteBackend) targets() ([]string, error) {
+	if b.addrs.mode == resolveFirst {
+		return []string{b.location}, nil
+	}
+
+	addrs, err := b.addrs.addresses()
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([]string, len(addrs))
+	for i, addr := range addrs {
+		targets[i] = addr.String()
+	}
+	return targets, nil
+}
+
+// closeStaleConns closes the connections to addresses the location no
+// longer resolves to. In first mode, connections are closed once the
+// resolve interval passes, so the location is resolved again on redial.
+func (b *graphiteBackend) closeStaleConns(addrs []string) {
+	if b.addrs.mode == resolveFirst && b.addrs.interval > 0 {
+		now := time.Now()
+		if now.After(b.redialAt) {
+			for addr, conn := range b.conns {
+				conn.Close()
+				delete(b.conns, addr)
+			}
+			b.redialAt = now.Add(b.addrs.interval)
+		}
+	}
+
+	if len(b.conns) == 0 {
+		return
+	}
+
+	current := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		current[addr] = true
+	}
+	for addr, conn := range b.conns {
+		if !current[addr] {
+			conn.Close()
+			delete(b.conns, addr)
+		}
+	}
+}
+
+// sendPackets writes buf to addr as UDP datagrams of at most mtu bytes,
+// split on line boundaries
+func (b *graphiteBackend) sendPackets(addr string, buf []byte) error {
+	conn := b.conns[addr]
+	if conn == nil {
+		c, err := net.Dial("udp", addr)
+		if err != nil {
+			return err
+		}
+		conn = c
+		b.conns[addr] = conn
+	}
+
+	for len(buf) > 0 {
+		n := len(buf)
+		if n > b.mtu {
+			// find the last line that will fit within the MTU
+			idx := bytes.LastIndexByte(buf[:b.mtu], '\n')
+			if idx < 0 {
+				// first line is larger than MTU
+				return errPacketTooLarge
+			}
+			n = idx + 1
+		}
+
+		if _, err := conn.Write(buf[:n]); err != nil {
+			conn.Close()
+			delete(b.conns, addr)
+			return err
+		}
+		buf = buf[n:]
+	}
+
+	return nil
+}
+
+// send writes buf over the connection to addr, dialing if needed.
+// A write on a connection carbon has already closed is retried once on a
+// fresh connection.
+func (b *graphiteBackend) send(addr string, buf []byte) error {
+	for attempt := 0; ; attempt++ {
+		conn := b.conns[addr]
+		reused := conn != nil
+		if !reused {
+			c, err := net.DialTimeout("tcp", addr, b.timeout)
+			if err != nil {
+				return err
+			}
+			conn = c
+			b.conns[addr] = conn
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(b.timeout))
+		_, err := conn.Write(buf)
+		if err == nil {
+			return nil
+		}
+
+		conn.Close()
+		delete(b.conns, addr)
+
+		if !reused || attempt > 0 {
+			return err
+		}
+	}
+}
+
+// graphiteWriter distributes writes over a pool of graphite backends.
+// Like telegraf's graphite output, every write goes to one randomly chosen
+// backend and falls back to the rest on error, unless consistent hashing
+// is enabled.
+type graphiteWriter struct {
+	backends []*graphiteBackend
+
+	// ring routes every path to replicationFactor backends, when set
+	ring              *graphiteHashRing
+	replicationFactor int
+}
+
+func newGraphiteWriter(cfgs []GraphiteOutputConfig) (*graphiteWriter, error) {
+	w := new(graphiteWriter)
+
+	for i := range cfgs {
+		backend, err := NewGraphiteBackend(&cfgs[i])
+		if err != nil {
+			return nil, err
+		}
+
+		w.backends = append(w.backends, backend)
+	}
+
+	return w, nil
+}
+
+// useConsistentHashing makes the writer route every path with carbon
+// compatible consistent hashing instead of picking a random backend
+func (w *graphiteWriter) useConsistentHashing(hashType string, replicationFactor int) error {
+	if replicationFactor <= 0 {
+		replicationFactor = 1
+	}
+
+	// The ring places a path on the backends, so all of them must render
+	// it identically or a point could land on a node that never sees it
+	keys := make([]string, len(w.backends))
+	for i, b := range w.backends {
+		if b.renderKey() != w.backends[0].renderKey() {
+			return fmt.Errorf("graphite backend %q: consistent hashing requires the same mode, prefix and sanitize settings on every output", b.name)
+		}
+		// a ring node fanning out to several addresses would spread its
+		// paths over servers the ring knows nothing about
+		if b.addrs.mode != resolveFirst {
+			return fmt.Errorf("graphite backend %q: consistent hashing requires resolve %q, list every server as an output instead of %q", b.name, resolveFirst, b.addrs.mode)
+		}
+		keys[i] = graphiteNodeKey(hashType, b)
+	}
+
+	ring, err := newGraphiteHashRing(hashType, keys)
+	if err != nil {
+		return err
+	}
+
+	w.ring = ring
+	w.replicationFactor = replicationFactor
+	return nil
+}
+
+func (w *graphiteWriter) write(points []models.Point, src graphiteSource) error {
+	return w.writeRendered(src.MachineID, w.renderer(points, src))
+}
+
+// renderer returns the render function of a write of points
+func (w *graphiteWriter) renderer(points []models.Point, src graphiteSource) func(*graphiteBackend) []graphitePoint {
+	return func(b *graphiteBackend) []graphitePoint {
+		return b.graphitePoints(points, src)
+	}
+}
+
+// writeGraphitePoints writes points that already carry their final path,
+// e.g. ones received by the carbon listener
+func (w *graphiteWriter) writeGraphitePoints(points []graphitePoint) error {
+	return w.writeRendered("", func(*graphiteBackend) []graphitePoint {
+		return points
+	})
+}
+
+// graphiteRenderKey holds the backend settings the rendered paths depend
+// on, consistent hashing requires every backend to share it
+type graphiteRenderKey struct {
+	mode     string
+	prefix   string
+	sanitize string
+}
+
+func (b *graphiteBackend) renderKey() graphiteRenderKey {
+	return graphiteRenderKey{mode: b.mode, prefix: b.prefix, sanitize: b.sanitize}
+}
+
+// graphiteRoute is the share of a write one backend receives
+type graphiteRoute struct {
+	backend *graphiteBackend
+	points  []graphitePoint
+}
+
+// route chooses the backends a write goes to and the points each of them
+// receives. With consistent hashing every backend gets the paths the ring
+// assigns to it, otherwise all the points go to one random backend.
+func (w *graphiteWriter) route(render func(*graphiteBackend) []graphitePoint) []graphiteRoute {
+	if len(w.backends) == 0 {
+		return nil
+	}
+
+	if w.ring == nil {
+		b := w.backends[rand.Intn(len(w.backends))]
+		return []graphiteRoute{{backend: b, points: render(b)}}
+	}
+
+	// useConsistentHashing made sure every backend renders the same paths,
+	// so the points are rendered once and every path is placed once
+	all := render(w.backends[0])
+	routes := make([]graphiteRoute, len(w.backends))
+	for i, b := range w.backends {
+		routes[i].backend = b
+	}
+	for _, p := range all {
+		for _, node := range w.ring.get(p.path, w.replicationFactor) {
+			routes[node].points = append(routes[node].points, p)
+		}
+	}
+
+	return routes
+}
+
+// writeRendered routes the points render produces for each backend
+func (w *graphiteWriter) writeRendered(machineID string, render func(*graphiteBackend) []graphitePoint) error {
+	_, err := w.writeRoutes(w.route(render), machineID, render)
+	return err
+}
+
+// writeRoutes sends every route to its backend and returns the routes that
+// failed along with the last error, so a retry only resends those
+func (w *graphiteWriter) writeRoutes(routes []graphiteRoute, machineID string, render func(*graphiteBackend) []graphitePoint) ([]graphiteRoute, error) {
+	var (
+		failed  []graphiteRoute
+		lastErr error
+	)
+	for _, r := range routes {
+		if err := w.writeRoute(r, machineID, render); err != nil {
+			failed = append(failed, r)
+			lastErr = err
+		}
+	}
+
+	return failed, lastErr
+}
+
+// writeRoute sends a route to its backend. Without consistent hashing, a
+// failed write falls back to the other backends in random order.
+func (w *graphiteWriter) writeRoute(r graphiteRoute, machineID string, render func(*graphiteBackend) []graphitePoint) error {
+	b, points := r.backend, r.points
+	err := b.writePoints(points)
+	if err == nil {
+		if log.V(5) {
+			log.Infof("Sending datapoints to graphite backend: %s, from machine: %s", b.location, machineID)
+		}
+		return nil
+	}
+	log.Errorf("Could not write to graphite backend %q: %v", b.name, err)
+
+	if w.ring != nil {
+		return err
+	}
+
+	for _, i := range rand.Perm(len(w.backends)) {
+		if w.backends[i] == r.backend {
+			continue
+		}
+		b = w.backends[i]
+		if err = b.writePoints(render(b)); err == nil {
+			if log.V(5) {
+				log.Infof("Sending datapoints to graphite backend: %s, from machine: %s", b.location, machineID)
+			}
+			return nil
+		}
+		log.Errorf("Could not write to graphite backend %q: %v", b.name, err)
+	}
+
+	return err
+}
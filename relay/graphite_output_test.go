@@ -0,0 +1,233 @@
+package relay
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// translateLines renders line protocol like a graphite output configured
+// with cfg would, sorted so tests do not depend on field order
+func translateLines(t *testing.T, cfg TranslateConfig, input ...string) []string {
+	t.Helper()
+
+	var out bytes.Buffer
+	if err := TranslateGraphite(strings.NewReader(strings.Join(input, "\n")+"\n"), &out, cfg); err != nil {
+		t.Fatalf("TranslateGraphite: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) == 1 && lines[0] == "" {
+		return nil
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func checkLines(t *testing.T, got []string, want ...string) {
+	t.Helper()
+
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got lines\n\t%s\nwant\n\t%s", strings.Join(got, "\n\t"), strings.Join(want, "\n\t"))
+	}
+}
+
+func TestGraphiteDefaultPrefix(t *testing.T) {
+	got := translateLines(t, TranslateConfig{MachineID: "m1"},
+		"cpu,cpu=cpu0 usage_user=1.5 1600000000123456789")
+
+	checkLines(t, got, "bucky.m1.cpu.0.user 1.5 1600000000")
+}
+
+func TestGraphitePrefixTemplate(t *testing.T) {
+	cfg := TranslateConfig{
+		OrgID:      "acme",
+		MachineID:  "m1",
+		SourceType: "linux",
+		Output:     GraphiteOutputConfig{Prefix: "{org}.{source}"},
+	}
+	checkLines(t, translateLines(t, cfg, "cpu,cpu=cpu0 usage_user=1.5 1600000000000000000"),
+		"acme.linux.m1.cpu.0.user 1.5 1600000000")
+
+	// an empty source type renders as the default profile
+	cfg.SourceType = ""
+	cfg.Output.Prefix = "metrics.{source}.{org}"
+	checkLines(t, translateLines(t, cfg, "cpu,cpu=cpu0 usage_user=1.5 1600000000000000000"),
+		"metrics.linux.acme.m1.cpu.0.user 1.5 1600000000")
+}
+
+func TestGraphiteSanitize(t *testing.T) {
+	input := "net,interface=vlan@100.5 bytes_recv=10i 1600000000000000000"
+
+	cfg := TranslateConfig{OrgID: "acme corp", MachineID: "m1.example"}
+	cfg.Output.Prefix = "{org}"
+
+	// without a policy the dot in the interface adds a path level, only
+	// whitespace is replaced so the plaintext line stays parseable
+	checkLines(t, translateLines(t, cfg, input),
+		"acme_corp.m1_example.interface.vlan-100.5.if_octets.rx 10 1600000000")
+
+	cfg.Output.Sanitize = graphiteSanitizeUnderscore
+	checkLines(t, translateLines(t, cfg, input),
+		"acme_corp.m1_example.interface.vlan-100_5.if_octets.rx 10 1600000000")
+
+	cfg.Output.Sanitize = graphiteSanitizeStrict
+	checkLines(t, translateLines(t, cfg, input),
+		"acme_corp.m1_example.interface.vlan_100_5.if_octets.rx 10 1600000000")
+}
+
+func TestSanitizeGraphiteComponent(t *testing.T) {
+	cases := map[string][3]string{
+		// input: none, underscore, strict
+		"eth0":         {"eth0", "eth0", "eth0"},
+		"eth0.100":     {"eth0.100", "eth0_100", "eth0_100"},
+		"Local Area 1": {"Local Area 1", "Local_Area_1", "Local_Area_1"},
+		"C:\\":         {"C:\\", "C:\\", "C__"},
+		"ümlaut-x_y":   {"ümlaut-x_y", "ümlaut-x_y", "_mlaut-x_y"},
+	}
+
+	for in, want := range cases {
+		for i, policy := range []string{graphiteSanitizeNone, graphiteSanitizeUnderscore, graphiteSanitizeStrict} {
+			if got := sanitizeGraphiteComponent(policy, in); got != want[i] {
+				t.Errorf("sanitizeGraphiteComponent(%q, %q) = %q, want %q", policy, in, got, want[i])
+			}
+		}
+	}
+}
+
+func TestGraphiteMillisecondTimestamps(t *testing.T) {
+	cfg := TranslateConfig{MachineID: "m1"}
+	cfg.Output.Precision = "ms"
+
+	checkLines(t, translateLines(t, cfg,
+		"cpu,cpu=cpu0 usage_user=1.5 1600000000123456789",
+		"cpu,cpu=cpu1 usage_user=2 1600000000005000000",
+	),
+		"bucky.m1.cpu.0.user 1.5 1600000000.123",
+		"bucky.m1.cpu.1.user 2 1600000000.005",
+	)
+}
+
+func TestGraphiteBackendSettingsValidation(t *testing.T) {
+	for _, cfg := range []GraphiteOutputConfig{
+		{Location: "localhost:2003", Sanitize: "lowercase"},
+		{Location: "localhost:2003", Precision: "us"},
+		{Location: "localhost:2003", Mode: "json"},
+		{Location: "localhost:2003", Protocol: "http"},
+	} {
+		if _, err := NewGraphiteBackend(&cfg); err == nil {
+			t.Errorf("NewGraphiteBackend(%+v): expected an error", cfg)
+		}
+	}
+}
+
+func TestGraphiteTaggedMode(t *testing.T) {
+	cfg := TranslateConfig{MachineID: "m1"}
+	cfg.Output.Mode = graphiteModeTagged
+
+	checkLines(t, translateLines(t, cfg,
+		"cpu,cpu=cpu0 usage_user=1.5,usage_system=2 1600000000000000000",
+		"net,interface=vlan@100.5 bytes_recv=10i 1600000000000000000",
+	),
+		"bucky.cpu.usage_user;cpu=cpu0;machine_id=m1 1.5 1600000000",
+		"bucky.cpu.usage_system;cpu=cpu0;machine_id=m1 2 1600000000",
+		"bucky.net.bytes_recv;interface=vlan@100.5;machine_id=m1 10 1600000000",
+	)
+
+	// string fields have no graphite representation
+	if got := translateLines(t, cfg, `svc,name=a state="up" 1600000000000000000`); got != nil {
+		t.Errorf("string field rendered as %q", got)
+	}
+}
+
+func TestGraphiteTagString(t *testing.T) {
+	got := graphiteTagString(map[string]string{
+		"region":  "~eu",
+		"host":    "a;b c",
+		"k=v":     "x",
+		"empty":   "",
+		"":        "orphan",
+		"machine": "m1",
+	})
+	want := ";host=a_b_c;k_v=x;machine=m1;region=_eu"
+	if got != want {
+		t.Errorf("graphiteTagString() = %q, want %q", got, want)
+	}
+
+	if got := graphiteTagString(nil); got != "" {
+		t.Errorf("graphiteTagString(nil) = %q, want empty", got)
+	}
+}
+
+func TestGraphiteRouteConsistentHashing(t *testing.T) {
+	w, err := newGraphiteWriter([]GraphiteOutputConfig{
+		{Name: "a", Location: "10.0.0.1:2003"},
+		{Name: "b", Location: "10.0.0.2:2003"},
+		{Name: "c", Location: "10.0.0.3:2003"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.useConsistentHashing(graphiteHashCarbon, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	rendered := 0
+	routes := w.route(func(*graphiteBackend) []graphitePoint {
+		rendered++
+		return []graphitePoint{
+			{path: "bucky.m2.memory.free", value: 1},
+			{path: "carbon.agents.a.metricsReceived", value: 2},
+		}
+	})
+
+	if rendered != 1 {
+		t.Errorf("points rendered %d times, want once", rendered)
+	}
+
+	got := make(map[string][]string)
+	for _, r := range routes {
+		for _, p := range r.points {
+			got[r.backend.name] = append(got[r.backend.name], p.path)
+		}
+	}
+	want := map[string][]string{
+		"a": {"carbon.agents.a.metricsReceived"},
+		"b": {"bucky.m2.memory.free"},
+		"c": {"bucky.m2.memory.free", "carbon.agents.a.metricsReceived"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("routed %v, want %v", got, want)
+	}
+}
+
+func TestGraphiteConsistentHashingRenderSettings(t *testing.T) {
+	w, err := newGraphiteWriter([]GraphiteOutputConfig{
+		{Name: "a", Location: "10.0.0.1:2003"},
+		{Name: "b", Location: "10.0.0.2:2003", Prefix: "other"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.useConsistentHashing(graphiteHashCarbon, 1); err == nil {
+		t.Error("expected an error for outputs rendering different paths")
+	}
+}
+
+func TestGraphiteConsistentHashingResolveMode(t *testing.T) {
+	for _, mode := range []string{resolveAll, resolveSRV} {
+		w, err := newGraphiteWriter([]GraphiteOutputConfig{
+			{Name: "a", Location: "10.0.0.1:2003"},
+			{Name: "b", Location: "_carbon._tcp.graphite.svc", Resolve: mode},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.useConsistentHashing(graphiteHashCarbon, 1); err == nil {
+			t.Errorf("expected an error for an output resolving %q", mode)
+		}
+	}
+}
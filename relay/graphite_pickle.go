@@ -0,0 +1,93 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+// carbon refuses pickle messages larger than 1MB, so we stay well below
+// by sending at most this many datapoints per message, like carbon-relay does
+const graphitePickleMaxPoints = 500
+
+// pickle protocol 2 opcodes used to encode a list of (path, (timestamp, value))
+const (
+	pickleProto      = 0x80
+	pickleEmptyList  = ']'
+	pickleMark       = '('
+	pickleAppends    = 'e'
+	pickleBinUnicode = 'X'
+	pickleBinInt     = 'J'
+	pickleLong1      = 0x8a
+	pickleBinFloat   = 'G'
+	pickleTuple2     = 0x86
+	pickleStop       = '.'
+)
+
+// pickle serializes points as length prefixed carbon pickle messages
+func (b *graphiteBackend) pickle(points []graphitePoint) []byte {
+	var buf bytes.Buffer
+	for len(points) > 0 {
+		n := len(points)
+		if n > graphitePickleMaxPoints {
+			n = graphitePickleMaxPoints
+		}
+
+		msg := b.pickleMessage(points[:n])
+
+		var header [4]byte
+		binary.BigEndian.PutUint32(header[:], uint32(len(msg)))
+		buf.Write(header[:])
+		buf.Write(msg)
+
+		points = points[n:]
+	}
+	return buf.Bytes()
+}
+
+func (b *graphiteBackend) pickleMessage(points []graphitePoint) []byte {
+	var buf bytes.Buffer
+	var scratch [8]byte
+
+	buf.WriteByte(pickleProto)
+	buf.WriteByte(2)
+	buf.WriteByte(pickleEmptyList)
+	buf.WriteByte(pickleMark)
+
+	for _, p := range points {
+		buf.WriteByte(pickleBinUnicode)
+		binary.LittleEndian.PutUint32(scratch[:4], uint32(len(p.path)))
+		buf.Write(scratch[:4])
+		buf.WriteString(p.path)
+
+		if b.precision == "ms" {
+			ms := p.timestamp / int64(time.Millisecond)
+			buf.WriteByte(pickleBinFloat)
+			binary.BigEndian.PutUint64(scratch[:], math.Float64bits(float64(ms)/1000))
+			buf.Write(scratch[:])
+		} else if ts := p.timestamp / int64(time.Second); ts >= math.MinInt32 && ts <= math.MaxInt32 {
+			buf.WriteByte(pickleBinInt)
+			binary.LittleEndian.PutUint32(scratch[:4], uint32(int32(ts)))
+			buf.Write(scratch[:4])
+		} else {
+			// BININT is 32 bits, later timestamps are sent as 8 byte longs
+			buf.WriteByte(pickleLong1)
+			buf.WriteByte(8)
+			binary.LittleEndian.PutUint64(scratch[:], uint64(ts))
+			buf.Write(scratch[:])
+		}
+
+		buf.WriteByte(pickleBinFloat)
+		binary.BigEndian.PutUint64(scratch[:], math.Float64bits(p.value))
+		buf.Write(scratch[:])
+
+		buf.WriteByte(pickleTuple2)
+		buf.WriteByte(pickleTuple2)
+	}
+
+	buf.WriteByte(pickleAppends)
+	buf.WriteByte(pickleStop)
+
+	return buf.Bytes()
+}
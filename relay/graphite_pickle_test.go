@@ -0,0 +1,98 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// The expected messages load with Python's pickle.loads into carbon's
+// [(path, (timestamp, value)), ...] lists.
+
+func TestGraphitePickleSeconds(t *testing.T) {
+	b := &graphiteBackend{precision: "s"}
+
+	got := b.pickle([]graphitePoint{
+		{path: "bucky.m1.cpu.0.user", value: 1.5, timestamp: 1600000000 * int64(time.Second)},
+	})
+	// [('bucky.m1.cpu.0.user', (1600000000, 1.5))]
+	want := "\x00\x00\x00.\x80\x02](X\x13\x00\x00\x00bucky.m1.cpu.0.userJ\x00\x10^_G?\xf8\x00\x00\x00\x00\x00\x00\x86\x86e."
+	if !bytes.Equal(got, []byte(want)) {
+		t.Errorf("pickle() = %q, want %q", got, want)
+	}
+
+	got = b.pickle([]graphitePoint{
+		{path: "a", value: -2, timestamp: 1600000000 * int64(time.Second)},
+		{path: "b.c", value: 0.25, timestamp: 1600000010*int64(time.Second) + 999},
+	})
+	// [('a', (1600000000, -2.0)), ('b.c', (1600000010, 0.25))]
+	want = "\x00\x00\x004\x80\x02](X\x01\x00\x00\x00aJ\x00\x10^_G\xc0\x00\x00\x00\x00\x00\x00\x00\x86\x86X\x03\x00\x00\x00b.cJ\x0a\x10^_G?\xd0\x00\x00\x00\x00\x00\x00\x86\x86e."
+	if !bytes.Equal(got, []byte(want)) {
+		t.Errorf("pickle() = %q, want %q", got, want)
+	}
+
+	if got := b.pickle(nil); len(got) != 0 {
+		t.Errorf("pickle(nil) = %q, want nothing", got)
+	}
+}
+
+func TestGraphitePickleLargeTimestamp(t *testing.T) {
+	b := &graphiteBackend{precision: "s"}
+
+	// 2100-01-01 does not fit a BININT
+	got := b.pickle([]graphitePoint{
+		{path: "a", value: 1, timestamp: 4102444800 * int64(time.Second)},
+	})
+	// [('a', (4102444800, 1.0))]
+	want := "\x00\x00\x00!\x80\x02](X\x01\x00\x00\x00a\x8a\x08\x00W\x86\xf4\x00\x00\x00\x00G?\xf0\x00\x00\x00\x00\x00\x00\x86\x86e."
+	if !bytes.Equal(got, []byte(want)) {
+		t.Errorf("pickle() = %q, want %q", got, want)
+	}
+}
+
+func TestGraphitePickleMilliseconds(t *testing.T) {
+	b := &graphiteBackend{precision: "ms"}
+
+	got := b.pickle([]graphitePoint{
+		{path: "a", value: 42, timestamp: 1600000000123 * int64(time.Millisecond)},
+	})
+	// [('a', (1600000000.123, 42.0))], the timestamp is a float
+	want := "\x00\x00\x00 \x80\x02](X\x01\x00\x00\x00aGA\xd7\xd7\x84\x00\x07\xdf;G@E\x00\x00\x00\x00\x00\x00\x86\x86e."
+	if !bytes.Equal(got, []byte(want)) {
+		t.Errorf("pickle() = %q, want %q", got, want)
+	}
+}
+
+func TestGraphitePickleSplitsMessages(t *testing.T) {
+	b := &graphiteBackend{precision: "s"}
+
+	points := make([]graphitePoint, graphitePickleMaxPoints+1)
+	for i := range points {
+		points[i] = graphitePoint{path: fmt.Sprintf("p%d", i), value: float64(i), timestamp: int64(i) * int64(time.Second)}
+	}
+
+	buf := b.pickle(points)
+
+	var sizes []int
+	for len(buf) > 0 {
+		if len(buf) < 4 {
+			t.Fatalf("truncated header: %q", buf)
+		}
+		n := int(binary.BigEndian.Uint32(buf[:4]))
+		if len(buf) < 4+n {
+			t.Fatalf("message of %d bytes truncated to %d", n, len(buf)-4)
+		}
+		sizes = append(sizes, n)
+		buf = buf[4+n:]
+	}
+
+	want := []int{
+		len(b.pickleMessage(points[:graphitePickleMaxPoints])),
+		len(b.pickleMessage(points[graphitePickleMaxPoints:])),
+	}
+	if fmt.Sprint(sizes) != fmt.Sprint(want) {
+		t.Errorf("message sizes = %v, want %v", sizes, want)
+	}
+}
@@ -19,9 +19,6 @@ import (
 	log "github.com/golang/glog"
 
 	"github.com/influxdata/influxdb/models"
-	"github.com/influxdata/telegraf/plugins/outputs/graphite"
-
-	"github.com/robfig/cron"
 )
 
 // HTTP is a relay for HTTP influxdb writes
@@ -36,13 +33,18 @@ type HTTP struct {
 	closing int64
 	l       net.Listener
 
-	enableMetering bool
-	ampqURL        string
+	// metering is nil unless enabled
+	metering *meter
+
+	// meteringQueryToken authorizes GET /metering, disabled if empty
+	meteringQueryToken string
+
+	// discovery is nil unless enabled
+	discovery *seriesDiscovery
 
 	dropUnauthorized bool
 
-	cronJob      *cron.Cron
-	cronSchedule string
+	defaultSourceType string
 
 	maxDatapointsPerRequest   int
 	splitRequestPerDatapoints int
@@ -84,22 +86,19 @@ func NewHTTP(cfg HTTPConfig) (Relay, error) {
 		h.backends = append(h.backends, backend)
 	}
 
-	h.enableMetering = cfg.EnableMetering
-	h.ampqURL = cfg.AMQPUrl
-	amqpURL = cfg.AMQPUrl
-
-	if h.enableMetering && h.ampqURL == "" {
-		h.enableMetering = false
-		log.Warning("You have to set AMQPUrl in config for metering to work")
+	enableMetering := cfg.EnableMetering
+	if enableMetering && cfg.AMQPUrl == "" && len(cfg.MeteringSinks) == 0 {
+		enableMetering = false
+		log.Warning("You have to set AMQPUrl or a metering-sink in config for metering to work")
 		log.Warning("Disabling metering for now")
 	}
 
 	h.dropUnauthorized = cfg.DropUnauthorized
+	h.meteringQueryToken = cfg.MeteringQueryToken
 
-	h.cronSchedule = cfg.CronSchedule
-
-	if h.cronSchedule != "" {
-		h.cronJob = cron.New()
+	h.defaultSourceType = cfg.DefaultSourceType
+	if h.defaultSourceType != "" && !validGraphiteProfile(h.defaultSourceType) {
+		return nil, fmt.Errorf("unknown default-source-type %q", h.defaultSourceType)
 	}
 
 	h.maxDatapointsPerRequest = cfg.MaxDatapointsPerRequest
@@ -111,6 +110,33 @@ func NewHTTP(cfg HTTPConfig) (Relay, error) {
 	}
 	h.itsAllGoodMan = cfg.ItsAllGoodMan
 
+	if enableMetering {
+		sinks, err := newMeteringSinks(cfg.MeteringSinks, amqpConfig(cfg.AMQPUrl, cfg.AMQPExchange, cfg.AMQPRoutingKey, cfg.AMQPBufferSize, cfg.AMQPTransientQueue, "metering"))
+		if err != nil {
+			return nil, err
+		}
+
+		m, err := newMeter(h.Name(), cfg.MeteringStateFile, cfg.CronSchedule, sinks)
+		if err != nil {
+			for _, s := range sinks {
+				s.close()
+			}
+			return nil, err
+		}
+		h.metering = m
+	}
+
+	if cfg.SeriesDiscovery != nil {
+		d, err := newSeriesDiscovery(h.Name(), cfg.SeriesDiscovery, amqpConfig(cfg.AMQPUrl, cfg.AMQPExchange, cfg.SeriesDiscovery.RoutingKey, cfg.AMQPBufferSize, cfg.AMQPTransientQueue, "series"))
+		if err != nil {
+			if h.metering != nil {
+				h.metering.stop()
+			}
+			return nil, err
+		}
+		h.discovery = d
+	}
+
 	return h, nil
 }
 
@@ -124,9 +150,11 @@ func (h *HTTP) Name() string {
 func (h *HTTP) Run() error {
 	l, err := net.Listen("tcp", h.addr)
 
-	if h.cronSchedule != "" {
-		h.cronJob.AddFunc(h.cronSchedule, pushToAmqp)
-		h.cronJob.Start()
+	if h.metering != nil {
+		h.metering.start()
+	}
+	if h.discovery != nil {
+		h.discovery.start()
 	}
 
 	if err != nil {
@@ -158,8 +186,11 @@ func (h *HTTP) Run() error {
 
 func (h *HTTP) Stop() error {
 	atomic.StoreInt64(&h.closing, 1)
-	if h.cronSchedule != "" {
-		h.cronJob.Stop()
+	if h.metering != nil {
+		h.metering.stop()
+	}
+	if h.discovery != nil {
+		h.discovery.stop()
 	}
 	return h.l.Close()
 }
@@ -173,6 +204,22 @@ func (h *HTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.URL.Path == "/metering" {
+		serveMetering(w, r, h.metering, h.meteringQueryToken)
+		return
+	}
+
+	if r.URL.Path == "/translate" {
+		var writers []*graphiteWriter
+		for _, b := range h.backends {
+			if b.graphite != nil {
+				writers = append(writers, b.graphite)
+			}
+		}
+		serveTranslate(w, r, writers, h.defaultSourceType)
+		return
+	}
+
 	if r.URL.Path != "/write" {
 		jsonError(w, http.StatusNotFound, "invalid write endpoint")
 		log.Error("Invalid write endpoint")
@@ -285,28 +332,22 @@ func (h *HTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		orgID = r.Header["X-Gocky-Tag-Org-Id"][0]
 	}
 
-	if h.enableMetering {
-		mu.Lock()
-
-		_, orgExists := metering[orgID]
-		if !orgExists {
-			metering[orgID] = make(map[string]int)
-		}
-
-		_, machExists := metering[orgID][machineID]
-		if !machExists {
-			metering[orgID][machineID] = len(points)
-		} else {
-			metering[orgID][machineID] += len(points)
-		}
-
-		mu.Unlock()
+	if h.metering != nil {
+		h.metering.add(orgID, machineID, newMeteringUsage(points, bodyBuf.Len()))
 	}
 
-	sourceType := "unix"
+	if h.discovery != nil {
+		h.discovery.observe(orgID, machineID, points)
+	}
 
-	if r.Header["X-Gocky-Tag-Source-Type"][0] == "windows" {
-		sourceType = "windows"
+	graphiteSrc := graphiteSource{
+		OrgID:             orgID,
+		MachineID:         machineID,
+		SourceType:        r.Header.Get("X-Gocky-Tag-Source-Type"),
+		DefaultSourceType: h.defaultSourceType,
+	}
+	if graphiteSrc.MachineID == "" {
+		graphiteSrc.MachineID = unknownMachineID(points)
 	}
 
 	// normalize query string
@@ -370,26 +411,13 @@ func (h *HTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				}()
 			}
 		} else if b.backendType == "graphite" {
-			graphiteServers := make([]string, 1)
-			graphiteServers[0] = b.location
-			graphiteClient := &graphite.Graphite{
-				Servers: graphiteServers,
-				Prefix:  "bucky",
-			}
-
-			conErr := graphiteClient.Connect()
-			if conErr != nil {
-				jsonError(w, http.StatusInternalServerError, "unable to connect to graphite")
-				log.Fatalf("Could not connect to graphite: %s", conErr)
-			}
-
 			newPoints, err := models.ParsePointsWithPrecision(graphiteBuf.Bytes(), start, precision)
 			if err != nil {
 				jsonError(w, http.StatusBadRequest, "unable to parse points")
 				log.Error("Unable to parse points")
 				return
 			}
-			go pushToGraphite(newPoints, graphiteClient, machineID, sourceType)
+			go pushToGraphite(newPoints, b.graphite, graphiteSrc)
 			wg.Done()
 		} else {
 			wg.Done()
@@ -550,6 +578,12 @@ type httpBackend struct {
 	name        string
 	backendType string
 	location    string
+
+	// graphite is set for graphite backends
+	graphite *graphiteWriter
+
+	// retry is set for influxdb backends buffering failed writes
+	retry *retryBuffer
 }
 
 func newHTTPBackend(cfg *HTTPOutputConfig) (*httpBackend, error) {
@@ -567,7 +601,10 @@ func newHTTPBackend(cfg *HTTPOutputConfig) (*httpBackend, error) {
 	}
 
 	if cfg.BackendType == "influxdb" {
-		var p poster = newSimplePoster(cfg.Location, timeout, cfg.SkipTLSVerification)
+		var (
+			p     poster = newSimplePoster(cfg.Location, timeout, cfg.SkipTLSVerification)
+			retry *retryBuffer
+		)
 
 		// If configured, create a retryBuffer per backend.
 		// This way we serialize retries against each backend.
@@ -586,7 +623,8 @@ func newHTTPBackend(cfg *HTTPOutputConfig) (*httpBackend, error) {
 				batch = cfg.MaxBatchKB * KB
 			}
 
-			p = newRetryBuffer(cfg.BufferSizeMB*MB, batch, max, p)
+			retry = newRetryBuffer(cfg.BufferSizeMB*MB, batch, max, p)
+			p = retry
 		}
 
 		return &httpBackend{
@@ -594,6 +632,22 @@ func newHTTPBackend(cfg *HTTPOutputConfig) (*httpBackend, error) {
 			name:        cfg.Name,
 			backendType: cfg.BackendType,
 			location:    "",
+			retry:       retry,
+		}, nil
+	}
+
+	if cfg.BackendType == "graphite" {
+		g, err := newGraphiteWriter([]GraphiteOutputConfig{cfg.graphiteConfig()})
+		if err != nil {
+			return nil, err
+		}
+
+		return &httpBackend{
+			poster:      nil,
+			name:        cfg.Name,
+			backendType: cfg.BackendType,
+			location:    cfg.Location,
+			graphite:    g,
 		}, nil
 	}
 
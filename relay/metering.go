@@ -0,0 +1,357 @@
+package relay
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/golang/glog"
+
+	"github.com/robfig/cron"
+)
+
+// how long a push waits for Rabbitmq to confirm a metering report
+const meteringConfirmTimeout = 30 * time.Second
+
+// meteringReport holds the samples counted per org and machine during a
+// period. Reports are numbered per gocky instance and relay, so consumers
+// can drop reports they have already seen.
+type meteringReport struct {
+	GockyID     string                                 `json:"gockyId"`
+	Relay       string                                 `json:"relay"`
+	Seq         uint64                                 `json:"seq"`
+	PeriodStart time.Time                              `json:"periodStart"`
+	PeriodEnd   time.Time                              `json:"periodEnd"`
+	Counters    map[string]map[string]*meteringCounter `json:"counters"`
+
+	// Delivered lists the sinks that already have the report
+	Delivered []string `json:"delivered,omitempty"`
+}
+
+// meteringState is what a meter persists to disk. Pending reports are
+// sealed, so only the counters of the current period carry series hashes.
+type meteringState struct {
+	Seq         uint64                                 `json:"seq"`
+	PeriodStart time.Time                              `json:"periodStart"`
+	Counters    map[string]map[string]*meteringCounter `json:"counters"`
+	Pending     []*meteringReport                      `json:"pending"`
+}
+
+// meter counts the samples a relay receives per org and machine. Every
+// push closes the current period into a report; reports are kept, and
+// persisted if a state file is set, until every sink has them.
+type meter struct {
+	gockyID string
+	relay   string
+
+	sinks    []meteringSink
+	schedule string
+	cron     *cron.Cron
+
+	mu          sync.Mutex
+	file        string
+	seq         uint64
+	periodStart time.Time
+	counters    map[string]map[string]*meteringCounter
+	pending     []*meteringReport
+
+	pushing int32
+}
+
+// state files in use, so two relays never overwrite each other's state
+var (
+	meteringFilesMu sync.Mutex
+	meteringFiles   = make(map[string]string)
+)
+
+// newMeter creates the metering state of a relay. Reports are pushed to
+// the sinks on the cron schedule once the meter is started.
+func newMeter(relay, file, schedule string, sinks []meteringSink) (*meter, error) {
+	gockyID, err := os.Hostname()
+	if err != nil {
+		gockyID = ""
+	}
+
+	m := &meter{
+		gockyID:     gockyID,
+		relay:       relay,
+		sinks:       sinks,
+		schedule:    schedule,
+		periodStart: time.Now().UTC(),
+		counters:    make(map[string]map[string]*meteringCounter),
+	}
+
+	if schedule != "" {
+		m.cron = cron.New()
+		if err := m.cron.AddFunc(schedule, m.push); err != nil {
+			return nil, fmt.Errorf("invalid cron-schedule %q: %v", schedule, err)
+		}
+	} else {
+		log.Warningf("Metering is enabled for relay %q without a cron-schedule, reports will not be sent", relay)
+	}
+
+	if file != "" {
+		if err := m.load(file); err != nil {
+			return nil, fmt.Errorf("problem loading metering state: %v", err)
+		}
+	}
+
+	return m, nil
+}
+
+// start pushes reports on the schedule
+func (m *meter) start() {
+	if m.cron != nil {
+		m.cron.Start()
+	}
+}
+
+// stop ends the schedule, persists the counters and closes the sinks
+func (m *meter) stop() {
+	if m.cron != nil {
+		m.cron.Stop()
+	}
+
+	m.mu.Lock()
+	m.save()
+	m.mu.Unlock()
+
+	if m.file != "" {
+		meteringFilesMu.Lock()
+		delete(meteringFiles, m.file)
+		meteringFilesMu.Unlock()
+	}
+
+	for _, s := range m.sinks {
+		s.close()
+	}
+}
+
+// add counts the usage of a write from a machine
+func (m *meter) add(orgID, machineID string, u *meteringUsage) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.counter(orgID, machineID).add(u)
+}
+
+// counter returns the counter of a machine, the caller must hold m.mu
+func (m *meter) counter(orgID, machineID string) *meteringCounter {
+	machines, ok := m.counters[orgID]
+	if !ok {
+		machines = make(map[string]*meteringCounter)
+		m.counters[orgID] = machines
+	}
+
+	c, ok := machines[machineID]
+	if !ok {
+		c = new(meteringCounter)
+		machines[machineID] = c
+	}
+	return c
+}
+
+// load restores the state saved in file and keeps persisting to it.
+// A missing file is not an error.
+func (m *meter) load(file string) error {
+	meteringFilesMu.Lock()
+	if other, ok := meteringFiles[file]; ok {
+		meteringFilesMu.Unlock()
+		return fmt.Errorf("%q is already the state file of relay %q", file, other)
+	}
+	meteringFiles[file] = m.relay
+	meteringFilesMu.Unlock()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.file = file
+
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var state meteringState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	m.seq = state.Seq
+	if !state.PeriodStart.IsZero() {
+		m.periodStart = state.PeriodStart
+	}
+	for orgID, machines := range state.Counters {
+		for machineID, c := range machines {
+			m.counter(orgID, machineID).merge(c)
+		}
+	}
+	for _, r := range state.Pending {
+		// state files written before reports were sealed hold their hashes
+		sealMeteringCounters(r.Counters)
+	}
+	m.pending = append(state.Pending, m.pending...)
+
+	log.Infof("Loaded metering state from %q: %d unconfirmed reports", file, len(state.Pending))
+	return nil
+}
+
+// save writes the state file, the caller must hold m.mu
+func (m *meter) save() {
+	if m.file == "" {
+		return
+	}
+
+	data, err := json.Marshal(meteringState{
+		Seq:         m.seq,
+		PeriodStart: m.periodStart,
+		Counters:    m.counters,
+		Pending:     m.pending,
+	})
+	if err != nil {
+		log.Errorf("Problem encoding metering state: %v", err)
+		return
+	}
+
+	// write a temporary file first so a crash never leaves a partial state
+	tmp, err := ioutil.TempFile(filepath.Dir(m.file), filepath.Base(m.file)+".tmp")
+	if err != nil {
+		log.Errorf("Problem saving metering state: %v", err)
+		return
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), m.file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Errorf("Problem saving metering state to %q: %v", m.file, err)
+	}
+}
+
+func sealMeteringCounters(counters map[string]map[string]*meteringCounter) {
+	for _, machines := range counters {
+		for _, c := range machines {
+			c.seal()
+		}
+	}
+}
+
+// closePeriod turns the current counters into a pending report and
+// returns all reports that are not confirmed yet. Periods without
+// samples are merged into the next one.
+func (m *meter) closePeriod() []*meteringReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.counters) > 0 {
+		sealMeteringCounters(m.counters)
+
+		now := time.Now().UTC()
+		m.seq++
+		m.pending = append(m.pending, &meteringReport{
+			GockyID:     m.gockyID,
+			Relay:       m.relay,
+			Seq:         m.seq,
+			PeriodStart: m.periodStart,
+			PeriodEnd:   now,
+			Counters:    m.counters,
+		})
+		m.periodStart = now
+		m.counters = make(map[string]map[string]*meteringCounter)
+	}
+
+	return append([]*meteringReport(nil), m.pending...)
+}
+
+// delivered reports whether a sink already has a report
+func (m *meter) delivered(r *meteringReport, sink string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, d := range r.Delivered {
+		if d == sink {
+			return true
+		}
+	}
+	return false
+}
+
+// markDelivered records that a sink has a report
+func (m *meter) markDelivered(r *meteringReport, sink string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r.Delivered = append(r.Delivered, sink)
+}
+
+// confirm drops a report every sink has
+func (m *meter) confirm(r *meteringReport) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, p := range m.pending {
+		if p == r {
+			m.pending = append(m.pending[:i], m.pending[i+1:]...)
+			break
+		}
+	}
+}
+
+// push sends the reports of the closed periods to every sink, in order.
+// A sink that fails gets no further reports during this push; reports it
+// is missing are sent again, with the same sequence number, on the next one.
+// The state is saved once, after the push.
+func (m *meter) push() {
+	if len(m.sinks) == 0 {
+		return
+	}
+
+	// a push waiting for confirms should not overlap with the next one
+	if !atomic.CompareAndSwapInt32(&m.pushing, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&m.pushing, 0)
+
+	failed := make(map[string]bool)
+	for _, r := range m.closePeriod() {
+		complete := true
+		for _, s := range m.sinks {
+			name := s.name()
+			if m.delivered(r, name) {
+				continue
+			}
+			if failed[name] {
+				complete = false
+				continue
+			}
+
+			if err := s.send(r); err != nil {
+				log.Errorf("Problem sending metering report %d to %s: %v", r.Seq, name, err)
+				failed[name] = true
+				complete = false
+				continue
+			}
+			m.markDelivered(r, name)
+		}
+
+		if complete {
+			m.confirm(r)
+		}
+	}
+
+	m.mu.Lock()
+	m.save()
+	m.mu.Unlock()
+}
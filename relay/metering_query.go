@@ -0,0 +1,158 @@
+package relay
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// meteringSortKeys are the record fields /metering can sort by, largest first
+var meteringSortKeys = map[string]bool{
+	"counter":    true,
+	"datapoints": true,
+	"bytes":      true,
+	"series":     true,
+}
+
+// snapshot returns the records of the current period, as the sinks will
+// receive them. Only the counts are copied under the lock, the series
+// hashes are not.
+func (m *meter) snapshot() (*meteringReport, []map[string]interface{}, int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r := &meteringReport{
+		GockyID:     m.gockyID,
+		Relay:       m.relay,
+		Seq:         m.seq + 1,
+		PeriodStart: m.periodStart,
+		PeriodEnd:   time.Now().UTC(),
+		Counters:    m.counters,
+	}
+
+	records := flattenMeteringData(r)
+	for _, record := range records {
+		measurements := record["measurements"].(map[string]int)
+		copies := make(map[string]int, len(measurements))
+		for name, n := range measurements {
+			copies[name] = n
+		}
+		record["measurements"] = copies
+	}
+	r.Counters = nil
+
+	return r, records, len(m.pending)
+}
+
+// serveMetering answers GET /metering with the usage of the current
+// period, as the records the sinks will receive for it. The records can be
+// filtered with owner and machine (repeatable) and sorted by counter,
+// datapoints, bytes or series with sort, keeping the top ones with top.
+// The records span every org, so the request has to carry the configured
+// token as "Authorization: Bearer <token>".
+func serveMetering(w http.ResponseWriter, r *http.Request, m *meter, token string) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		jsonError(w, http.StatusMethodNotAllowed, "invalid metering method")
+		return
+	}
+
+	if m == nil || token == "" {
+		jsonError(w, http.StatusNotFound, "metering is disabled")
+		return
+	}
+
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		jsonError(w, http.StatusUnauthorized, "invalid metering token")
+		return
+	}
+
+	q := r.URL.Query()
+
+	sortKey := q.Get("sort")
+	if sortKey != "" && !meteringSortKeys[sortKey] {
+		jsonError(w, http.StatusBadRequest, "invalid sort, expected counter, datapoints, bytes or series")
+		return
+	}
+
+	top := 0
+	if s := q.Get("top"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			jsonError(w, http.StatusBadRequest, "invalid top")
+			return
+		}
+		top = n
+	}
+
+	owners := make(map[string]bool)
+	for _, o := range q["owner"] {
+		owners[o] = true
+	}
+	machines := make(map[string]bool)
+	for _, machine := range q["machine"] {
+		machines[machine] = true
+	}
+
+	report, all, pending := m.snapshot()
+
+	records := make([]map[string]interface{}, 0)
+	for _, record := range all {
+		if len(owners) > 0 && !owners[record["owner"].(string)] {
+			continue
+		}
+		if len(machines) > 0 && !machines[record["machine"].(string)] {
+			continue
+		}
+		records = append(records, record)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		if records[i]["owner"] != records[j]["owner"] {
+			return records[i]["owner"].(string) < records[j]["owner"].(string)
+		}
+		return records[i]["machine"].(string) < records[j]["machine"].(string)
+	})
+	if sortKey != "" {
+		sort.SliceStable(records, func(i, j int) bool {
+			return meteringValue(records[i][sortKey]) > meteringValue(records[j][sortKey])
+		})
+	}
+
+	if top > 0 && len(records) > top {
+		records = records[:top]
+	}
+
+	data, err := json.Marshal(M{
+		"gockyId":     report.GockyID,
+		"relay":       report.Relay,
+		"periodStart": report.PeriodStart,
+		"now":         report.PeriodEnd,
+		"pending":     pending,
+		"records":     records,
+	})
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, "problem encoding metering data")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// meteringValue returns a numeric record field for sorting
+func meteringValue(v interface{}) int64 {
+	switch n := v.(type) {
+	case int:
+		return int64(n)
+	case int64:
+		return n
+	}
+	return 0
+}
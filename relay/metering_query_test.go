@@ -0,0 +1,106 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type meteringQueryResponse struct {
+	Relay   string                   `json:"relay"`
+	Pending int                      `json:"pending"`
+	Records []map[string]interface{} `json:"records"`
+}
+
+func queryMetering(t *testing.T, m *meter, token, query string) (int, *meteringQueryResponse) {
+	t.Helper()
+
+	req := httptest.NewRequest("GET", "/metering"+query, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	serveMetering(rec, req, m, "secret")
+
+	if rec.Code != http.StatusOK {
+		return rec.Code, nil
+	}
+	var resp meteringQueryResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding %s: %v", rec.Body, err)
+	}
+	return rec.Code, &resp
+}
+
+func machinesOf(resp *meteringQueryResponse) []string {
+	var out []string
+	for _, r := range resp.Records {
+		out = append(out, r["owner"].(string)+"/"+r["machine"].(string))
+	}
+	return out
+}
+
+func TestServeMetering(t *testing.T) {
+	m, err := newMeter("relay1", "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.add("org1", "m1", meteringTestUsage(t, "cpu user=1\n"))
+	m.add("org1", "m2", meteringTestUsage(t, "cpu user=1,system=2,idle=3\n"))
+	m.add("org2", "m3", meteringTestUsage(t, "cpu user=1,system=2\n"))
+
+	if code, _ := queryMetering(t, m, "", ""); code != http.StatusUnauthorized {
+		t.Errorf("no token answered %d", code)
+	}
+	if code, _ := queryMetering(t, m, "wrong", ""); code != http.StatusUnauthorized {
+		t.Errorf("wrong token answered %d", code)
+	}
+
+	_, resp := queryMetering(t, m, "secret", "")
+	if resp.Relay != "relay1" || resp.Pending != 0 {
+		t.Errorf("response for relay %q with %d pending", resp.Relay, resp.Pending)
+	}
+	if got := machinesOf(resp); len(got) != 3 || got[0] != "org1/m1" || got[2] != "org2/m3" {
+		t.Errorf("records %v, want every machine ordered by owner and machine", got)
+	}
+
+	_, resp = queryMetering(t, m, "secret", "?owner=org1&machine=m2&machine=m3")
+	if got := machinesOf(resp); len(got) != 1 || got[0] != "org1/m2" {
+		t.Errorf("filtered records %v, want org1/m2", got)
+	}
+
+	_, resp = queryMetering(t, m, "secret", "?sort=datapoints&top=2")
+	if got := machinesOf(resp); len(got) != 2 || got[0] != "org1/m2" || got[1] != "org2/m3" {
+		t.Errorf("top records %v, want org1/m2 and org2/m3", got)
+	}
+
+	for _, q := range []string{"?sort=owner", "?top=-1", "?top=all"} {
+		if code, _ := queryMetering(t, m, "secret", q); code != http.StatusBadRequest {
+			t.Errorf("%s answered %d", q, code)
+		}
+	}
+}
+
+func TestServeMeteringDisabled(t *testing.T) {
+	rec := httptest.NewRecorder()
+	serveMetering(rec, httptest.NewRequest("GET", "/metering", nil), nil, "secret")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("relay without metering answered %d", rec.Code)
+	}
+
+	m, _ := newMeter("relay1", "", "", nil)
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/metering", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	serveMetering(rec, req, m, "")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("relay without a query token answered %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	serveMetering(rec, httptest.NewRequest("POST", "/metering", nil), m, "secret")
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST answered %d", rec.Code)
+	}
+}
@@ -0,0 +1,285 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// Metering sink types
+const (
+	meteringSinkAMQP     = "amqp"
+	meteringSinkWebhook  = "webhook"
+	meteringSinkFile     = "file"
+	meteringSinkInfluxDB = "influxdb"
+
+	// DefaultMeteringMeasurement is the measurement the influxdb sink writes to
+	DefaultMeteringMeasurement = "gocky_metering"
+)
+
+// meteringSink ships metering reports somewhere. send returns once the
+// report is safely delivered; it is called again for the same report
+// after a failure, so sinks must tolerate duplicates.
+type meteringSink interface {
+	// name identifies the sink in the state file
+	name() string
+	send(r *meteringReport) error
+	close()
+}
+
+// newMeteringSinks builds the sinks of a relay. Without configured sinks
+// reports are published to Rabbitmq if an amqp-url is set.
+func newMeteringSinks(cfgs []MeteringSinkConfig, amqpCfg amqpPublisherConfig) ([]meteringSink, error) {
+	if len(cfgs) == 0 && amqpCfg.URL != "" {
+		cfgs = []MeteringSinkConfig{{Type: meteringSinkAMQP}}
+	}
+
+	var sinks []meteringSink
+	for _, cfg := range cfgs {
+		s, err := newMeteringSink(cfg, amqpCfg)
+		if err != nil {
+			for _, s := range sinks {
+				s.close()
+			}
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+
+	return sinks, nil
+}
+
+func newMeteringSink(cfg MeteringSinkConfig, amqpCfg amqpPublisherConfig) (meteringSink, error) {
+	timeout := DefaultHTTPTimeout
+	if cfg.Timeout != "" {
+		t, err := time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing metering sink timeout '%v'", err)
+		}
+		timeout = t
+	}
+
+	switch cfg.Type {
+	case meteringSinkAMQP:
+		if cfg.Location != "" {
+			amqpCfg.URL = cfg.Location
+		}
+		if amqpCfg.URL == "" {
+			return nil, fmt.Errorf("missing location or amqp-url for amqp metering sink")
+		}
+		return &amqpMeteringSink{p: getAMQPPublisher(amqpCfg)}, nil
+
+	case meteringSinkWebhook:
+		if cfg.Location == "" {
+			return nil, fmt.Errorf("missing location for webhook metering sink")
+		}
+		return &webhookMeteringSink{
+			location: cfg.Location,
+			client:   &http.Client{Timeout: timeout},
+		}, nil
+
+	case meteringSinkFile:
+		if cfg.Location == "" {
+			return nil, fmt.Errorf("missing location for file metering sink")
+		}
+		return &fileMeteringSink{path: cfg.Location}, nil
+
+	case meteringSinkInfluxDB:
+		if cfg.Location == "" || cfg.Database == "" {
+			return nil, fmt.Errorf("missing location or database for influxdb metering sink")
+		}
+		measurement := cfg.Measurement
+		if measurement == "" {
+			measurement = DefaultMeteringMeasurement
+		}
+		return &influxdbMeteringSink{
+			location:    cfg.Location,
+			poster:      newSimplePoster(cfg.Location, timeout, cfg.SkipTLSVerification),
+			query:       url.Values{"db": []string{cfg.Database}, "precision": []string{"s"}}.Encode(),
+			measurement: measurement,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown metering sink type %q", cfg.Type)
+}
+
+// amqpMeteringSink publishes reports to Rabbitmq, waiting for confirms
+type amqpMeteringSink struct {
+	p *amqpPublisher
+}
+
+func (s *amqpMeteringSink) name() string {
+	return meteringSinkAMQP + ":" + s.p.cfg.Exchange + "/" + s.p.cfg.RoutingKey
+}
+
+func (s *amqpMeteringSink) send(r *meteringReport) error {
+	body, err := json.Marshal(flattenMeteringData(r))
+	if err != nil {
+		return err
+	}
+
+	return s.p.publishWait(body, meteringConfirmTimeout)
+}
+
+func (s *amqpMeteringSink) close() {
+	s.p.release()
+}
+
+// webhookMeteringSink POSTs the records of a report as a JSON array
+type webhookMeteringSink struct {
+	location string
+	client   *http.Client
+}
+
+func (s *webhookMeteringSink) name() string {
+	return meteringSinkWebhook + ":" + s.location
+}
+
+func (s *webhookMeteringSink) send(r *meteringReport) error {
+	return postJSON(s.client, s.location, flattenMeteringData(r))
+}
+
+// postJSON POSTs v as JSON and fails unless the response is a 2xx
+func postJSON(client *http.Client, location string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Post(location, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%d response from webhook %q", resp.StatusCode, location)
+	}
+	return nil
+}
+
+func (s *webhookMeteringSink) close() {}
+
+// fileMeteringSink appends the records of a report to a file, one JSON
+// object per line
+type fileMeteringSink struct {
+	path string
+	mu   sync.Mutex
+}
+
+func (s *fileMeteringSink) name() string {
+	return meteringSinkFile + ":" + s.path
+}
+
+func (s *fileMeteringSink) send(r *meteringReport) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, record := range flattenMeteringData(r) {
+		if err := enc.Encode(record); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return appendFile(s.path, buf.Bytes())
+}
+
+// appendFile appends data to a file and syncs it.
+// The caller serializes writes to the same file.
+func appendFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s *fileMeteringSink) close() {}
+
+// influxdbMeteringSink writes reports as line protocol, one point per org
+// and machine and one per measurement they wrote, at the end of the
+// period. Sending a report again overwrites the same points.
+type influxdbMeteringSink struct {
+	location    string
+	poster      poster
+	query       string
+	measurement string
+}
+
+func (s *influxdbMeteringSink) name() string {
+	return meteringSinkInfluxDB + ":" + s.location
+}
+
+func (s *influxdbMeteringSink) send(r *meteringReport) error {
+	var buf bytes.Buffer
+
+	for orgID, machines := range r.Counters {
+		for machineID, c := range machines {
+			// relays meter separately, their reports must not overwrite each other
+			tags := map[string]string{
+				"gocky_id": r.GockyID,
+				"relay":    r.Relay,
+				"owner":    orgID,
+				"machine":  machineID,
+			}
+
+			p, err := models.NewPoint(s.measurement, models.NewTags(tags), models.Fields{
+				"seq":        int64(r.Seq),
+				"counter":    int64(c.Samples),
+				"datapoints": int64(c.Datapoints),
+				"bytes":      c.Bytes,
+				"series":     int64(c.distinctSeries()),
+			}, r.PeriodEnd)
+			if err != nil {
+				return err
+			}
+			buf.WriteString(p.PrecisionString("s"))
+			buf.WriteByte('\n')
+
+			for measurement, n := range c.Measurements {
+				tags["measurement"] = measurement
+				p, err := models.NewPoint(s.measurement+"_measurements", models.NewTags(tags), models.Fields{
+					"datapoints": int64(n),
+				}, r.PeriodEnd)
+				if err != nil {
+					return err
+				}
+				buf.WriteString(p.PrecisionString("s"))
+				buf.WriteByte('\n')
+			}
+			delete(tags, "measurement")
+		}
+	}
+
+	if buf.Len() == 0 {
+		return nil
+	}
+
+	resp, err := s.poster.post(buf.Bytes(), s.query, "", "")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%d response from metering influxdb %q", resp.StatusCode, s.location)
+	}
+	return nil
+}
+
+func (s *influxdbMeteringSink) close() {}
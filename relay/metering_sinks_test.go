@@ -0,0 +1,158 @@
+package relay
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testMeteringReport() *meteringReport {
+	end := time.Unix(1600000060, 0).UTC()
+	return &meteringReport{
+		GockyID:     "gocky1",
+		Relay:       "relay1",
+		Seq:         3,
+		PeriodStart: end.Add(-time.Minute),
+		PeriodEnd:   end,
+		Counters: map[string]map[string]*meteringCounter{
+			"org1": {"m1": {Samples: 2, Datapoints: 5, Bytes: 80, SeriesCount: 4, Measurements: map[string]int{"cpu": 5}}},
+		},
+	}
+}
+
+func TestWebhookMeteringSink(t *testing.T) {
+	var records []map[string]interface{}
+	status := http.StatusNoContent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s with content type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		json.NewDecoder(r.Body).Decode(&records)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	s, err := newMeteringSink(MeteringSinkConfig{Type: meteringSinkWebhook, Location: srv.URL}, amqpPublisherConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	if err := s.send(testMeteringReport()); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("got %d records, want 1", len(records))
+	}
+	r := records[0]
+	if r["owner"] != "org1" || r["machine"] != "m1" || r["seq"] != 3.0 || r["series"] != 4.0 || r["datapoints"] != 5.0 {
+		t.Errorf("unexpected record %v", r)
+	}
+
+	status = http.StatusBadGateway
+	if err := s.send(testMeteringReport()); err == nil {
+		t.Error("a 502 response was accepted")
+	}
+}
+
+func TestFileMeteringSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocky-sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metering.jsonl")
+
+	s, err := newMeteringSink(MeteringSinkConfig{Type: meteringSinkFile, Location: path}, amqpPublisherConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.name() != "file:"+path {
+		t.Errorf("name() = %q", s.name())
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := s.send(testMeteringReport()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, _ := ioutil.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("file holds %d lines, want 2:\n%s", len(lines), data)
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[1]), &record); err != nil || record["bytes"] != 80.0 {
+		t.Errorf("line %q decoded to %v, %v", lines[1], record, err)
+	}
+}
+
+func TestInfluxDBMeteringSink(t *testing.T) {
+	var query, body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		data, _ := ioutil.ReadAll(r.Body)
+		body = string(data)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	s, err := newMeteringSink(MeteringSinkConfig{Type: meteringSinkInfluxDB, Location: srv.URL + "/write", Database: "usage"}, amqpPublisherConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.send(testMeteringReport()); err != nil {
+		t.Fatal(err)
+	}
+
+	if query != "db=usage&precision=s" {
+		t.Errorf("query = %q", query)
+	}
+	for _, want := range []string{
+		"gocky_metering,gocky_id=gocky1,machine=m1,owner=org1,relay=relay1 ",
+		"series=4i",
+		"gocky_metering_measurements,gocky_id=gocky1,machine=m1,measurement=cpu,owner=org1,relay=relay1 datapoints=5i 1600000060\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body does not contain %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestNewMeteringSinksConfig(t *testing.T) {
+	for _, cfg := range []MeteringSinkConfig{
+		{Type: "kafka", Location: "x"},
+		{Type: meteringSinkWebhook},
+		{Type: meteringSinkFile},
+		{Type: meteringSinkInfluxDB, Location: "http://influxdb:8086/write"},
+		{Type: meteringSinkAMQP},
+		{Type: meteringSinkWebhook, Location: "http://x", Timeout: "soon"},
+	} {
+		if _, err := newMeteringSinks([]MeteringSinkConfig{cfg}, amqpPublisherConfig{}); err == nil {
+			t.Errorf("newMeteringSinks(%+v): expected an error", cfg)
+		}
+	}
+
+	// without sinks nothing is sent unless an amqp-url is set
+	if sinks, err := newMeteringSinks(nil, amqpPublisherConfig{}); err != nil || len(sinks) != 0 {
+		t.Errorf("newMeteringSinks(nil) = %v, %v", sinks, err)
+	}
+
+	sinks, err := newMeteringSinks(nil, amqpPublisherConfig{URL: unreachableAMQP, RoutingKey: "metering"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sinks) != 1 || sinks[0].name() != "amqp:/metering" {
+		t.Errorf("default sinks = %v", sinks)
+	}
+	for _, s := range sinks {
+		s.close()
+	}
+}
@@ -0,0 +1,233 @@
+package relay
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// recordingSink keeps the reports it is sent, or fails while err is set
+type recordingSink struct {
+	id      string
+	err     error
+	reports []*meteringReport
+}
+
+func (s *recordingSink) name() string { return s.id }
+func (s *recordingSink) close()       {}
+
+func (s *recordingSink) send(r *meteringReport) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.reports = append(s.reports, r)
+	return nil
+}
+
+func meteringTestUsage(t *testing.T, lines string) *meteringUsage {
+	t.Helper()
+	points, err := models.ParsePointsString(lines)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newMeteringUsage(points, len(lines))
+}
+
+func TestMeterReportsDeltas(t *testing.T) {
+	sink := &recordingSink{id: "test"}
+	m, err := newMeter("relay", "", "", []meteringSink{sink})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.add("org1", "m1", meteringTestUsage(t, "cpu,cpu=cpu0 user=1,system=2\n"))
+	m.add("org1", "m1", meteringTestUsage(t, "cpu,cpu=cpu0 user=3,system=4\n"))
+	m.push()
+
+	m.add("org1", "m1", meteringTestUsage(t, "mem free=1i\n"))
+	m.push()
+
+	// a period without samples is not reported
+	m.push()
+
+	if len(sink.reports) != 2 {
+		t.Fatalf("%d reports sent, want 2", len(sink.reports))
+	}
+	first, second := sink.reports[0], sink.reports[1]
+
+	if first.Seq != 1 || second.Seq != 2 {
+		t.Errorf("sequence numbers %d, %d", first.Seq, second.Seq)
+	}
+	if !second.PeriodStart.Equal(first.PeriodEnd) {
+		t.Errorf("second period starts at %v, first ended at %v", second.PeriodStart, first.PeriodEnd)
+	}
+
+	if c := first.Counters["org1"]["m1"]; c.Samples != 2 || c.Datapoints != 4 || c.distinctSeries() != 2 {
+		t.Errorf("first report counted %+v", c)
+	}
+	// counters start over after a report
+	if c := second.Counters["org1"]["m1"]; c.Samples != 1 || c.Datapoints != 1 || c.distinctSeries() != 1 {
+		t.Errorf("second report counted %+v", c)
+	}
+
+	if len(m.pending) != 0 {
+		t.Errorf("%d reports still pending", len(m.pending))
+	}
+}
+
+func TestMeterResendsUndelivered(t *testing.T) {
+	ok := &recordingSink{id: "ok"}
+	flaky := &recordingSink{id: "flaky", err: errors.New("unreachable")}
+	m, err := newMeter("relay", "", "", []meteringSink{ok, flaky})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.add("org1", "m1", meteringTestUsage(t, "cpu user=1\n"))
+	m.push()
+	m.add("org1", "m1", meteringTestUsage(t, "cpu user=1\n"))
+	m.push()
+
+	if len(ok.reports) != 2 || len(m.pending) != 2 {
+		t.Fatalf("%d reports delivered and %d pending, want 2 and 2", len(ok.reports), len(m.pending))
+	}
+
+	flaky.err = nil
+	m.push()
+
+	// the failed sink gets both reports in order, the other none again
+	if len(flaky.reports) != 2 || flaky.reports[0].Seq != 1 || flaky.reports[1].Seq != 2 {
+		t.Errorf("flaky sink got %d reports", len(flaky.reports))
+	}
+	if len(ok.reports) != 2 {
+		t.Errorf("delivered reports were sent again")
+	}
+	if len(m.pending) != 0 {
+		t.Errorf("%d reports still pending", len(m.pending))
+	}
+}
+
+func TestMeterPersistsState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocky-metering")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "state.json")
+
+	down := &recordingSink{id: "down", err: errors.New("unreachable")}
+	m, err := newMeter("relay", file, "", []meteringSink{down})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.add("org1", "m1", meteringTestUsage(t, "cpu,cpu=cpu0 user=1,system=2\n"))
+	m.push()
+	m.add("org1", "m1", meteringTestUsage(t, "cpu,cpu=cpu0 user=5\n"))
+	m.stop()
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the current period keeps its series hashes
+	if n := strings.Count(string(data), `"series":`); n != 1 {
+		t.Errorf("state holds %d series lists, want 1:\n%s", n, data)
+	}
+
+	up := &recordingSink{id: "down"}
+	m, err = newMeter("relay", file, "", []meteringSink{up})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.stop()
+
+	// user was written in this period before the restart, only idle is new
+	m.add("org1", "m1", meteringTestUsage(t, "cpu,cpu=cpu0 user=1,idle=2\n"))
+	m.push()
+
+	if len(up.reports) != 2 {
+		t.Fatalf("%d reports sent after the restart, want 2", len(up.reports))
+	}
+	if r := up.reports[0]; r.Seq != 1 || r.Counters["org1"]["m1"].distinctSeries() != 2 {
+		t.Errorf("restored report %d counted %+v", r.Seq, r.Counters["org1"]["m1"])
+	}
+	if r := up.reports[1]; r.Seq != 2 || r.Counters["org1"]["m1"].Samples != 2 || r.Counters["org1"]["m1"].distinctSeries() != 2 {
+		t.Errorf("report %d counted %+v", r.Seq, r.Counters["org1"]["m1"])
+	}
+}
+
+func TestRelaysMeterSeparately(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocky-relays")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	newRelay := func(name string) *HTTP {
+		t.Helper()
+		r, err := NewHTTP(HTTPConfig{
+			Name:              name,
+			Addr:              "127.0.0.1:0",
+			EnableMetering:    true,
+			MeteringStateFile: filepath.Join(dir, name+".state"),
+			MeteringSinks:     []MeteringSinkConfig{{Type: meteringSinkFile, Location: filepath.Join(dir, name+".jsonl")}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r.(*HTTP)
+	}
+
+	a, b := newRelay("a"), newRelay("b")
+	defer a.metering.stop()
+	defer b.metering.stop()
+
+	a.metering.add("org1", "m1", meteringTestUsage(t, "cpu user=1\n"))
+	a.metering.push()
+	b.metering.push()
+
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "a.jsonl")); !strings.Contains(string(data), `"relay":"a"`) {
+		t.Errorf("relay a reported %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b.jsonl")); !os.IsNotExist(err) {
+		t.Errorf("relay b reported the usage of relay a")
+	}
+
+	// a state file belongs to a single relay at a time
+	_, err = NewHTTP(HTTPConfig{
+		Name:              "c",
+		EnableMetering:    true,
+		MeteringStateFile: filepath.Join(dir, "a.state"),
+		MeteringSinks:     []MeteringSinkConfig{{Type: meteringSinkFile, Location: filepath.Join(dir, "c.jsonl")}},
+	})
+	if err == nil || !strings.Contains(err.Error(), `relay "a"`) {
+		t.Errorf("sharing the state file of relay a returned %v", err)
+	}
+}
+
+func TestMeterStateFileReleasedOnStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocky-metering")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "state.json")
+
+	m, err := newMeter("first", file, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.stop()
+
+	m, err = newMeter("second", file, "", nil)
+	if err != nil {
+		t.Fatalf("state file of a stopped relay: %v", err)
+	}
+	m.stop()
+}
@@ -0,0 +1,197 @@
+package relay
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"unicode/utf8"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// meteringUsage is what a single write counts for
+type meteringUsage struct {
+	// samples is the number of points, the original metering counter
+	samples int
+
+	// datapoints is the number of numeric fields, as stored by the backends
+	datapoints int
+
+	// bytes is the size of the uncompressed line protocol
+	bytes int64
+
+	// series identifies every measurement, tag set and field written
+	series []uint64
+
+	// measurements holds the datapoints per measurement
+	measurements map[string]int
+}
+
+// newMeteringUsage measures a write. Only float and integer fields count
+// as datapoints, like everywhere else in the relays.
+func newMeteringUsage(points []models.Point, bytes int) *meteringUsage {
+	u := &meteringUsage{
+		samples:      len(points),
+		bytes:        int64(bytes),
+		measurements: make(map[string]int),
+	}
+
+	for _, p := range points {
+		key := p.Key()
+		n := 0
+
+		fi := p.FieldIterator()
+		for fi.Next() {
+			switch fi.Type() {
+			case models.Float, models.Integer:
+			default:
+				continue
+			}
+			if !utf8.Valid(fi.FieldKey()) {
+				continue
+			}
+
+			h := fnv.New64a()
+			h.Write(key)
+			h.Write([]byte{' '})
+			h.Write(fi.FieldKey())
+			u.series = append(u.series, h.Sum64())
+			n++
+		}
+
+		if n > 0 {
+			u.datapoints += n
+			u.measurements[string(p.Name())] += n
+		}
+	}
+
+	return u
+}
+
+// meteringCounter accumulates the usage of a machine during a period
+type meteringCounter struct {
+	Samples      int            `json:"samples"`
+	Datapoints   int            `json:"datapoints"`
+	Bytes        int64          `json:"bytes"`
+	Measurements map[string]int `json:"measurements"`
+
+	// hashes of the distinct series written in the period, dropped once
+	// the period is closed and only their number is kept in SeriesCount
+	Series      map[uint64]struct{} `json:"-"`
+	SeriesCount int                 `json:"-"`
+}
+
+// distinctSeries returns the number of distinct series of the period
+func (c *meteringCounter) distinctSeries() int {
+	if c.Series != nil {
+		return len(c.Series)
+	}
+	return c.SeriesCount
+}
+
+// seal keeps the number of series of a closed period and drops the hashes,
+// which are only needed to count series that are still being written
+func (c *meteringCounter) seal() {
+	c.SeriesCount = c.distinctSeries()
+	c.Series = nil
+}
+
+func (c *meteringCounter) add(u *meteringUsage) {
+	c.Samples += u.samples
+	c.Datapoints += u.datapoints
+	c.Bytes += u.bytes
+
+	if c.Measurements == nil {
+		c.Measurements = make(map[string]int)
+	}
+	for name, n := range u.measurements {
+		c.Measurements[name] += n
+	}
+
+	if c.Series == nil {
+		c.Series = make(map[uint64]struct{})
+	}
+	for _, s := range u.series {
+		c.Series[s] = struct{}{}
+	}
+}
+
+func (c *meteringCounter) merge(o *meteringCounter) {
+	c.Samples += o.Samples
+	c.Datapoints += o.Datapoints
+	c.Bytes += o.Bytes
+
+	if c.Measurements == nil {
+		c.Measurements = make(map[string]int)
+	}
+	for name, n := range o.Measurements {
+		c.Measurements[name] += n
+	}
+
+	if c.Series == nil {
+		c.Series = make(map[uint64]struct{})
+	}
+	for s := range o.Series {
+		c.Series[s] = struct{}{}
+	}
+}
+
+// meteringCounterJSON is how counters are persisted, with the series
+// hashes as a list, or just their number for sealed counters
+type meteringCounterJSON struct {
+	Samples      int            `json:"samples"`
+	Datapoints   int            `json:"datapoints"`
+	Bytes        int64          `json:"bytes"`
+	Measurements map[string]int `json:"measurements,omitempty"`
+	Series       []uint64       `json:"series,omitempty"`
+	SeriesCount  int            `json:"seriesCount,omitempty"`
+}
+
+func (c *meteringCounter) MarshalJSON() ([]byte, error) {
+	j := meteringCounterJSON{
+		Samples:      c.Samples,
+		Datapoints:   c.Datapoints,
+		Bytes:        c.Bytes,
+		Measurements: c.Measurements,
+	}
+	if c.Series == nil {
+		j.SeriesCount = c.SeriesCount
+	}
+	for s := range c.Series {
+		j.Series = append(j.Series, s)
+	}
+
+	return json.Marshal(j)
+}
+
+func (c *meteringCounter) UnmarshalJSON(data []byte) error {
+	// state files written before the counters had dimensions hold the
+	// number of samples only
+	var samples int
+	if err := json.Unmarshal(data, &samples); err == nil {
+		*c = meteringCounter{Samples: samples}
+		return nil
+	}
+
+	var j meteringCounterJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+
+	*c = meteringCounter{
+		Samples:      j.Samples,
+		Datapoints:   j.Datapoints,
+		Bytes:        j.Bytes,
+		Measurements: j.Measurements,
+		SeriesCount:  j.SeriesCount,
+	}
+	if j.SeriesCount > 0 {
+		return nil
+	}
+
+	c.Series = make(map[uint64]struct{}, len(j.Series))
+	for _, s := range j.Series {
+		c.Series[s] = struct{}{}
+	}
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package relay
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+func TestNewMeteringUsage(t *testing.T) {
+	body := "cpu,cpu=cpu0 user=1,system=2,state=\"idle\"\n" +
+		"cpu,cpu=cpu1 user=3\n" +
+		"mem free=4i\n" +
+		"event,kind=boot up=true\n"
+	points, err := models.ParsePointsString(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := newMeteringUsage(points, len(body))
+
+	if u.samples != 4 {
+		t.Errorf("samples = %d, want 4", u.samples)
+	}
+	// string and boolean fields are not datapoints
+	if u.datapoints != 4 {
+		t.Errorf("datapoints = %d, want 4", u.datapoints)
+	}
+	if u.bytes != int64(len(body)) {
+		t.Errorf("bytes = %d, want %d", u.bytes, len(body))
+	}
+	if len(u.series) != 4 {
+		t.Errorf("%d series, want 4", len(u.series))
+	}
+	if want := map[string]int{"cpu": 3, "mem": 1}; !reflect.DeepEqual(u.measurements, want) {
+		t.Errorf("measurements = %v, want %v", u.measurements, want)
+	}
+}
+
+func TestMeteringCounterDistinctSeries(t *testing.T) {
+	points, _ := models.ParsePointsString("cpu,cpu=cpu0 user=1,system=2\n")
+	u := newMeteringUsage(points, 0)
+
+	c := new(meteringCounter)
+	c.add(u)
+	c.add(u)
+
+	if c.Samples != 2 || c.Datapoints != 4 || c.distinctSeries() != 2 {
+		t.Errorf("counter = %+v, want 2 samples, 4 datapoints and 2 series", c)
+	}
+	if c.Measurements["cpu"] != 4 {
+		t.Errorf("cpu datapoints = %d, want 4", c.Measurements["cpu"])
+	}
+}
+
+func TestMeteringCounterJSON(t *testing.T) {
+	// state files written before counters had dimensions
+	var old meteringCounter
+	if err := json.Unmarshal([]byte("7"), &old); err != nil || old.Samples != 7 {
+		t.Errorf("legacy counter decoded to %+v, %v", old, err)
+	}
+
+	c := &meteringCounter{
+		Samples:      1,
+		Datapoints:   2,
+		Bytes:        30,
+		Measurements: map[string]int{"cpu": 2},
+		Series:       map[uint64]struct{}{1: {}, 2: {}},
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var open meteringCounter
+	if err := json.Unmarshal(data, &open); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&open, c) {
+		t.Errorf("round trip of %s = %+v, want %+v", data, open, c)
+	}
+
+	// sealed counters keep only the number of series
+	c.seal()
+	data, _ = json.Marshal(c)
+	var sealed meteringCounter
+	if err := json.Unmarshal(data, &sealed); err != nil {
+		t.Fatal(err)
+	}
+	if sealed.Series != nil || sealed.distinctSeries() != 2 {
+		t.Errorf("sealed counter %s decoded to %+v", data, sealed)
+	}
+}
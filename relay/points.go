@@ -3,11 +3,12 @@ package relay
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"hash/fnv"
 	"regexp"
-	"time"
+	"sort"
+	"strings"
 
 	"github.com/influxdata/telegraf"
-	"github.com/influxdata/telegraf/metric"
 )
 
 //BeringeiPoint is the Point that we push to Rabbitmq
@@ -31,15 +32,106 @@ func NewBeringeiPoint(name, field string, timestamp int64, tags map[string]strin
 	}
 }
 
-// This will take the initial telegraf key and then generate a unique Id based in the key and the Field
-func (*BeringeiPoint) generateID(p *BeringeiPoint, key []byte) {
+// Series ID versions of the Beringei relay
+const (
+	// SeriesIDLegacy is the ID of older releases: the point key and field
+	// followed by the SHA-256 of nothing, in hex. It depends on the tag
+	// order of the write and grows with the key.
+	SeriesIDLegacy = 0
 
-	fieldByte := []byte(p.Field)
-	bytestring := append(key, fieldByte...)
+	// SeriesIDv1 is "v1:" followed by the first 16 bytes of the SHA-256
+	// of the canonical series, in hex
+	SeriesIDv1 = 1
+)
+
+// Every separator and backslash is escaped in canonical series, unlike in
+// line protocol, so they can be parsed back unambiguously
+var seriesEscaper = strings.NewReplacer(`\`, `\\`, ",", `\,`, "=", `\=`, " ", `\ `)
+
+// canonicalSeries identifies a series regardless of how it was written:
+// the escaped measurement, tags sorted by key and the field, like
+// "cpu,cpu=cpu0,host=a usage_idle"
+func canonicalSeries(name string, tags map[string]string, field string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(seriesEscaper.Replace(name))
+	for _, k := range keys {
+		b.WriteByte(',')
+		b.WriteString(seriesEscaper.Replace(k))
+		b.WriteByte('=')
+		b.WriteString(seriesEscaper.Replace(tags[k]))
+	}
+	b.WriteByte(' ')
+	b.WriteString(seriesEscaper.Replace(field))
+	return b.String()
+}
+
+// parseCanonicalSeries splits a canonical series into its measurement,
+// tags and field
+func parseCanonicalSeries(s string) (name string, tags map[string]string, field string, ok bool) {
+	var (
+		parts []string
+		cur   []byte
+		seps  []byte
+	)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' && i+1 < len(s) {
+			i++
+			cur = append(cur, s[i])
+			continue
+		}
+		if c == ',' || c == '=' || c == ' ' {
+			parts = append(parts, string(cur))
+			seps = append(seps, c)
+			cur = cur[:0]
+			continue
+		}
+		cur = append(cur, c)
+	}
+	parts = append(parts, string(cur))
+
+	// measurement, then tag keys and values, then the field
+	if len(parts) < 2 || len(parts)%2 != 0 || seps[len(seps)-1] != ' ' {
+		return "", nil, "", false
+	}
+
+	tags = make(map[string]string)
+	for i := 1; i < len(parts)-1; i += 2 {
+		if seps[i-1] != ',' || seps[i] != '=' {
+			return "", nil, "", false
+		}
+		tags[parts[i]] = parts[i+1]
+	}
+
+	return parts[0], tags, parts[len(parts)-1], true
+}
+
+// seriesIDv1 returns the v1 ID of a canonical series, and a second hash of
+// it to detect IDs shared by different series
+func seriesIDv1(canonical string) (string, uint64) {
+	sum := sha256.Sum256([]byte(canonical))
+
+	h := fnv.New64a()
+	h.Write([]byte(canonical))
+
+	return "v1:" + hex.EncodeToString(sum[:16]), h.Sum64()
+}
+
+// legacySeriesID returns the ID older releases generated from the point
+// key, the way they did
+func legacySeriesID(key []byte, field string) string {
+	bytestring := make([]byte, 0, len(key)+len(field))
+	bytestring = append(bytestring, key...)
+	bytestring = append(bytestring, field...)
 
 	h := sha256.New()
-	hash := h.Sum(bytestring)
-	p.ID = hex.EncodeToString(hash)
+	return hex.EncodeToString(h.Sum(bytestring))
 }
 
 // GraphiteMetric transforms a BeringeiPoint to Graphite compatible format
@@ -63,22 +155,35 @@ func GraphiteMetric(metricName string, tags map[string]string, timestamp int64,
 		parsedMetric, metricName = parseSystem(tags, field, metricName, value)
 	case "swap":
 		parsedMetric = parseSwap(tags, field, value)
+	case "processes":
+		parsedMetric, metricName = parseProcesses(field, value)
+	case "netstat":
+		parsedMetric, metricName = parseNetstat(field, value)
+	case "kernel":
+		parsedMetric, metricName = parseKernel(field, value)
+	case "docker",
+		"docker_container_cpu",
+		"docker_container_mem",
+		"docker_container_net",
+		"docker_container_blkio",
+		"docker_container_status",
+		"docker_container_health":
+		parsedMetric, metricName = parseDocker(tags, field, metricName, value)
+	case "nginx":
+		parsedMetric, metricName = parseNginx(field, value)
+	case "postgresql":
+		parsedMetric, metricName = parsePostgresql(tags, field, value)
+	case "mysql":
+		parsedMetric, metricName = parseMysql(field, value)
+	case "redis", "redis_keyspace":
+		parsedMetric, metricName = parseRedis(tags, field, metricName, value)
+	case "ping":
+		parsedMetric, metricName = parsePing(tags, field, value)
 	default:
 		parsedMetric = map[string]interface{}{field: value}
 	}
 
-	if parsedMetric != nil {
-		m1, _ := metric.New(
-			metricName,
-			map[string]string{"id": tags["machine_id"]},
-			parsedMetric,
-			time.Unix(timestamp/1000000000, 0).UTC(),
-		)
-
-		return m1
-	}
-
-	return nil
+	return newGraphiteMetric(metricName, tags, timestamp, parsedMetric)
 }
 
 func parseCPU(tags map[string]string, field, metricName string, value interface{}) (parsedMetric map[string]interface{}, metricNameFixed string) {
@@ -0,0 +1,70 @@
+package relay
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCanonicalSeries(t *testing.T) {
+	got := canonicalSeries("cpu", map[string]string{"host": "a", "cpu": "cpu0"}, "usage_idle")
+	if want := "cpu,cpu=cpu0,host=a usage_idle"; got != want {
+		t.Errorf("canonicalSeries() = %q, want %q", got, want)
+	}
+
+	if got := canonicalSeries("cpu", nil, "usage_idle"); got != "cpu usage_idle" {
+		t.Errorf("canonicalSeries() without tags = %q", got)
+	}
+
+	// separators and backslashes are escaped everywhere
+	got = canonicalSeries("disk io", map[string]string{"path": `C:\Program Files`, "k=v": "x,y"}, "used bytes")
+	if want := `disk\ io,k\=v=x\,y,path=C:\\Program\ Files used\ bytes`; got != want {
+		t.Errorf("canonicalSeries() = %q, want %q", got, want)
+	}
+}
+
+func TestSeriesIDs(t *testing.T) {
+	id, sum := seriesIDv1("cpu,cpu=cpu0,host=a usage_idle")
+	if id != "v1:7d50c6f4ef1dbefbf0b1fb5935c6ec2d" {
+		t.Errorf("seriesIDv1() = %q", id)
+	}
+
+	other, otherSum := seriesIDv1("cpu,cpu=cpu0,host=b usage_idle")
+	if other == id || otherSum == sum {
+		t.Error("different series share an ID or a sum")
+	}
+
+	// legacy IDs keep the format of older releases
+	legacy := legacySeriesID([]byte("cpu,host=a"), "usage_idle")
+	if want := "6370752c686f73743d6175736167655f69646c65e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"; legacy != want {
+		t.Errorf("legacySeriesID() = %q, want %q", legacy, want)
+	}
+}
+
+func TestParseCanonicalSeries(t *testing.T) {
+	// parsing reverses canonicalSeries, escapes included
+	for _, tags := range []map[string]string{
+		nil,
+		{"host": "a"},
+		{"path": `C:\Program Files`, "k=v": "x,y", "empty": ""},
+	} {
+		canonical := canonicalSeries("disk io", tags, "used bytes")
+
+		name, got, field, ok := parseCanonicalSeries(canonical)
+		if !ok {
+			t.Errorf("parseCanonicalSeries(%q) failed", canonical)
+			continue
+		}
+		if len(tags) == 0 && len(got) == 0 {
+			got = tags
+		}
+		if name != "disk io" || field != "used bytes" || !reflect.DeepEqual(got, tags) {
+			t.Errorf("parseCanonicalSeries(%q) = %q, %v, %q", canonical, name, got, field)
+		}
+	}
+
+	for _, s := range []string{"", "cpu", "cpu,host=a", "cpu,host usage_idle", "cpu usage idle"} {
+		if _, _, _, ok := parseCanonicalSeries(s); ok {
+			t.Errorf("parseCanonicalSeries(%q) succeeded, want a failure", s)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package relay
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/metric"
+)
+
+// GraphiteMapper transforms a single field of a point to a graphite metric.
+// It returns nil for fields that should not be sent to graphite.
+type GraphiteMapper func(metricName string, tags map[string]string, timestamp int64, value interface{}, field string) telegraf.Metric
+
+// Names of the built-in mapping profiles
+const (
+	ProfileLinux         = "linux"
+	ProfileWindows       = "windows"
+	ProfileMacOS         = "macos"
+	ProfileFreeBSD       = "freebsd"
+	ProfileContainer     = "container"
+	ProfileNetworkDevice = "network-device"
+
+	// DefaultProfile is used when neither the request nor the point name a profile
+	DefaultProfile = ProfileLinux
+)
+
+// sourceTypeTag may be set on points to pick their mapping profile when
+// the request has no X-Gocky-Tag-Source-Type header
+const sourceTypeTag = "source_type"
+
+// graphiteProfilesMu guards graphiteProfiles, profiles may be registered
+// while relays are running
+var graphiteProfilesMu sync.RWMutex
+
+var graphiteProfiles = map[string]GraphiteMapper{
+	ProfileLinux:         GraphiteMetric,
+	ProfileWindows:       GraphiteWindowsMetric,
+	ProfileMacOS:         graphiteMacOSMetric,
+	ProfileFreeBSD:       graphiteFreeBSDMetric,
+	ProfileContainer:     graphiteContainerMetric,
+	ProfileNetworkDevice: graphiteNetworkDeviceMetric,
+}
+
+// other names source types are known by
+var graphiteProfileAliases = map[string]string{
+	"unix":    ProfileLinux,
+	"darwin":  ProfileMacOS,
+	"osx":     ProfileMacOS,
+	"bsd":     ProfileFreeBSD,
+	"docker":  ProfileContainer,
+	"network": ProfileNetworkDevice,
+	"snmp":    ProfileNetworkDevice,
+}
+
+// RegisterGraphiteProfile adds or replaces a mapping profile
+func RegisterGraphiteProfile(name string, mapper GraphiteMapper) {
+	graphiteProfilesMu.Lock()
+	graphiteProfiles[strings.ToLower(name)] = mapper
+	graphiteProfilesMu.Unlock()
+}
+
+// lookupGraphiteProfile returns the mapping profile for a source type
+func lookupGraphiteProfile(sourceType string) (GraphiteMapper, bool) {
+	name := strings.ToLower(sourceType)
+	if alias, ok := graphiteProfileAliases[name]; ok {
+		name = alias
+	}
+
+	graphiteProfilesMu.RLock()
+	mapper, ok := graphiteProfiles[name]
+	graphiteProfilesMu.RUnlock()
+	return mapper, ok
+}
+
+// validGraphiteProfile reports whether a configured source type is known
+func validGraphiteProfile(sourceType string) bool {
+	_, ok := lookupGraphiteProfile(sourceType)
+	return ok
+}
+
+// graphiteProfile picks the mapping profile for a point. The request
+// source type wins, then the point's source_type tag, then the default.
+func graphiteProfile(src graphiteSource, tags map[string]string) GraphiteMapper {
+	for _, name := range []string{src.SourceType, tags[sourceTypeTag], src.DefaultSourceType} {
+		if name == "" {
+			continue
+		}
+		if mapper, ok := lookupGraphiteProfile(name); ok {
+			return mapper
+		}
+	}
+
+	mapper, _ := lookupGraphiteProfile(DefaultProfile)
+	return mapper
+}
+
+// newGraphiteMetric builds the metric every mapping profile returns
+func newGraphiteMetric(metricName string, tags map[string]string, timestamp int64, parsedMetric map[string]interface{}) telegraf.Metric {
+	if parsedMetric == nil {
+		return nil
+	}
+
+	m, _ := metric.New(
+		metricName,
+		map[string]string{"id": tags["machine_id"]},
+		parsedMetric,
+		time.Unix(0, timestamp).UTC(),
+	)
+
+	return m
+}
+
+// graphiteMacOSMetric maps telegraf on macOS, which reports memory the
+// way collectd's darwin memory plugin does
+func graphiteMacOSMetric(metricName string, tags map[string]string, timestamp int64, value interface{}, field string) telegraf.Metric {
+	if metricName == "mem" {
+		parsedMetric, metricName := parseBSDMem(field, value, "active", "inactive", "wired", "free")
+		return newGraphiteMetric(metricName, tags, timestamp, parsedMetric)
+	}
+
+	return GraphiteMetric(metricName, tags, timestamp, value, field)
+}
+
+// graphiteFreeBSDMetric maps telegraf on FreeBSD, which reports memory
+// the way collectd's BSD memory plugin does
+func graphiteFreeBSDMetric(metricName string, tags map[string]string, timestamp int64, value interface{}, field string) telegraf.Metric {
+	if metricName == "mem" {
+		parsedMetric, metricName := parseBSDMem(field, value, "active", "inactive", "wired", "cached", "laundry", "buffered", "free")
+		return newGraphiteMetric(metricName, tags, timestamp, parsedMetric)
+	}
+
+	return GraphiteMetric(metricName, tags, timestamp, value, field)
+}
+
+func parseBSDMem(field string, value interface{}, memoryFields ...string) (parsedMetric map[string]interface{}, metricNameFixed string) {
+	parsedMetric = map[string]interface{}{field: value}
+
+	for _, f := range memoryFields {
+		if f == field {
+			return parsedMetric, "memory"
+		}
+	}
+
+	return parsedMetric, "memory_extra"
+}
+
+// graphiteContainerMetric maps telegraf running inside a container.
+// Per core cpu and the container's own pseudo filesystems describe the
+// host rather than the container, so they are dropped.
+func graphiteContainerMetric(metricName string, tags map[string]string, timestamp int64, value interface{}, field string) telegraf.Metric {
+	switch metricName {
+	case "cpu":
+		if tags["cpu"] != "cpu-total" {
+			return nil
+		}
+	case "disk":
+		switch tags["fstype"] {
+		case "overlay", "tmpfs", "shm", "devtmpfs", "aufs":
+			return nil
+		}
+	}
+
+	return GraphiteMetric(metricName, tags, timestamp, value, field)
+}
+
+// graphiteNetworkDeviceMetric maps SNMP polled network devices to the
+// layout of collectd's snmp plugin
+func graphiteNetworkDeviceMetric(metricName string, tags map[string]string, timestamp int64, value interface{}, field string) telegraf.Metric {
+	switch metricName {
+	case "interface", "ifTable", "ifXTable":
+		parsedMetric, metricName := parseSNMPInterface(tags, field, value)
+		return newGraphiteMetric(metricName, tags, timestamp, parsedMetric)
+	}
+
+	return GraphiteMetric(metricName, tags, timestamp, value, field)
+}
+
+func parseSNMPInterface(tags map[string]string, field string, value interface{}) (parsedMetric map[string]interface{}, metricNameFixed string) {
+	name := tags["ifName"]
+	if name == "" {
+		name = tags["ifDescr"]
+	}
+	if name == "" {
+		name = tags["ifIndex"]
+	}
+
+	metricNameFixed = "interface." + name
+	fieldFix := field
+
+	switch field {
+	case "ifHCInOctets", "ifInOctets":
+		metricNameFixed += ".if_octets"
+		fieldFix = "rx"
+	case "ifHCOutOctets", "ifOutOctets":
+		metricNameFixed += ".if_octets"
+		fieldFix = "tx"
+	case "ifHCInUcastPkts", "ifInUcastPkts":
+		metricNameFixed += ".if_packets"
+		fieldFix = "rx"
+	case "ifHCOutUcastPkts", "ifOutUcastPkts":
+		metricNameFixed += ".if_packets"
+		fieldFix = "tx"
+	case "ifInErrors":
+		metricNameFixed += ".if_errors"
+		fieldFix = "rx"
+	case "ifOutErrors":
+		metricNameFixed += ".if_errors"
+		fieldFix = "tx"
+	case "ifInDiscards":
+		metricNameFixed += ".if_dropped"
+		fieldFix = "rx"
+	case "ifOutDiscards":
+		metricNameFixed += ".if_dropped"
+		fieldFix = "tx"
+	default:
+		metricNameFixed = "interface_extra." + name
+	}
+
+	parsedMetric = map[string]interface{}{fieldFix: value}
+	return parsedMetric, metricNameFixed
+}
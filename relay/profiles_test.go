@@ -0,0 +1,117 @@
+package relay
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/influxdata/telegraf"
+)
+
+func sameMapper(a, b GraphiteMapper) bool {
+	return reflect.ValueOf(a).Pointer() == reflect.ValueOf(b).Pointer()
+}
+
+func TestLookupGraphiteProfile(t *testing.T) {
+	for name, want := range map[string]GraphiteMapper{
+		"linux":          GraphiteMetric,
+		"Unix":           GraphiteMetric,
+		"WINDOWS":        GraphiteWindowsMetric,
+		"darwin":         graphiteMacOSMetric,
+		"osx":            graphiteMacOSMetric,
+		"bsd":            graphiteFreeBSDMetric,
+		"docker":         graphiteContainerMetric,
+		"snmp":           graphiteNetworkDeviceMetric,
+		"network-device": graphiteNetworkDeviceMetric,
+	} {
+		got, ok := lookupGraphiteProfile(name)
+		if !ok || !sameMapper(got, want) {
+			t.Errorf("lookupGraphiteProfile(%q) picked the wrong profile", name)
+		}
+	}
+
+	if _, ok := lookupGraphiteProfile("solaris"); ok {
+		t.Error("lookupGraphiteProfile(solaris) should not exist")
+	}
+	if validGraphiteProfile("solaris") {
+		t.Error("validGraphiteProfile(solaris) = true")
+	}
+}
+
+func TestGraphiteProfileSelection(t *testing.T) {
+	tagged := map[string]string{sourceTypeTag: "windows"}
+
+	// the request source type wins over the tag
+	if m := graphiteProfile(graphiteSource{SourceType: "freebsd"}, tagged); !sameMapper(m, graphiteFreeBSDMetric) {
+		t.Error("request source type was not preferred")
+	}
+
+	// the tag wins over the relay default
+	if m := graphiteProfile(graphiteSource{DefaultSourceType: "macos"}, tagged); !sameMapper(m, GraphiteWindowsMetric) {
+		t.Error("source_type tag was not preferred over the default")
+	}
+
+	// unknown names fall through to the next candidate
+	src := graphiteSource{SourceType: "solaris", DefaultSourceType: "docker"}
+	if m := graphiteProfile(src, map[string]string{sourceTypeTag: "plan9"}); !sameMapper(m, graphiteContainerMetric) {
+		t.Error("unknown source types did not fall back to the relay default")
+	}
+
+	if m := graphiteProfile(graphiteSource{}, nil); !sameMapper(m, GraphiteMetric) {
+		t.Error("the default profile is not linux")
+	}
+}
+
+func TestGraphiteProfileRendering(t *testing.T) {
+	mem := "mem used=1i,free=2i,wired=3i,laundry=4i 1600000000000000000"
+
+	checkLines(t, translateLines(t, TranslateConfig{MachineID: "m1", SourceType: "freebsd"}, mem),
+		"bucky.m1.memory_extra.used 1 1600000000",
+		"bucky.m1.memory.free 2 1600000000",
+		"bucky.m1.memory.wired 3 1600000000",
+		"bucky.m1.memory.laundry 4 1600000000",
+	)
+
+	// macOS has no laundry queue
+	checkLines(t, translateLines(t, TranslateConfig{MachineID: "m1", SourceType: "darwin"}, mem),
+		"bucky.m1.memory_extra.used 1 1600000000",
+		"bucky.m1.memory.free 2 1600000000",
+		"bucky.m1.memory.wired 3 1600000000",
+		"bucky.m1.memory_extra.laundry 4 1600000000",
+	)
+
+	checkLines(t, translateLines(t, TranslateConfig{MachineID: "m1", SourceType: "docker"},
+		"cpu,cpu=cpu0 usage_user=1 1600000000000000000",
+		"cpu,cpu=cpu-total usage_user=2 1600000000000000000",
+		"disk,path=/,device=overlay,fstype=overlay used=3i 1600000000000000000",
+		"disk,path=/data,device=sda1,fstype=ext4 used=4i 1600000000000000000",
+	),
+		"bucky.m1.cpu_extra.total.user 2 1600000000",
+		"bucky.m1.df.sda1.df_complex.used 4 1600000000",
+	)
+
+	checkLines(t, translateLines(t, TranslateConfig{MachineID: "m1", SourceType: "snmp"},
+		"ifXTable,ifName=ge-0/0/1 ifHCInOctets=5i,ifHCOutOctets=6i 1600000000000000000"),
+		"bucky.m1.interface.ge-0-0-1.if_octets.rx 5 1600000000",
+		"bucky.m1.interface.ge-0-0-1.if_octets.tx 6 1600000000",
+	)
+}
+
+func TestRegisterGraphiteProfile(t *testing.T) {
+	RegisterGraphiteProfile("Custom-Test", func(metricName string, tags map[string]string, timestamp int64, value interface{}, field string) telegraf.Metric {
+		return newGraphiteMetric("custom."+metricName, tags, timestamp, map[string]interface{}{field: value})
+	})
+	defer func() {
+		graphiteProfilesMu.Lock()
+		delete(graphiteProfiles, "custom-test")
+		graphiteProfilesMu.Unlock()
+	}()
+
+	if !validGraphiteProfile("custom-test") {
+		t.Fatal("registered profile is not valid")
+	}
+
+	checkLines(t, translateLines(t, TranslateConfig{MachineID: "m1", SourceType: "CUSTOM-test"},
+		"app requests=3i 1600000000000000000"),
+		"bucky.m1.custom.app.requests 3 1600000000",
+	)
+}
@@ -59,6 +59,17 @@ func New(config Config) (*Service, error) {
 		s.relays[g.Name()] = g
 
 	}
+
+	for _, cfg := range config.TCPRelays {
+		t, err := NewTCP(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if s.relays[t.Name()] != nil {
+			return nil, fmt.Errorf("duplicate relay: %q", t.Name())
+		}
+		s.relays[t.Name()] = t
+	}
 	return s, nil
 }
 
@@ -0,0 +1,201 @@
+package relay
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+const (
+	// resolveFirst sends to the first address of the location, like dialing it would
+	resolveFirst = "first"
+
+	// resolveAll sends to every A and AAAA record of the location
+	resolveAll = "all"
+
+	// resolveSRV sends to every target of the SRV record the location names
+	resolveSRV = "srv"
+)
+
+// resolver keeps the addresses of a backend location up to date. The
+// location is resolved again once the interval passes, if set, and after
+// a send to it failed. A failed resolution keeps the previous addresses.
+type resolver struct {
+	network  string
+	location string
+	mode     string
+	interval time.Duration
+
+	mu    sync.Mutex
+	addrs []net.Addr
+	// next is when the addresses are due to be resolved again
+	next time.Time
+}
+
+func newResolver(network, location, mode, interval string) (*resolver, error) {
+	r := &resolver{network: network, location: location, mode: resolveFirst}
+
+	switch mode {
+	case "":
+	case resolveFirst, resolveAll, resolveSRV:
+		r.mode = mode
+	default:
+		return nil, fmt.Errorf("unknown resolve mode %q for %q", mode, location)
+	}
+
+	if interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing resolve interval '%v'", err)
+		}
+		r.interval = d
+	}
+
+	return r, nil
+}
+
+// addresses returns the current addresses of the location, resolving it
+// if it is due. Only the first caller resolves, the rest get the previous
+// addresses meanwhile.
+func (r *resolver) addresses() ([]net.Addr, error) {
+	r.mu.Lock()
+	due := r.addrs == nil || (!r.next.IsZero() && !time.Now().Before(r.next))
+	if !due {
+		addrs := r.addrs
+		r.mu.Unlock()
+		return addrs, nil
+	}
+	if r.addrs != nil {
+		// push back the others while resolving
+		r.next = time.Now().Add(time.Second)
+	}
+	r.mu.Unlock()
+
+	addrs, err := r.resolve()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.next = time.Time{}
+	if r.interval > 0 {
+		r.next = time.Now().Add(r.interval)
+	}
+
+	if err != nil {
+		if r.addrs == nil {
+			return nil, err
+		}
+		log.Errorf("Keeping the previous addresses of %q: %v", r.location, err)
+		return r.addrs, nil
+	}
+
+	if r.addrs != nil && !sameAddrs(addrs, r.addrs) {
+		log.Infof("Addresses of %q changed from %v to %v", r.location, r.addrs, addrs)
+	}
+	r.addrs = addrs
+	return addrs, nil
+}
+
+// invalidate resolves the location again on the next send
+func (r *resolver) invalidate() {
+	r.mu.Lock()
+	if r.addrs != nil {
+		r.next = time.Now()
+	}
+	r.mu.Unlock()
+}
+
+func (r *resolver) resolve() ([]net.Addr, error) {
+	switch r.mode {
+	case resolveAll:
+		host, port, err := net.SplitHostPort(r.location)
+		if err != nil {
+			return nil, err
+		}
+		p, err := net.LookupPort(r.network, port)
+		if err != nil {
+			return nil, err
+		}
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return nil, err
+		}
+
+		addrs := make([]net.Addr, 0, len(ips))
+		for _, ip := range ips {
+			addrs = append(addrs, r.addr(ip, p))
+		}
+		return addrs, nil
+
+	case resolveSRV:
+		_, srvs, err := net.LookupSRV("", "", r.location)
+		if err != nil {
+			return nil, err
+		}
+
+		var addrs []net.Addr
+		for _, srv := range srvs {
+			hostport := net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), fmt.Sprint(srv.Port))
+			addr, err := r.resolveFirst(hostport)
+			if err != nil {
+				log.Errorf("Skipping target %s of %q: %v", hostport, r.location, err)
+				continue
+			}
+			addrs = append(addrs, addr)
+		}
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("no usable SRV targets for %q", r.location)
+		}
+		return addrs, nil
+	}
+
+	addr, err := r.resolveFirst(r.location)
+	if err != nil {
+		return nil, err
+	}
+	return []net.Addr{addr}, nil
+}
+
+func (r *resolver) resolveFirst(hostport string) (net.Addr, error) {
+	if r.network == "udp" {
+		return net.ResolveUDPAddr("udp", hostport)
+	}
+	return net.ResolveTCPAddr("tcp", hostport)
+}
+
+func (r *resolver) addr(ip net.IP, port int) net.Addr {
+	if r.network == "udp" {
+		return &net.UDPAddr{IP: ip, Port: port}
+	}
+	return &net.TCPAddr{IP: ip, Port: port}
+}
+
+// sameAddrs tells whether two lists hold the same addresses, in any order
+func sameAddrs(a, b []net.Addr) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	as := make([]string, len(a))
+	for i := range a {
+		as[i] = a[i].String()
+	}
+	bs := make([]string, len(b))
+	for i := range b {
+		bs[i] = b[i].String()
+	}
+	sort.Strings(as)
+	sort.Strings(bs)
+
+	for i := range as {
+		if as[i] != bs[i] {
+			return false
+		}
+	}
+	return true
+}
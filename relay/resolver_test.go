@@ -0,0 +1,94 @@
+package relay
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestResolverModes(t *testing.T) {
+	first, err := newResolver("udp", "127.0.0.1:8089", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, err := first.addresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0].String() != "127.0.0.1:8089" {
+		t.Errorf("first: got %v", addrs)
+	}
+	if _, ok := addrs[0].(*net.UDPAddr); !ok {
+		t.Errorf("first: got a %T for a udp location", addrs[0])
+	}
+
+	all, err := newResolver("tcp", "[::1]:2003", resolveAll, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, err = all.addresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0].String() != "[::1]:2003" {
+		t.Errorf("all: got %v", addrs)
+	}
+	if _, ok := addrs[0].(*net.TCPAddr); !ok {
+		t.Errorf("all: got a %T for a tcp location", addrs[0])
+	}
+
+	if _, err := newResolver("tcp", "graphite:2003", "round-robin", ""); err == nil {
+		t.Error("expected an error for an unknown resolve mode")
+	}
+	if _, err := newResolver("tcp", "graphite:2003", resolveSRV, "often"); err == nil {
+		t.Error("expected an error for an invalid resolve interval")
+	}
+}
+
+func TestResolverKeepsAddressesOnFailure(t *testing.T) {
+	r, err := newResolver("tcp", "127.0.0.1:2003", resolveFirst, "1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := r.addresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Until(r.next) < 59*time.Minute {
+		t.Errorf("next resolution due in %v, want an hour", time.Until(r.next))
+	}
+
+	// the location stops resolving, the addresses it had are kept
+	r.location = "127.0.0.1:no-such-port"
+	r.invalidate()
+	got, err := r.addresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameAddrs(got, want) {
+		t.Errorf("got %v, want the previous %v", got, want)
+	}
+
+	// without previous addresses the failure is returned
+	fresh, _ := newResolver("tcp", "127.0.0.1:no-such-port", resolveFirst, "")
+	if _, err := fresh.addresses(); err == nil {
+		t.Error("expected an error for a location that does not resolve")
+	}
+}
+
+func TestSameAddrs(t *testing.T) {
+	a := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 2003}
+	b := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 2003}
+	c := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 2004}
+
+	switch {
+	case !sameAddrs([]net.Addr{a, b}, []net.Addr{b, a}):
+		t.Error("order must not matter")
+	case sameAddrs([]net.Addr{a, b}, []net.Addr{a, c}):
+		t.Error("different ports are different addresses")
+	case sameAddrs([]net.Addr{a}, []net.Addr{a, a}):
+		t.Error("lists of different length are different")
+	case !sameAddrs(nil, []net.Addr{}):
+		t.Error("empty lists are the same")
+	}
+}
@@ -2,16 +2,25 @@ package relay
 
 import (
 	"bytes"
+	"errors"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	log "github.com/golang/glog"
 )
 
 const (
 	retryInitial    = 500 * time.Millisecond
 	retryMultiplier = 2
+
+	// how long stopping an output waits for its backends to take the
+	// writes still queued or buffered, before dropping them
+	retryDrainTimeout = 10 * time.Second
 )
 
+var errRetryBufferStopped = errors.New("retry buffer stopped")
+
 type Operation func() error
 
 // Buffers and retries operations, if the buffer is full operations are dropped.
@@ -31,6 +40,9 @@ type retryBuffer struct {
 	list *bufferList
 
 	p poster
+
+	closing  chan struct{}
+	stopOnce sync.Once
 }
 
 func newRetryBuffer(size, batch int, max time.Duration, p poster) *retryBuffer {
@@ -42,6 +54,7 @@ func newRetryBuffer(size, batch int, max time.Duration, p poster) *retryBuffer {
 		maxBatch:        batch,
 		list:            newBufferList(size, batch),
 		p:               p,
+		closing:         make(chan struct{}),
 	}
 	go r.run()
 	return r
@@ -63,8 +76,23 @@ func (r *retryBuffer) post(buf []byte, query string, auth string, org string) (*
 		return nil, err
 	}
 
-	batch.wg.Wait()
-	return batch.resp, nil
+	select {
+	case <-batch.done:
+		return batch.resp, nil
+	case <-r.closing:
+		return nil, errRetryBufferStopped
+	}
+}
+
+// stop gives up retrying, dropping the buffered writes. Pending posts
+// return errRetryBufferStopped.
+func (r *retryBuffer) stop() {
+	r.stopOnce.Do(func() {
+		close(r.closing)
+		if dropped := r.list.close(); dropped > 0 {
+			log.Errorf("Dropping %d bytes of buffered writes, the retry buffer was stopped", dropped)
+		}
+	})
 }
 
 func (r *retryBuffer) run() {
@@ -72,6 +100,10 @@ func (r *retryBuffer) run() {
 	for {
 		buf.Reset()
 		batch := r.list.pop()
+		if batch == nil {
+			// stopped
+			return
+		}
 
 		for _, b := range batch.bufs {
 			buf.Write(b)
@@ -83,7 +115,7 @@ func (r *retryBuffer) run() {
 			if err == nil && resp.StatusCode/100 != 5 {
 				batch.resp = resp
 				atomic.StoreInt32(&r.buffering, 0)
-				batch.wg.Done()
+				close(batch.done)
 				break
 			}
 
@@ -94,7 +126,12 @@ func (r *retryBuffer) run() {
 				}
 			}
 
-			time.Sleep(interval)
+			select {
+			case <-time.After(interval):
+			case <-r.closing:
+				log.Errorf("Dropping %d bytes of buffered writes, the retry buffer was stopped", batch.size)
+				return
+			}
 		}
 	}
 }
@@ -107,7 +144,8 @@ type batch struct {
 	size  int
 	full  bool
 
-	wg   sync.WaitGroup
+	// done is closed once the batch was written
+	done chan struct{}
 	resp *responseData
 
 	next *batch
@@ -120,7 +158,7 @@ func newBatch(buf []byte, query string, auth string, org string) *batch {
 	b.query = query
 	b.auth = auth
 	b.org = org
-	b.wg.Add(1)
+	b.done = make(chan struct{})
 	return b
 }
 
@@ -130,6 +168,7 @@ type bufferList struct {
 	size     int
 	maxSize  int
 	maxBatch int
+	closed   bool
 }
 
 func newBufferList(maxSize, maxBatch int) *bufferList {
@@ -140,13 +179,18 @@ func newBufferList(maxSize, maxBatch int) *bufferList {
 	}
 }
 
-// pop will remove and return the first element of the list, blocking if necessary
+// pop will remove and return the first element of the list, blocking if necessary.
+// It returns nil once the list is closed.
 func (l *bufferList) pop() *batch {
 	l.cond.L.Lock()
 
-	for l.size == 0 {
+	for l.size == 0 && !l.closed {
 		l.cond.Wait()
 	}
+	if l.closed {
+		l.cond.L.Unlock()
+		return nil
+	}
 
 	b := l.head
 	l.head = l.head.next
@@ -157,9 +201,27 @@ func (l *bufferList) pop() *batch {
 	return b
 }
 
+// close empties the list and wakes pop, returning the size dropped
+func (l *bufferList) close() int {
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+
+	dropped := l.size
+	l.closed = true
+	l.head = nil
+	l.size = 0
+	l.cond.Broadcast()
+	return dropped
+}
+
 func (l *bufferList) add(buf []byte, query string, auth string, org string) (*batch, error) {
 	l.cond.L.Lock()
 
+	if l.closed {
+		l.cond.L.Unlock()
+		return nil, errRetryBufferStopped
+	}
+
 	if l.size+len(buf) > l.maxSize {
 		l.cond.L.Unlock()
 		return nil, ErrBufferFull
@@ -197,6 +259,24 @@ func (l *bufferList) add(buf []byte, query string, auth string, org string) (*ba
 		b.bufs = append(b.bufs, buf)
 	}
 
+	// pop may unlink the batch as soon as the lock is released
+	b := *cur
 	l.cond.L.Unlock()
-	return *cur, nil
+	return b, nil
+}
+
+// waitTimeout waits for wg for at most d, telling whether it finished
+func waitTimeout(wg *sync.WaitGroup, d time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(d):
+		return false
+	}
 }
@@ -0,0 +1,328 @@
+package relay
+
+import (
+	"bufio"
+	"container/list"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+const (
+	// DefaultSeriesRegistrySize is the number of series a registry remembers
+	DefaultSeriesRegistrySize = 100000
+
+	// how often a registry writes its index file
+	seriesIndexInterval = time.Minute
+)
+
+type seriesEntry struct {
+	key  string
+	seen time.Time
+
+	// sum tells apart series that share a key, 0 if unused
+	sum uint64
+
+	// value describes the series, like the series of an ID
+	value string
+}
+
+// seriesRegistry remembers which series were seen recently, so new ones
+// can be announced once. It holds at most size series, forgetting the
+// least recently seen first, and forgets series not seen for ttl (0 means
+// never). If an index file is set the registry survives restarts.
+type seriesRegistry struct {
+	size int
+	ttl  time.Duration
+	file string
+
+	mu    sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+	dirty bool
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// newSeriesRegistry creates a registry, loading the index file if it exists
+func newSeriesRegistry(size int, ttl time.Duration, file string) (*seriesRegistry, error) {
+	if size <= 0 {
+		size = DefaultSeriesRegistrySize
+	}
+
+	r := &seriesRegistry{
+		size:    size,
+		ttl:     ttl,
+		file:    file,
+		ll:      list.New(),
+		items:   make(map[string]*list.Element),
+		closing: make(chan struct{}),
+	}
+
+	if file == "" {
+		return r, nil
+	}
+
+	if err := r.load(); err != nil {
+		return nil, fmt.Errorf("problem loading series index %q: %v", file, err)
+	}
+
+	r.wg.Add(1)
+	go r.run()
+
+	return r, nil
+}
+
+// observe records that a series was seen and reports whether it is new,
+// i.e. unknown, forgotten or not seen for longer than the TTL
+func (r *seriesRegistry) observe(key string) bool {
+	isNew, _ := r.observeSum(key, 0, "")
+	return isNew
+}
+
+// observeSum is observe for keys derived from a hash of the series, like
+// series IDs. sum is a second, independent hash of the series; collision
+// is true if the key was seen with a different sum, in which case the
+// registry keeps the series it knew. value is kept with the key and can
+// be looked up with match.
+func (r *seriesRegistry) observeSum(key string, sum uint64, value string) (isNew, collision bool) {
+	now := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if el, ok := r.items[key]; ok {
+		e := el.Value.(*seriesEntry)
+		expired := r.ttl > 0 && now.Sub(e.seen) > r.ttl
+		if e.sum != sum && !expired {
+			return false, true
+		}
+		e.seen = now
+		e.sum = sum
+		e.value = value
+		r.ll.MoveToFront(el)
+		r.dirty = true
+		return expired, false
+	}
+
+	r.add(&seriesEntry{key: key, seen: now, sum: sum, value: value})
+	r.dirty = true
+	return true, false
+}
+
+// value returns the value kept with a key
+func (r *seriesRegistry) value(key string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	el, ok := r.items[key]
+	if !ok {
+		return "", false
+	}
+	return el.Value.(*seriesEntry).value, true
+}
+
+// match returns the keys whose value satisfies fn, at most limit of them,
+// most recently seen first
+func (r *seriesRegistry) match(fn func(value string) bool, limit int) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var keys []string
+	for el := r.ll.Front(); el != nil && len(keys) < limit; el = el.Next() {
+		e := el.Value.(*seriesEntry)
+		if fn(e.value) {
+			keys = append(keys, e.key)
+		}
+	}
+	return keys
+}
+
+// forget drops a series, so it is announced again when next seen
+func (r *seriesRegistry) forget(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if el, ok := r.items[key]; ok {
+		r.ll.Remove(el)
+		delete(r.items, key)
+		r.dirty = true
+	}
+}
+
+// len returns the number of series in the registry
+func (r *seriesRegistry) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.ll.Len()
+}
+
+// add inserts a series, evicting the oldest one if full.
+// The caller must hold r.mu.
+func (r *seriesRegistry) add(e *seriesEntry) {
+	r.items[e.key] = r.ll.PushFront(e)
+
+	for r.ll.Len() > r.size {
+		el := r.ll.Back()
+		r.ll.Remove(el)
+		delete(r.items, el.Value.(*seriesEntry).key)
+	}
+}
+
+// close stops the registry, writing the index file one last time
+func (r *seriesRegistry) close() {
+	if r.file == "" {
+		return
+	}
+
+	close(r.closing)
+	r.wg.Wait()
+	r.save()
+}
+
+func (r *seriesRegistry) run() {
+	defer r.wg.Done()
+
+	t := time.NewTicker(seriesIndexInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			r.save()
+		case <-r.closing:
+			return
+		}
+	}
+}
+
+// load reads the index file, one "<unix nanoseconds>[/<hex sum>][*] <key>"
+// line per series, most recently seen first. A "*" means the key is
+// followed by a tab and its quoted value.
+func (r *seriesRegistry) load() error {
+	f, err := os.Open(r.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	now := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		line := s.Text()
+		i := strings.IndexByte(line, ' ')
+		if i <= 0 {
+			continue
+		}
+
+		stamp, key := line[:i], line[i+1:]
+
+		var value string
+		if strings.HasSuffix(stamp, "*") {
+			stamp = stamp[:len(stamp)-1]
+			// quoting leaves no tabs in the value
+			j := strings.LastIndexByte(key, '\t')
+			if j < 0 {
+				continue
+			}
+			if value, err = strconv.Unquote(key[j+1:]); err != nil {
+				continue
+			}
+			key = key[:j]
+		}
+
+		var sum uint64
+		if j := strings.IndexByte(stamp, '/'); j >= 0 {
+			if sum, err = strconv.ParseUint(stamp[j+1:], 16, 64); err != nil {
+				continue
+			}
+			stamp = stamp[:j]
+		}
+		ns, err := strconv.ParseInt(stamp, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		seen := time.Unix(0, ns)
+		if _, ok := r.items[key]; ok {
+			continue
+		}
+		if r.ttl > 0 && now.Sub(seen) > r.ttl {
+			continue
+		}
+
+		// the file is ordered, keep the most recent series if it grew too big
+		if r.ll.Len() >= r.size {
+			break
+		}
+		r.items[key] = r.ll.PushBack(&seriesEntry{key: key, seen: seen, sum: sum, value: value})
+	}
+
+	return s.Err()
+}
+
+// save writes the index file if series were seen since the last save
+func (r *seriesRegistry) save() {
+	r.mu.Lock()
+	if !r.dirty {
+		r.mu.Unlock()
+		return
+	}
+
+	var b strings.Builder
+	for el := r.ll.Front(); el != nil; el = el.Next() {
+		e := el.Value.(*seriesEntry)
+		b.WriteString(strconv.FormatInt(e.seen.UnixNano(), 10))
+		if e.sum != 0 {
+			b.WriteByte('/')
+			b.WriteString(strconv.FormatUint(e.sum, 16))
+		}
+		if e.value != "" {
+			b.WriteByte('*')
+		}
+		b.WriteByte(' ')
+		b.WriteString(e.key)
+		if e.value != "" {
+			b.WriteByte('\t')
+			b.WriteString(strconv.Quote(e.value))
+		}
+		b.WriteByte('\n')
+	}
+	r.dirty = false
+	r.mu.Unlock()
+
+	// write a temporary file first so a crash never leaves a partial index
+	tmp, err := ioutil.TempFile(filepath.Dir(r.file), filepath.Base(r.file)+".tmp")
+	if err != nil {
+		log.Errorf("Problem saving series index: %v", err)
+		return
+	}
+	_, err = tmp.WriteString(b.String())
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), r.file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Errorf("Problem saving series index to %q: %v", r.file, err)
+	}
+}
@@ -0,0 +1,338 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/golang/glog"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+const (
+	// DefaultSeriesBatchSize is the maximum number of events per batch
+	DefaultSeriesBatchSize = 1000
+
+	// DefaultSeriesFlushInterval is how long events wait for a batch to fill
+	DefaultSeriesFlushInterval = 10 * time.Second
+
+	// how long an amqp series sink waits for Rabbitmq to confirm a batch
+	seriesConfirmTimeout = 30 * time.Second
+)
+
+// seriesEvent announces a series seen for the first time by an org
+type seriesEvent struct {
+	GockyID     string            `json:"gockyId"`
+	Relay       string            `json:"relay"`
+	Owner       string            `json:"owner"`
+	Machine     string            `json:"machine"`
+	Measurement string            `json:"measurement"`
+	Tags        map[string]string `json:"tags"`
+	Field       string            `json:"field"`
+	FieldType   string            `json:"fieldType"`
+	FirstSeen   time.Time         `json:"firstSeen"`
+
+	key string
+}
+
+// seriesSink ships batches of series events
+type seriesSink interface {
+	send(events []seriesEvent) error
+	close()
+}
+
+// seriesDiscovery detects the series an org writes for the first time and
+// sends them to a sink in batches. A batch the sink fails to take is
+// dropped and its series are forgotten, so they are announced again when
+// they are next written.
+type seriesDiscovery struct {
+	gockyID string
+	relay   string
+
+	registry *seriesRegistry
+	sink     seriesSink
+
+	batchSize int
+	interval  time.Duration
+
+	events  chan seriesEvent
+	dropped int64
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// newSeriesDiscovery creates the series discovery of a relay. Events are
+// sent once it is started.
+func newSeriesDiscovery(relay string, cfg *SeriesDiscoveryConfig, amqpCfg amqpPublisherConfig) (*seriesDiscovery, error) {
+	gockyID, err := os.Hostname()
+	if err != nil {
+		gockyID = ""
+	}
+
+	d := &seriesDiscovery{
+		gockyID:   gockyID,
+		relay:     relay,
+		batchSize: cfg.BatchSize,
+		interval:  DefaultSeriesFlushInterval,
+		closing:   make(chan struct{}),
+	}
+
+	if d.batchSize <= 0 {
+		d.batchSize = DefaultSeriesBatchSize
+	}
+	d.events = make(chan seriesEvent, 10*d.batchSize)
+
+	if cfg.FlushInterval != "" {
+		t, err := time.ParseDuration(cfg.FlushInterval)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing series-discovery flush-interval '%v'", err)
+		}
+		d.interval = t
+	}
+
+	var ttl time.Duration
+	if cfg.CacheTTL != "" {
+		t, err := time.ParseDuration(cfg.CacheTTL)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing series-discovery cache-ttl '%v'", err)
+		}
+		ttl = t
+	}
+
+	d.sink, err = newSeriesSink(cfg, amqpCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	d.registry, err = newSeriesRegistry(cfg.CacheSize, ttl, cfg.IndexFile)
+	if err != nil {
+		d.sink.close()
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func newSeriesSink(cfg *SeriesDiscoveryConfig, amqpCfg amqpPublisherConfig) (seriesSink, error) {
+	timeout := DefaultHTTPTimeout
+	if cfg.Timeout != "" {
+		t, err := time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing series-discovery timeout '%v'", err)
+		}
+		timeout = t
+	}
+
+	switch cfg.Type {
+	case "", meteringSinkAMQP:
+		if cfg.Location != "" {
+			amqpCfg.URL = cfg.Location
+		}
+		if amqpCfg.URL == "" {
+			return nil, fmt.Errorf("missing location or amqp-url for amqp series-discovery")
+		}
+		return &amqpSeriesSink{p: getAMQPPublisher(amqpCfg)}, nil
+
+	case meteringSinkWebhook:
+		if cfg.Location == "" {
+			return nil, fmt.Errorf("missing location for webhook series-discovery")
+		}
+		return &webhookSeriesSink{
+			location: cfg.Location,
+			client:   &http.Client{Timeout: timeout},
+		}, nil
+
+	case meteringSinkFile:
+		if cfg.Location == "" {
+			return nil, fmt.Errorf("missing location for file series-discovery")
+		}
+		return &fileSeriesSink{path: cfg.Location}, nil
+	}
+
+	return nil, fmt.Errorf("unknown series-discovery type %q", cfg.Type)
+}
+
+// start sends events in the background
+func (d *seriesDiscovery) start() {
+	d.wg.Add(1)
+	go d.run()
+}
+
+// stop sends the queued events, then closes the sink and the registry
+func (d *seriesDiscovery) stop() {
+	close(d.closing)
+	d.wg.Wait()
+
+	d.sink.close()
+	d.registry.close()
+}
+
+// observe queues an event for every series of the points the org has not
+// written recently. Events that do not fit in the queue are dropped.
+func (d *seriesDiscovery) observe(orgID, machineID string, points []models.Point) {
+	now := time.Now().UTC()
+
+	for _, p := range points {
+		var tags map[string]string
+		prefix := orgID + " " + string(p.Key()) + " "
+
+		fi := p.FieldIterator()
+		for fi.Next() {
+			key := prefix + string(fi.FieldKey())
+			if !d.registry.observe(key) {
+				continue
+			}
+
+			if tags == nil {
+				tags = p.Tags().Map()
+			}
+
+			e := seriesEvent{
+				GockyID:     d.gockyID,
+				Relay:       d.relay,
+				Owner:       orgID,
+				Machine:     machineID,
+				Measurement: string(p.Name()),
+				Tags:        tags,
+				Field:       string(fi.FieldKey()),
+				FieldType:   fieldTypeName(fi.Type()),
+				FirstSeen:   now,
+				key:         key,
+			}
+
+			select {
+			case d.events <- e:
+			default:
+				d.registry.forget(key)
+				atomic.AddInt64(&d.dropped, 1)
+			}
+		}
+	}
+}
+
+func (d *seriesDiscovery) run() {
+	defer d.wg.Done()
+
+	t := time.NewTicker(d.interval)
+	defer t.Stop()
+
+	batch := make([]seriesEvent, 0, d.batchSize)
+	for {
+		select {
+		case e := <-d.events:
+			batch = append(batch, e)
+			if len(batch) < d.batchSize {
+				continue
+			}
+		case <-t.C:
+		case <-d.closing:
+		drain:
+			for {
+				select {
+				case e := <-d.events:
+					batch = append(batch, e)
+					if len(batch) >= d.batchSize {
+						batch = d.flush(batch)
+					}
+				default:
+					break drain
+				}
+			}
+			d.flush(batch)
+			return
+		}
+
+		batch = d.flush(batch)
+	}
+}
+
+// flush sends a batch and returns it emptied
+func (d *seriesDiscovery) flush(batch []seriesEvent) []seriesEvent {
+	if n := atomic.SwapInt64(&d.dropped, 0); n > 0 {
+		log.Warningf("Dropped %d new series events of relay %q, the queue is full", n, d.relay)
+	}
+
+	if len(batch) == 0 {
+		return batch
+	}
+
+	if err := d.sink.send(batch); err != nil {
+		log.Errorf("Problem sending %d new series events of relay %q: %v", len(batch), d.relay, err)
+		for _, e := range batch {
+			d.registry.forget(e.key)
+		}
+	}
+
+	return batch[:0]
+}
+
+func fieldTypeName(t models.FieldType) string {
+	switch t {
+	case models.Float:
+		return "float"
+	case models.Integer:
+		return "integer"
+	case models.String:
+		return "string"
+	case models.Boolean:
+		return "boolean"
+	}
+	return "unknown"
+}
+
+// amqpSeriesSink publishes every batch as a JSON array, waiting for the confirm
+type amqpSeriesSink struct {
+	p *amqpPublisher
+}
+
+func (s *amqpSeriesSink) send(events []seriesEvent) error {
+	body, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+
+	return s.p.publishWait(body, seriesConfirmTimeout)
+}
+
+func (s *amqpSeriesSink) close() {
+	s.p.release()
+}
+
+// webhookSeriesSink POSTs every batch as a JSON array
+type webhookSeriesSink struct {
+	location string
+	client   *http.Client
+}
+
+func (s *webhookSeriesSink) send(events []seriesEvent) error {
+	return postJSON(s.client, s.location, events)
+}
+
+func (s *webhookSeriesSink) close() {}
+
+// fileSeriesSink appends events to a file, one JSON object per line
+type fileSeriesSink struct {
+	path string
+}
+
+func (s *fileSeriesSink) send(events []seriesEvent) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+
+	// only the discovery goroutine writes to the file
+	return appendFile(s.path, buf.Bytes())
+}
+
+func (s *fileSeriesSink) close() {}
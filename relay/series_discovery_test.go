@@ -0,0 +1,149 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// seriesWebhook collects the batches POSTed to it, failing while down is set
+type seriesWebhook struct {
+	mu      sync.Mutex
+	down    bool
+	batches [][]seriesEvent
+}
+
+func (h *seriesWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.down {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	var events []seriesEvent
+	json.NewDecoder(r.Body).Decode(&events)
+	h.batches = append(h.batches, events)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *seriesWebhook) sizes() []int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var sizes []int
+	for _, b := range h.batches {
+		sizes = append(sizes, len(b))
+	}
+	return sizes
+}
+
+func newTestSeriesDiscovery(t *testing.T, location string) *seriesDiscovery {
+	t.Helper()
+
+	d, err := newSeriesDiscovery("relay", &SeriesDiscoveryConfig{
+		Type:          meteringSinkWebhook,
+		Location:      location,
+		BatchSize:     2,
+		FlushInterval: "1h",
+	}, amqpPublisherConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func seriesPoints(t *testing.T, lines string) []models.Point {
+	t.Helper()
+	points, err := models.ParsePointsString(lines)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return points
+}
+
+func TestSeriesDiscoveryBatches(t *testing.T) {
+	hook := new(seriesWebhook)
+	srv := httptest.NewServer(hook)
+	defer srv.Close()
+
+	d := newTestSeriesDiscovery(t, srv.URL)
+	d.start()
+
+	points := seriesPoints(t, "cpu,host=a user=1,system=2,idle=3\nmem,host=a free=4i,used=5i\n")
+	d.observe("org1", "m1", points)
+	// series already announced for the org are not sent again
+	d.observe("org1", "m1", points)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(hook.sizes()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// full batches go out without waiting for the flush interval
+	if got := hook.sizes(); len(got) != 2 || got[0] != 2 || got[1] != 2 {
+		t.Fatalf("sent batches of %v before stopping, want [2 2]", got)
+	}
+
+	// the rest is sent on stop
+	d.stop()
+	if got := hook.sizes(); len(got) != 3 || got[2] != 1 {
+		t.Fatalf("sent batches of %v, want [2 2 1]", got)
+	}
+
+	e := hook.batches[0][0]
+	if e.Relay != "relay" || e.Owner != "org1" || e.Machine != "m1" || e.Measurement != "cpu" || e.Tags["host"] != "a" || e.FieldType != "float" {
+		t.Errorf("unexpected event %+v", e)
+	}
+}
+
+func TestSeriesDiscoveryFailedBatch(t *testing.T) {
+	hook := &seriesWebhook{down: true}
+	srv := httptest.NewServer(hook)
+	defer srv.Close()
+
+	d := newTestSeriesDiscovery(t, srv.URL)
+	defer d.registry.close()
+
+	points := seriesPoints(t, "cpu,host=a user=1\n")
+	d.observe("org1", "m1", points)
+	d.flush([]seriesEvent{<-d.events})
+
+	// the series of a failed batch are announced again
+	hook.down = false
+	d.observe("org1", "m1", points)
+	if len(d.events) != 1 {
+		t.Fatalf("%d events queued after a failed batch, want 1", len(d.events))
+	}
+	d.flush([]seriesEvent{<-d.events})
+
+	// the same series is new to another org
+	d.observe("org2", "m1", points)
+	if len(d.events) != 1 {
+		t.Errorf("%d events queued for another org, want 1", len(d.events))
+	}
+
+	if got := hook.sizes(); len(got) != 1 {
+		t.Errorf("sent batches of %v, want one", got)
+	}
+}
+
+func TestSeriesDiscoveryConfig(t *testing.T) {
+	for _, cfg := range []SeriesDiscoveryConfig{
+		{Type: "kafka", Location: "x"},
+		{Type: meteringSinkWebhook},
+		{Type: meteringSinkFile},
+		{},
+		{Type: meteringSinkFile, Location: "x", FlushInterval: "often"},
+		{Type: meteringSinkFile, Location: "x", CacheTTL: "1 day"},
+	} {
+		if d, err := newSeriesDiscovery("relay", &cfg, amqpPublisherConfig{}); err == nil {
+			d.stop()
+			t.Errorf("newSeriesDiscovery(%+v): expected an error", cfg)
+		}
+	}
+}
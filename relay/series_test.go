@@ -0,0 +1,197 @@
+package relay
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// registryKeys lists the keys of a registry, most recently seen first
+func registryKeys(r *seriesRegistry) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var keys []string
+	for el := r.ll.Front(); el != nil; el = el.Next() {
+		keys = append(keys, el.Value.(*seriesEntry).key)
+	}
+	return keys
+}
+
+func TestSeriesRegistryObserve(t *testing.T) {
+	r, err := newSeriesRegistry(2, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !r.observe("a") || r.observe("a") {
+		t.Error("a series is new only the first time it is seen")
+	}
+
+	r.observe("b")
+	r.observe("a")
+	r.observe("c") // evicts b, the least recently seen
+
+	if got := registryKeys(r); !reflect.DeepEqual(got, []string{"c", "a"}) {
+		t.Errorf("registry holds %q, want [c a]", got)
+	}
+	if !r.observe("b") {
+		t.Error("an evicted series is not new again")
+	}
+
+	r.forget("a")
+	if r.len() != 2 || !r.observe("a") {
+		t.Error("a forgotten series is not new again")
+	}
+}
+
+func TestSeriesRegistryTTL(t *testing.T) {
+	r, err := newSeriesRegistry(10, time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.observe("a")
+	r.items["a"].Value.(*seriesEntry).seen = time.Now().Add(-2 * time.Hour)
+
+	if !r.observe("a") {
+		t.Error("a series not seen for longer than the TTL is not new")
+	}
+	if r.observe("a") {
+		t.Error("the expired series was not refreshed")
+	}
+}
+
+func TestSeriesRegistryPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocky-series")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "series.index")
+
+	r, err := newSeriesRegistry(10, 0, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.observe("cpu,host=a")
+	r.observe("disk,path=C:\\\\Program\\ Files")
+	r.close()
+
+	r, err = newSeriesRegistry(10, 0, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.close()
+
+	if got := registryKeys(r); !reflect.DeepEqual(got, []string{"disk,path=C:\\\\Program\\ Files", "cpu,host=a"}) {
+		t.Errorf("reloaded %q", got)
+	}
+	if r.observe("cpu,host=a") {
+		t.Error("a reloaded series is new")
+	}
+}
+
+// loadSeriesIndex writes index to a file and returns the keys a registry
+// loads from it
+func loadSeriesIndex(t *testing.T, index string, size int, ttl time.Duration) []string {
+	t.Helper()
+
+	f, err := ioutil.TempFile("", "gocky-series")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(index)
+	f.Close()
+
+	r, err := newSeriesRegistry(size, ttl, f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.close()
+
+	return registryKeys(r)
+}
+
+func TestSeriesRegistryLoad(t *testing.T) {
+	now := time.Now().UnixNano()
+	old := time.Now().Add(-2 * time.Hour).UnixNano()
+
+	got := loadSeriesIndex(t, fmt.Sprintf("garbage\n%d a\nx b\n%d e\n", now, now), 0, 0)
+	if !reflect.DeepEqual(got, []string{"a", "e"}) {
+		t.Errorf("malformed lines: loaded %q, want [a e]", got)
+	}
+
+	got = loadSeriesIndex(t, fmt.Sprintf("%d a\n%d b\n", now, old), 0, time.Hour)
+	if !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("expired series: loaded %q, want [a]", got)
+	}
+
+	// the most recent series are kept when the size shrank
+	got = loadSeriesIndex(t, fmt.Sprintf("%d a\n%d b\n%d c\n", now, now, now), 2, 0)
+	if !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("shrunk registry: loaded %q, want [a b]", got)
+	}
+}
+
+func TestSeriesRegistryCollisions(t *testing.T) {
+	r, err := newSeriesRegistry(10, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if isNew, collision := r.observeSum("v1:aa", 1, "cpu,host=a usage_idle"); !isNew || collision {
+		t.Errorf("first observeSum = %v, %v", isNew, collision)
+	}
+	if isNew, collision := r.observeSum("v1:aa", 1, "cpu,host=a usage_idle"); isNew || collision {
+		t.Errorf("second observeSum = %v, %v", isNew, collision)
+	}
+
+	// another series hashing to the same ID keeps the first one
+	if _, collision := r.observeSum("v1:aa", 2, "cpu,host=b usage_idle"); !collision {
+		t.Error("expected a collision")
+	}
+	if v, _ := r.value("v1:aa"); v != "cpu,host=a usage_idle" {
+		t.Errorf("value of the colliding ID = %q, want the first series", v)
+	}
+}
+
+func TestSeriesRegistryPersistsSums(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocky-series")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "series.index")
+
+	value := "disk,path=C:\\\\Program\\ Files used\twith\"quotes"
+
+	r, err := newSeriesRegistry(10, 0, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.observeSum("v1:bb", 0xffffffffffffffff, value)
+	r.close()
+
+	r, err = newSeriesRegistry(10, 0, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.close()
+
+	if v, ok := r.value("v1:bb"); !ok || v != value {
+		t.Errorf("value() = %q, %v, want %q", v, ok, value)
+	}
+	// the second hash survives, so collisions are still detected
+	if isNew, collision := r.observeSum("v1:bb", 0xffffffffffffffff, value); isNew || collision {
+		t.Errorf("observeSum after reload = %v, %v", isNew, collision)
+	}
+	if _, collision := r.observeSum("v1:bb", 1, "other"); !collision {
+		t.Error("expected a collision with the reloaded series")
+	}
+}
@@ -0,0 +1,282 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+const (
+	// DefaultTCPMaxLineSizeKB is the length of the longest line accepted
+	DefaultTCPMaxLineSizeKB = 64
+
+	// size at which the lines of a connection are forwarded without
+	// waiting for the client to pause
+	tcpMaxBatchSize = 256 * KB
+)
+
+// TCP is a relay for newline delimited line protocol sent over long-lived
+// TCP, TLS or unix socket connections, like telegraf's socket_writer does
+type TCP struct {
+	addr      string
+	socket    string
+	name      string
+	cert      string
+	precision string
+
+	maxLineSize int
+	idleTimeout time.Duration
+
+	closing int64
+	l       net.Listener
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+
+	out *lineOutputs
+}
+
+func NewTCP(config TCPConfig) (Relay, error) {
+	t := new(TCP)
+
+	t.name = config.Name
+	t.addr = config.Addr
+	t.socket = config.Socket
+	t.cert = config.SSLCombinedPem
+	t.precision = config.Precision
+
+	if t.addr == "" && t.socket == "" {
+		return nil, fmt.Errorf("missing bind-addr or socket for TCP relay %q", t.name)
+	}
+
+	t.maxLineSize = DefaultTCPMaxLineSizeKB * KB
+	if config.MaxLineSizeKB > 0 {
+		t.maxLineSize = config.MaxLineSizeKB * KB
+	}
+
+	if config.IdleTimeout != "" {
+		d, err := time.ParseDuration(config.IdleTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing idle timeout '%v'", err)
+		}
+		t.idleTimeout = d
+	}
+
+	t.conns = make(map[net.Conn]struct{})
+
+	out, err := newLineOutputs(t.Name(), t.precision, config.DefaultSourceType, config.Outputs)
+	if err != nil {
+		return nil, err
+	}
+	t.out = out
+
+	return t, nil
+}
+
+func (t *TCP) Name() string {
+	if t.name != "" {
+		return t.name
+	}
+	if t.socket != "" {
+		return "unix://" + t.socket
+	}
+	return t.addr
+}
+
+func (t *TCP) Run() error {
+	var (
+		l   net.Listener
+		err error
+	)
+	if t.socket != "" {
+		// remove the socket left behind by a previous run
+		if fi, serr := os.Stat(t.socket); serr == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(t.socket)
+		}
+		l, err = net.Listen("unix", t.socket)
+	} else {
+		l, err = net.Listen("tcp", t.addr)
+	}
+	if err != nil {
+		return err
+	}
+
+	// support TLS
+	if t.cert != "" {
+		cert, err := tls.LoadX509KeyPair(t.cert, t.cert)
+		if err != nil {
+			l.Close()
+			return err
+		}
+
+		l = tls.NewListener(l, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		})
+	}
+
+	t.mu.Lock()
+	t.l = l
+	t.mu.Unlock()
+
+	t.out.start()
+
+	log.Infof("Starting TCP relay %q on %v", t.Name(), l.Addr())
+
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			// like http.Server, back off on errors such as running out of
+			// file descriptors instead of giving up
+			if ne, ok := err.(net.Error); ok && ne.Temporary() && atomic.LoadInt64(&t.closing) == 0 {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				log.Errorf("Error accepting connection in relay %q: %v; retrying in %v", t.Name(), err, delay)
+				time.Sleep(delay)
+				continue
+			}
+
+			if atomic.LoadInt64(&t.closing) == 0 {
+				log.Errorf("Error accepting connection in relay %q: %v", t.Name(), err)
+			} else {
+				err = nil
+			}
+
+			t.closeConns()
+			t.wg.Wait()
+			t.out.stop()
+			return err
+		}
+
+		delay = 0
+
+		if !t.track(conn) {
+			conn.Close()
+			continue
+		}
+		go t.handleConn(conn)
+	}
+}
+
+func (t *TCP) Stop() error {
+	atomic.StoreInt64(&t.closing, 1)
+
+	t.mu.Lock()
+	l := t.l
+	t.mu.Unlock()
+
+	if l != nil {
+		return l.Close()
+	}
+	return nil
+}
+
+// track registers an open connection, unless the relay is closing
+func (t *TCP) track(conn net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if atomic.LoadInt64(&t.closing) != 0 {
+		return false
+	}
+	t.conns[conn] = struct{}{}
+	t.wg.Add(1)
+	return true
+}
+
+func (t *TCP) untrack(conn net.Conn) {
+	t.mu.Lock()
+	delete(t.conns, conn)
+	t.mu.Unlock()
+	t.wg.Done()
+}
+
+// closeConns interrupts the open connections
+func (t *TCP) closeConns() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for conn := range t.conns {
+		conn.Close()
+	}
+}
+
+// handleConn frames the lines of a connection and forwards them in batches,
+// whenever the client pauses or the batch is full. Lines longer than the
+// maximum line size are dropped.
+func (t *TCP) handleConn(conn net.Conn) {
+	defer t.untrack(conn)
+	defer conn.Close()
+
+	r := bufio.NewReaderSize(conn, t.maxLineSize)
+
+	batch := getBuf()
+	defer putBuf(batch)
+
+	var (
+		start    time.Time
+		skipping bool
+	)
+	for {
+		if t.idleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(t.idleTimeout))
+		}
+
+		line, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			if !skipping {
+				log.Errorf("Dropping line longer than %d bytes in relay %q from %v", t.maxLineSize, t.Name(), conn.RemoteAddr())
+			}
+			skipping = true
+			continue
+		}
+
+		// a line cut by a timeout or a read error is incomplete, only the
+		// client closing the connection ends the last line
+		partial := err != nil && err != io.EOF && len(line) > 0 && line[len(line)-1] != '\n'
+
+		if skipping {
+			// this is the end of the long line
+			skipping = false
+		} else if partial {
+			log.Errorf("Dropping incomplete line in relay %q from %v", t.Name(), conn.RemoteAddr())
+		} else if len(bytes.TrimSpace(line)) > 0 {
+			if batch.Len() == 0 {
+				start = time.Now()
+			}
+			batch.Write(line)
+			if line[len(line)-1] != '\n' {
+				batch.WriteByte('\n')
+			}
+		}
+
+		if batch.Len() > 0 && (err != nil || r.Buffered() == 0 || batch.Len() >= tcpMaxBatchSize) {
+			if werr := t.out.write(batch.Bytes(), start); werr != nil {
+				log.Errorf("Error parsing lines in relay %q from %v: %v", t.Name(), conn.RemoteAddr(), werr)
+			}
+			batch.Reset()
+		}
+
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				log.Infof("Closing idle connection in relay %q from %v", t.Name(), conn.RemoteAddr())
+			} else if err != io.EOF && atomic.LoadInt64(&t.closing) == 0 {
+				log.Errorf("Error reading connection in relay %q from %v: %v", t.Name(), conn.RemoteAddr(), err)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package relay
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runTCP starts a TCP relay on a unix socket in a temporary directory,
+// forwarding to sink
+func runTCP(t *testing.T, cfg TCPConfig, sink *net.UDPConn) (tcp *TCP, dial func() net.Conn, cleanup func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "gocky-tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Socket = filepath.Join(dir, "gocky.sock")
+	cfg.Outputs = []UDPOutputConfig{{Location: sink.LocalAddr().String()}}
+
+	r, err := NewTCP(cfg)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	tcp = r.(*TCP)
+
+	done := make(chan error, 1)
+	go func() { done <- tcp.Run() }()
+
+	dial = func() net.Conn {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			c, err := net.Dial("unix", cfg.Socket)
+			if err == nil {
+				return c
+			}
+			if time.Now().After(deadline) {
+				t.Fatal(err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	cleanup = func() {
+		t.Helper()
+		defer os.RemoveAll(dir)
+
+		tcp.Stop()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Run returned %v after Stop", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("Run did not return after Stop")
+		}
+	}
+	return tcp, dial, cleanup
+}
+
+func TestTCPRelayFramesLines(t *testing.T) {
+	sink := udpSink(t)
+	defer sink.Close()
+
+	_, dial, cleanup := runTCP(t, TCPConfig{Name: "tcp", Precision: "s", MaxLineSizeKB: 1}, sink)
+	defer cleanup()
+
+	c := dial()
+	c.Write([]byte("cpu,host=a value=1 1600000000\n\ncpu,host=b va"))
+	c.Write([]byte("lue=2 1600000001\n"))
+	// the long line is dropped, the lines around it are kept
+	c.Write([]byte("cpu,host=" + strings.Repeat("x", 2*KB) + " value=3 1600000002\n"))
+	// closing the connection ends the last line
+	c.Write([]byte("cpu,host=c value=4 1600000003"))
+	c.Close()
+
+	checkLines(t, readLines(t, sink, 3),
+		"cpu,host=a value=1 1600000000",
+		"cpu,host=b value=2 1600000001",
+		"cpu,host=c value=4 1600000003",
+	)
+}
+
+func TestTCPRelayIdleTimeout(t *testing.T) {
+	sink := udpSink(t)
+	defer sink.Close()
+
+	_, dial, cleanup := runTCP(t, TCPConfig{Name: "tcp", IdleTimeout: "50ms"}, sink)
+	defer cleanup()
+
+	c := dial()
+	defer c.Close()
+
+	// the cut line is not forwarded
+	c.Write([]byte("cpu value=1 1600000000000000000\ncpu value=2"))
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("the idle connection is still open")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("the idle connection was not closed")
+	}
+
+	checkLines(t, readLines(t, sink, 1), "cpu value=1 1600000000000000000")
+
+	sink.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, _, err := sink.ReadFromUDP(make([]byte, 1024)); err == nil {
+		t.Errorf("forwarded %d more bytes", n)
+	}
+}
+
+func TestTCPRelayStopClosesConnections(t *testing.T) {
+	sink := udpSink(t)
+	defer sink.Close()
+
+	tcp, dial, cleanup := runTCP(t, TCPConfig{Name: "tcp"}, sink)
+
+	c := dial()
+	defer c.Close()
+	c.Write([]byte("cpu value=1 1600000000000000000\n"))
+	readLines(t, sink, 1)
+
+	// Run returns only once the connection is closed
+	cleanup()
+
+	tcp.mu.Lock()
+	open := len(tcp.conns)
+	tcp.mu.Unlock()
+	if open != 0 {
+		t.Errorf("%d connections still tracked", open)
+	}
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Error("the connection is still open")
+	}
+}
+
+func TestNewTCPConfig(t *testing.T) {
+	if _, err := NewTCP(TCPConfig{Name: "tcp"}); err == nil {
+		t.Error("expected an error without bind-addr or socket")
+	}
+	if _, err := NewTCP(TCPConfig{Name: "tcp", Addr: "127.0.0.1:0", IdleTimeout: "later"}); err == nil {
+		t.Error("expected an error for an invalid idle-timeout")
+	}
+
+	r, err := NewTCP(TCPConfig{Socket: "/run/gocky.sock"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp := r.(*TCP)
+	if tcp.Name() != "unix:///run/gocky.sock" || tcp.maxLineSize != DefaultTCPMaxLineSizeKB*KB {
+		t.Errorf("got name %q and line size %d", tcp.Name(), tcp.maxLineSize)
+	}
+	tcp.out.stop()
+}
@@ -0,0 +1,126 @@
+package relay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// TranslateConfig describes how line protocol is translated to graphite
+type TranslateConfig struct {
+	// SourceType, MachineID and OrgID play the role of the Gocky headers
+	SourceType string
+	MachineID  string
+	OrgID      string
+
+	// Precision of the input timestamps (Default "n")
+	Precision string
+
+	// Output holds the graphite output settings to translate for
+	Output GraphiteOutputConfig
+}
+
+// TranslateGraphite reads line protocol from r and writes to w the carbon
+// plaintext lines a graphite output with the given settings would emit
+func TranslateGraphite(r io.Reader, w io.Writer, cfg TranslateConfig) error {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	points, err := models.ParsePointsWithPrecision(body, time.Now(), cfg.Precision)
+	if err != nil {
+		return err
+	}
+
+	b, err := NewGraphiteBackend(&cfg.Output)
+	if err != nil {
+		return err
+	}
+
+	src := graphiteSource{
+		OrgID:      cfg.OrgID,
+		MachineID:  cfg.MachineID,
+		SourceType: cfg.SourceType,
+	}
+	if src.MachineID == "" {
+		src.MachineID = unknownMachineID(points)
+	}
+
+	_, err = w.Write(b.plaintext(b.graphitePoints(points, src)))
+	return err
+}
+
+// translate renders the lines the backends of the writer would receive
+// for the points, each block preceded by a "# backend" comment line.
+// Without consistent hashing that is one random backend, like a write.
+func (w *graphiteWriter) translate(points []models.Point, src graphiteSource, out *bytes.Buffer) {
+	for _, r := range w.route(w.renderer(points, src)) {
+		fmt.Fprintf(out, "# backend %q (%s)\n", r.backend.name, r.backend.location)
+		out.Write(r.backend.plaintext(r.points))
+	}
+}
+
+// serveTranslate is the dry run counterpart of a write: it parses the
+// request like a write and responds with the graphite lines that would be
+// emitted, without sending anything
+func serveTranslate(w http.ResponseWriter, r *http.Request, writers []*graphiteWriter, defaultSourceType string) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		jsonError(w, http.StatusMethodNotAllowed, "invalid translate method")
+		return
+	}
+
+	var body = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		b, err := gzip.NewReader(r.Body)
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, "unable to decode gzip body")
+			return
+		}
+		defer b.Close()
+		body = b
+	}
+
+	bodyBuf := getBuf()
+	defer putBuf(bodyBuf)
+	if _, err := bodyBuf.ReadFrom(body); err != nil {
+		jsonError(w, http.StatusInternalServerError, "problem reading request body")
+		return
+	}
+
+	points, err := models.ParsePointsWithPrecision(bodyBuf.Bytes(), time.Now(), r.URL.Query().Get("precision"))
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, "unable to parse points")
+		return
+	}
+
+	src := graphiteSource{
+		OrgID:             "Unauthorized",
+		MachineID:         r.Header.Get("X-Gocky-Tag-Machine-Id"),
+		SourceType:        r.Header.Get("X-Gocky-Tag-Source-Type"),
+		DefaultSourceType: defaultSourceType,
+	}
+	if org := r.Header.Get("X-Gocky-Tag-Org-Id"); org != "" {
+		src.OrgID = org
+	}
+	if src.MachineID == "" {
+		src.MachineID = unknownMachineID(points)
+	}
+
+	out := getBuf()
+	defer putBuf(out)
+	for _, g := range writers {
+		g.translate(points, src, out)
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	w.Write(out.Bytes())
+}
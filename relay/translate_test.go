@@ -0,0 +1,114 @@
+package relay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func translateRequest(writers []*graphiteWriter, method, body string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/translate?precision=s", strings.NewReader(body))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	rec := httptest.NewRecorder()
+	serveTranslate(rec, req, writers, "")
+	return rec
+}
+
+func TestServeTranslateRandom(t *testing.T) {
+	w, err := newGraphiteWriter([]GraphiteOutputConfig{
+		{Name: "a", Location: "10.0.0.1:2003"},
+		{Name: "b", Location: "10.0.0.2:2003"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := translateRequest([]*graphiteWriter{w}, "POST", "cpu,cpu=cpu0 usage_user=1.5 1600000000\n",
+		http.Header{"X-Gocky-Tag-Machine-Id": {"m1"}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	// a random write goes to a single backend
+	body := rec.Body.String()
+	if n := strings.Count(body, "# backend "); n != 1 {
+		t.Errorf("%d backends listed, want 1:\n%s", n, body)
+	}
+	if !strings.HasSuffix(body, "\nbucky.m1.cpu.0.user 1.5 1600000000\n") {
+		t.Errorf("unexpected translation:\n%s", body)
+	}
+}
+
+func TestServeTranslateConsistentHashing(t *testing.T) {
+	w, err := newGraphiteWriter([]GraphiteOutputConfig{
+		{Name: "a", Location: "10.0.0.1:2003"},
+		{Name: "b", Location: "10.0.0.2:2003"},
+		{Name: "c", Location: "10.0.0.3:2003"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.useConsistentHashing(graphiteHashCarbon, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// bucky.m2.memory.free hashes to the third backend
+	rec := translateRequest([]*graphiteWriter{w}, "POST", "mem free=5i 1600000000\n",
+		http.Header{"X-Gocky-Tag-Machine-Id": {"m2"}})
+
+	want := `# backend "a" (10.0.0.1:2003)
+# backend "b" (10.0.0.2:2003)
+# backend "c" (10.0.0.3:2003)
+bucky.m2.memory.free 5 1600000000
+`
+	if got := rec.Body.String(); got != want {
+		t.Errorf("got translation\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestServeTranslateRequests(t *testing.T) {
+	w, err := newGraphiteWriter([]GraphiteOutputConfig{{Name: "a", Location: "10.0.0.1:2003"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writers := []*graphiteWriter{w}
+
+	rec := translateRequest(writers, "GET", "", nil)
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "POST" {
+		t.Errorf("GET answered %d with Allow %q", rec.Code, rec.Header().Get("Allow"))
+	}
+
+	rec = translateRequest(writers, "POST", "cpu\n", nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("unparseable body answered %d", rec.Code)
+	}
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("cpu,cpu=cpu0,machine_id=host9 usage_user=1 1600000000\n"))
+	zw.Close()
+
+	rec = translateRequest(writers, "POST", gz.String(), http.Header{"Content-Encoding": {"gzip"}})
+	// without a machine id header the id comes from the first point
+	if !strings.Contains(rec.Body.String(), "bucky.Unknown_host9.cpu.0.user 1 1600000000\n") {
+		t.Errorf("gzip body translated to\n%s", rec.Body)
+	}
+}
+
+func TestTranslateGraphitePrecision(t *testing.T) {
+	cfg := TranslateConfig{MachineID: "m1", Precision: "s"}
+	checkLines(t, translateLines(t, cfg, "cpu,cpu=cpu0 usage_user=1 1600000000"),
+		"bucky.m1.cpu.0.user 1 1600000000")
+
+	var out bytes.Buffer
+	cfg.Output.Mode = "json"
+	if err := TranslateGraphite(strings.NewReader("cpu usage_user=1\n"), &out, cfg); err == nil {
+		t.Error("expected an error for an invalid output")
+	}
+}
@@ -10,11 +10,21 @@ import (
 
 	log "github.com/golang/glog"
 
-	"github.com/influxdata/influxdb/models"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 const (
 	defaultMTU = 1024
+
+	// DefaultUDPReadBatchSize is the number of packets read at once
+	DefaultUDPReadBatchSize = 16
+
+	// DefaultUDPQueueSize is the number of packets waiting for a worker
+	DefaultUDPQueueSize = 1024
+
+	// how often dropped packets are reported
+	udpDropReportInterval = time.Minute
 )
 
 // UDP is a relay for UDP influxdb writes
@@ -24,10 +34,21 @@ type UDP struct {
 	precision string
 
 	closing int64
-	l       *net.UDPConn
-	c       *net.UDPConn
+	// listening sockets, one per reader if SO_REUSEPORT is supported
+	conns     []*net.UDPConn
+	closeOnce sync.Once
 
-	backends []*udpBackend
+	readers   int
+	batchSize int
+	workers   int
+	queueSize int
+
+	// kernelDrops holds the drop counter of every socket, if supported
+	dropCounter bool
+	kernelDrops []uint32
+	queueDrops  int64
+
+	out *lineOutputs
 }
 
 func NewUDP(config UDPConfig) (Relay, error) {
@@ -37,48 +58,66 @@ func NewUDP(config UDPConfig) (Relay, error) {
 	u.addr = config.Addr
 	u.precision = config.Precision
 
-	l, err := net.ListenPacket("udp", u.addr)
-	if err != nil {
-		return nil, err
+	u.readers = config.Readers
+	if u.readers <= 0 {
+		u.readers = 1
 	}
-
-	ul, ok := l.(*net.UDPConn)
-	if !ok {
-		return nil, errors.New("problem listening for UDP")
+	u.batchSize = config.ReadBatchSize
+	if u.batchSize <= 0 {
+		u.batchSize = DefaultUDPReadBatchSize
 	}
-
-	if config.ReadBuffer != 0 {
-		if err := ul.SetReadBuffer(config.ReadBuffer); err != nil {
-			return nil, err
-		}
+	u.workers = config.Workers
+	if u.workers <= 0 {
+		u.workers = 1
 	}
-
-	u.l = ul
-
-	// UDP doesn't really "listen", this just gets us a socket with
-	// the local UDP address set to something random
-	u.c, err = net.ListenUDP("udp", nil)
-	if err != nil {
-		return nil, err
+	u.queueSize = config.QueueSize
+	if u.queueSize <= 0 {
+		u.queueSize = DefaultUDPQueueSize
 	}
 
-	for i := range config.Outputs {
-		cfg := &config.Outputs[i]
-		if cfg.Name == "" {
-			cfg.Name = cfg.Location
+	if u.readers > 1 && reusePortSupported {
+		for i := 0; i < u.readers; i++ {
+			ul, err := listenUDPReusePort(u.addr)
+			if err != nil {
+				u.closeConns()
+				return nil, err
+			}
+			u.conns = append(u.conns, ul)
+		}
+	} else {
+		l, err := net.ListenPacket("udp", u.addr)
+		if err != nil {
+			return nil, err
 		}
 
-		if cfg.MTU == 0 {
-			cfg.MTU = defaultMTU
+		ul, ok := l.(*net.UDPConn)
+		if !ok {
+			l.Close()
+			return nil, errors.New("problem listening for UDP")
 		}
+		u.conns = append(u.conns, ul)
+	}
 
-		addr, err := net.ResolveUDPAddr("udp", cfg.Location)
-		if err != nil {
-			return nil, err
+	u.dropCounter = true
+	for _, ul := range u.conns {
+		if config.ReadBuffer != 0 {
+			if err := ul.SetReadBuffer(config.ReadBuffer); err != nil {
+				u.closeConns()
+				return nil, err
+			}
+		}
+		if err := enableDropCounter(ul); err != nil {
+			u.dropCounter = false
 		}
+	}
+	u.kernelDrops = make([]uint32, len(u.conns))
 
-		u.backends = append(u.backends, &udpBackend{u, cfg.Name, addr, cfg.MTU})
+	out, err := newLineOutputs(u.Name(), u.precision, config.DefaultSourceType, config.Outputs)
+	if err != nil {
+		u.closeConns()
+		return nil, err
 	}
+	u.out = out
 
 	return u, nil
 }
@@ -112,99 +151,197 @@ type packet struct {
 }
 
 func (u *UDP) Run() error {
+	u.out.start()
 
-	// buffer that can hold the largest possible UDP payload
-	var buf [65536]byte
+	queue := make(chan packet, u.queueSize)
 
-	// arbitrary queue size for now
-	queue := make(chan packet, 1024)
+	var workers sync.WaitGroup
+	workers.Add(u.workers)
+	for i := 0; i < u.workers; i++ {
+		go func() {
+			defer workers.Done()
+			for p := range queue {
+				u.post(&p)
+			}
+		}()
+	}
 
-	var wg sync.WaitGroup
+	done := make(chan struct{})
+	go u.reportDrops(done)
 
-	go func() {
-		for p := range queue {
-			u.post(&p)
-			wg.Done()
-		}
-	}()
+	log.Infof("Starting UDP relay %q on %v with %d readers and %d workers", u.Name(), u.conns[0].LocalAddr(), u.readers, u.workers)
+
+	// readers share the sockets if there are fewer sockets than readers
+	errs := make(chan error, u.readers)
+	var readers sync.WaitGroup
+	readers.Add(u.readers)
+	for i := 0; i < u.readers; i++ {
+		sock := i % len(u.conns)
+		go func() {
+			defer readers.Done()
+			err := u.read(sock, queue)
+			if atomic.LoadInt64(&u.closing) == 0 {
+				log.Errorf("Error reading packet in relay %q: %v", u.Name(), err)
+				errs <- err
+			}
+			// one failing reader stops the relay
+			u.closeConns()
+		}()
+	}
+
+	readers.Wait()
+	close(queue)
+	workers.Wait()
+	close(done)
+	u.out.stop()
+
+	close(errs)
+	return <-errs
+}
 
-	log.Infof("Starting UDP relay %q on %v", u.Name(), u.l.LocalAddr())
+// read queues the packets of a socket until it is closed. Packets that do
+// not fit in the queue are dropped.
+func (u *UDP) read(sock int, queue chan<- packet) error {
+	c := u.conns[sock]
+
+	var pc interface {
+		ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	}
+	if addr, ok := c.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+		pc = ipv4.NewPacketConn(c)
+	} else {
+		pc = ipv6.NewPacketConn(c)
+	}
+
+	// buffers that can hold the largest possible UDP payload
+	msgs := make([]ipv4.Message, u.batchSize)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, 65536)}
+		if u.dropCounter {
+			msgs[i].OOB = make([]byte, 64)
+		}
+	}
 
 	for {
-		n, remote, err := u.l.ReadFromUDP(buf[:])
+		n, err := pc.ReadBatch(msgs, 0)
 		if err != nil {
-			if atomic.LoadInt64(&u.closing) == 0 {
-				log.Errorf("Error reading packet in relay %q from %v: %v", u.name, remote, err)
-			} else {
-				err = nil
-			}
-			close(queue)
-			wg.Wait()
 			return err
 		}
 		start := time.Now()
 
-		wg.Add(1)
+		for _, m := range msgs[:n] {
+			if d, ok := droppedPackets(m.OOB[:m.NN]); ok {
+				atomic.StoreUint32(&u.kernelDrops[sock], d)
+			}
 
-		// copy the data into a buffer and queue it for processing
-		b := getUDPBuf()
-		b.Grow(n)
-		// bytes.Buffer.Write always returns a nil error, and will panic if out of memory
-		_, _ = b.Write(buf[:n])
-		queue <- packet{start, b, remote}
+			// copy the data into a buffer and queue it for processing
+			b := getUDPBuf()
+			b.Grow(m.N)
+			// bytes.Buffer.Write always returns a nil error, and will panic if out of memory
+			_, _ = b.Write(m.Buffers[0][:m.N])
+
+			remote, _ := m.Addr.(*net.UDPAddr)
+			select {
+			case queue <- packet{start, b, remote}:
+			default:
+				putUDPBuf(b)
+				atomic.AddInt64(&u.queueDrops, 1)
+			}
+		}
 	}
 }
 
-func (u *UDP) Stop() error {
-	atomic.StoreInt64(&u.closing, 1)
-	return u.l.Close()
-}
+// reportDrops logs the packets dropped by the kernel and by the relay
+func (u *UDP) reportDrops(done chan struct{}) {
+	t := time.NewTicker(udpDropReportInterval)
+	defer t.Stop()
 
-func (u *UDP) post(p *packet) {
-	points, err := models.ParsePointsWithPrecision(p.data.Bytes(), p.timestamp, u.precision)
-	if err != nil {
-		log.Errorf("Error parsing packet in relay %q from %v: %v", u.Name(), p.from, err)
-		putUDPBuf(p.data)
-		return
-	}
+	last := make([]uint32, len(u.kernelDrops))
+	for {
+		select {
+		case <-t.C:
+		case <-done:
+			return
+		}
 
-	out := getUDPBuf()
-	for _, pt := range points {
-		if _, err = out.WriteString(pt.PrecisionString(u.precision)); err != nil {
-			break
+		var kernel uint64
+		for i := range u.kernelDrops {
+			d := atomic.LoadUint32(&u.kernelDrops[i])
+			// the counters wrap around
+			kernel += uint64(d - last[i])
+			last[i] = d
 		}
-		if err = out.WriteByte('\n'); err != nil {
-			break
+		queue := atomic.SwapInt64(&u.queueDrops, 0)
+
+		if kernel > 0 || queue > 0 {
+			log.Warningf("UDP relay %q dropped %d packets in the kernel and %d in the queue during the last %v",
+				u.Name(), kernel, queue, udpDropReportInterval)
 		}
 	}
+}
 
-	putUDPBuf(p.data)
-
-	if err != nil {
-		putUDPBuf(out)
-		log.Errorf("Error writing points in relay %q: %v", u.Name(), err)
-		return
-	}
+func (u *UDP) Stop() error {
+	atomic.StoreInt64(&u.closing, 1)
+	return u.closeConns()
+}
 
-	for _, b := range u.backends {
-		if err := b.post(out.Bytes()); err != nil {
-			log.Errorf("Error writing points in relay %q to backend %q: %v", u.Name(), b.name, err)
+// closeConns closes the listening sockets, once
+func (u *UDP) closeConns() error {
+	var err error
+	u.closeOnce.Do(func() {
+		for _, c := range u.conns {
+			if cerr := c.Close(); err == nil {
+				err = cerr
+			}
 		}
-	}
+	})
+	return err
+}
 
-	putUDPBuf(out)
+func (u *UDP) post(p *packet) {
+	if err := u.out.write(p.data.Bytes(), p.timestamp); err != nil {
+		log.Errorf("Error parsing packet in relay %q from %v: %v", u.Name(), p.from, err)
+	}
+	putUDPBuf(p.data)
 }
 
 type udpBackend struct {
-	u    *UDP
-	name string
-	addr *net.UDPAddr
-	mtu  int
+	name        string
+	backendType string
+
+	// c, addrs and mtu are set for udp backends
+	c     *net.UDPConn
+	addrs *resolver
+	mtu   int
+
+	// influxdb is set for influxdb backends
+	influxdb *udpBatch
+
+	// graphite is set for graphite backends
+	graphite *udpGraphite
 }
 
 var errPacketTooLarge = errors.New("payload larger than MTU")
 
+// post sends data to every address of the backend, returning the last error
 func (b *udpBackend) post(data []byte) error {
+	addrs, err := b.addrs.addresses()
+	if err != nil {
+		return err
+	}
+
+	for _, addr := range addrs {
+		if serr := b.send(data, addr.(*net.UDPAddr)); serr != nil {
+			if serr != errPacketTooLarge {
+				b.addrs.invalidate()
+			}
+			err = serr
+		}
+	}
+	return err
+}
+
+func (b *udpBackend) send(data []byte, addr *net.UDPAddr) error {
 	var err error
 	for len(data) > b.mtu {
 		// find the last line that will fit within the MTU
@@ -213,13 +350,13 @@ func (b *udpBackend) post(data []byte) error {
 			// first line is larger than MTU
 			return errPacketTooLarge
 		}
-		_, err = b.u.c.WriteToUDP(data[:idx+1], b.addr)
+		_, err = b.c.WriteToUDP(data[:idx+1], addr)
 		if err != nil {
 			return err
 		}
 		data = data[idx+1:]
 	}
 
-	_, err = b.u.c.WriteToUDP(data, b.addr)
+	_, err = b.c.WriteToUDP(data, addr)
 	return err
 }
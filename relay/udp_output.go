@@ -0,0 +1,484 @@
+package relay
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/golang/glog"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+const (
+	// DefaultUDPBatchSizeKB is the size at which points are posted to
+	// influxdb backends of UDP relays
+	DefaultUDPBatchSizeKB = 64
+
+	// DefaultUDPFlushInterval is how long points wait for a batch to fill
+	DefaultUDPFlushInterval = time.Second
+
+	// batches waiting for an influxdb backend before new ones are dropped
+	udpBatchQueueSize = 64
+
+	// writes waiting for a graphite backend before new ones are dropped
+	udpGraphiteQueueSize = 1024
+
+	// DefaultUDPResolveInterval is how often udp backends are resolved
+	// again. Sends to a dead address rarely fail, so errors alone do not
+	// tell that a backend moved.
+	DefaultUDPResolveInterval = "30s"
+)
+
+// lineOutputs parses the line protocol a relay receives with the precision
+// of the relay and writes the points to its udp, influxdb and graphite
+// backends
+type lineOutputs struct {
+	relay             string
+	precision         string
+	defaultSourceType string
+
+	// UDP doesn't really "listen", this is just a socket with the local
+	// UDP address set to something random, sending to udp backends
+	c *net.UDPConn
+
+	backends []*udpBackend
+}
+
+func newLineOutputs(relay, precision, defaultSourceType string, cfgs []UDPOutputConfig) (*lineOutputs, error) {
+	if defaultSourceType != "" && !validGraphiteProfile(defaultSourceType) {
+		return nil, fmt.Errorf("unknown default-source-type %q", defaultSourceType)
+	}
+
+	c, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &lineOutputs{
+		relay:             relay,
+		precision:         precision,
+		defaultSourceType: defaultSourceType,
+		c:                 c,
+	}
+
+	for i := range cfgs {
+		backend, err := newUDPBackend(o, &cfgs[i])
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+
+		o.backends = append(o.backends, backend)
+	}
+
+	return o, nil
+}
+
+// start posts the batches of influxdb backends in the background
+func (o *lineOutputs) start() {
+	for _, b := range o.backends {
+		if b.influxdb != nil {
+			b.influxdb.start()
+		}
+		if b.graphite != nil {
+			b.graphite.start()
+		}
+	}
+}
+
+// stop posts the points written so far to influxdb backends
+func (o *lineOutputs) stop() {
+	for _, b := range o.backends {
+		if b.influxdb != nil {
+			b.influxdb.stop()
+		}
+		if b.graphite != nil {
+			b.graphite.stop()
+		}
+	}
+	o.c.Close()
+}
+
+// write parses newline separated points and forwards them to every
+// backend. The valid points are forwarded even if others are invalid, the
+// parse error is returned. The data is not retained.
+func (o *lineOutputs) write(data []byte, timestamp time.Time) error {
+	points, parseErr := models.ParsePointsWithPrecision(data, timestamp, o.precision)
+	if len(points) == 0 {
+		return parseErr
+	}
+
+	out := getUDPBuf()
+	defer putUDPBuf(out)
+
+	var err error
+	for _, pt := range points {
+		if _, err = out.WriteString(pt.PrecisionString(o.precision)); err != nil {
+			break
+		}
+		if err = out.WriteByte('\n'); err != nil {
+			break
+		}
+	}
+
+	if err != nil {
+		log.Errorf("Error writing points in relay %q: %v", o.relay, err)
+		return parseErr
+	}
+
+	// graphite backends write in the background and need their own copy
+	var graphitePoints models.Points
+	for _, b := range o.backends {
+		switch b.backendType {
+		case "influxdb":
+			b.influxdb.add(out.Bytes())
+
+		case "graphite":
+			if graphitePoints == nil {
+				graphitePoints, err = models.ParsePointsWithPrecision(append([]byte(nil), out.Bytes()...), timestamp, o.precision)
+				if err != nil {
+					log.Errorf("Error parsing points in relay %q: %v", o.relay, err)
+					continue
+				}
+			}
+			src := graphiteSource{
+				MachineID:         unknownMachineID(graphitePoints),
+				DefaultSourceType: o.defaultSourceType,
+			}
+			b.graphite.add(graphitePoints, src)
+
+		default:
+			if err := b.post(out.Bytes()); err != nil {
+				log.Errorf("Error writing points in relay %q to backend %q: %v", o.relay, b.name, err)
+			}
+		}
+	}
+
+	return parseErr
+}
+
+func newUDPBackend(o *lineOutputs, cfg *UDPOutputConfig) (*udpBackend, error) {
+	if cfg.Name == "" {
+		cfg.Name = cfg.Location
+	}
+
+	switch cfg.BackendType {
+	case "", "udp":
+		if cfg.MTU == 0 {
+			cfg.MTU = defaultMTU
+		}
+
+		interval := cfg.ResolveInterval
+		if interval == "" {
+			interval = DefaultUDPResolveInterval
+		}
+
+		addrs, err := newResolver("udp", cfg.Location, cfg.Resolve, interval)
+		if err != nil {
+			return nil, err
+		}
+		// fail early if the location does not resolve
+		if _, err := addrs.addresses(); err != nil {
+			return nil, err
+		}
+
+		return &udpBackend{name: cfg.Name, backendType: "udp", c: o.c, addrs: addrs, mtu: cfg.MTU}, nil
+
+	case "influxdb":
+		if cfg.Database == "" {
+			return nil, fmt.Errorf("missing database for influxdb output %q of relay %q", cfg.Name, o.relay)
+		}
+
+		backend, err := newHTTPBackend(&HTTPOutputConfig{
+			Name:                cfg.Name,
+			Location:            cfg.Location,
+			BackendType:         cfg.BackendType,
+			Timeout:             cfg.Timeout,
+			BufferSizeMB:        cfg.BufferSizeMB,
+			MaxBatchKB:          cfg.MaxBatchKB,
+			MaxDelayInterval:    cfg.MaxDelayInterval,
+			SkipTLSVerification: cfg.SkipTLSVerification,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		size := DefaultUDPBatchSizeKB * KB
+		if cfg.BatchSizeKB > 0 {
+			size = cfg.BatchSizeKB * KB
+		}
+
+		interval := DefaultUDPFlushInterval
+		if cfg.FlushInterval != "" {
+			i, err := time.ParseDuration(cfg.FlushInterval)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing flush interval %v", err)
+			}
+			interval = i
+		}
+
+		// lines are forwarded with the precision of the relay
+		query := url.Values{"db": []string{cfg.Database}}
+		if cfg.RetentionPolicy != "" {
+			query.Set("rp", cfg.RetentionPolicy)
+		}
+		if o.precision != "" {
+			query.Set("precision", o.precision)
+		}
+
+		return &udpBackend{
+			name:        cfg.Name,
+			backendType: cfg.BackendType,
+			influxdb:    newUDPBatch(o.relay, backend, query.Encode(), size, interval),
+		}, nil
+
+	case "graphite":
+		g, err := newGraphiteWriter([]GraphiteOutputConfig{cfg.graphiteConfig()})
+		if err != nil {
+			return nil, err
+		}
+
+		return &udpBackend{name: cfg.Name, backendType: cfg.BackendType, graphite: newUDPGraphite(o.relay, cfg.Name, g)}, nil
+	}
+
+	return nil, fmt.Errorf("unknown type %q of output %q in relay %q", cfg.BackendType, cfg.Name, o.relay)
+}
+
+// udpBatch gathers the lines of many packets and posts them to an influxdb
+// backend once the batch is full or old enough. Batches wait for the
+// backend in a bounded queue; a batch that does not fit is dropped.
+type udpBatch struct {
+	relay    string
+	backend  *httpBackend
+	query    string
+	size     int
+	interval time.Duration
+
+	mu  sync.Mutex
+	buf []byte
+
+	queue   chan []byte
+	closing chan struct{}
+	// abort is closed once stopping gave up on the remaining batches
+	abort chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newUDPBatch(relay string, backend *httpBackend, query string, size int, interval time.Duration) *udpBatch {
+	return &udpBatch{
+		relay:    relay,
+		backend:  backend,
+		query:    query,
+		size:     size,
+		interval: interval,
+		buf:      make([]byte, 0, size),
+		queue:    make(chan []byte, udpBatchQueueSize),
+		closing:  make(chan struct{}),
+		abort:    make(chan struct{}),
+	}
+}
+
+// start posts batches in the background
+func (b *udpBatch) start() {
+	b.wg.Add(2)
+	go b.run()
+	go b.serve()
+}
+
+// stop posts the lines added so far and waits for the backend to take them.
+// If the backend is still down after retryDrainTimeout the remaining
+// batches are dropped.
+func (b *udpBatch) stop() {
+	b.flush()
+	close(b.closing)
+	if waitTimeout(&b.wg, retryDrainTimeout) {
+		return
+	}
+
+	log.Errorf("Backend %q of relay %q did not take the remaining points within %v, dropping them", b.backend.name, b.relay, retryDrainTimeout)
+	close(b.abort)
+	if b.backend.retry != nil {
+		b.backend.retry.stop()
+	}
+	b.wg.Wait()
+}
+
+// add queues newline terminated lines
+func (b *udpBatch) add(lines []byte) {
+	b.mu.Lock()
+	b.buf = append(b.buf, lines...)
+	full := len(b.buf) >= b.size
+	b.mu.Unlock()
+
+	if full {
+		b.flush()
+	}
+}
+
+// flush hands the current batch to the backend
+func (b *udpBatch) flush() {
+	b.mu.Lock()
+	batch := b.buf
+	if len(batch) == 0 {
+		b.mu.Unlock()
+		return
+	}
+	b.buf = make([]byte, 0, b.size)
+	b.mu.Unlock()
+
+	select {
+	case b.queue <- batch:
+	default:
+		log.Warningf("Dropping %d bytes of points for relay %q backend %q, the queue is full", len(batch), b.relay, b.backend.name)
+	}
+}
+
+func (b *udpBatch) run() {
+	defer b.wg.Done()
+
+	t := time.NewTicker(b.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			b.flush()
+		case <-b.closing:
+			return
+		}
+	}
+}
+
+// serve posts the batches one at a time
+func (b *udpBatch) serve() {
+	defer b.wg.Done()
+
+	for {
+		select {
+		case batch := <-b.queue:
+			b.post(batch)
+		case <-b.closing:
+			for {
+				select {
+				case <-b.abort:
+					if n := len(b.queue); n > 0 {
+						log.Errorf("Dropping %d batches of points for relay %q backend %q", n, b.relay, b.backend.name)
+					}
+					return
+				default:
+				}
+
+				select {
+				case batch := <-b.queue:
+					b.post(batch)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (b *udpBatch) post(batch []byte) {
+	resp, err := b.backend.post(batch, b.query, "", "")
+	if err != nil {
+		log.Errorf("Problem posting to relay %q backend %q: %v", b.relay, b.backend.name, err)
+		return
+	}
+	if resp.StatusCode/100 != 2 {
+		log.Errorf("%d response for relay %q backend %q: %s", resp.StatusCode, b.relay, b.backend.name, bytes.TrimSpace(resp.Body))
+	}
+}
+
+type udpGraphiteWrite struct {
+	points models.Points
+	src    graphiteSource
+}
+
+// udpGraphite writes points to a graphite backend from a single worker, in
+// the order they were received. Writes that do not fit in the bounded queue
+// are dropped and counted.
+type udpGraphite struct {
+	relay  string
+	name   string
+	writer *graphiteWriter
+
+	queue   chan udpGraphiteWrite
+	dropped int64
+	// aborted is set once stopping gave up on the remaining writes
+	aborted int32
+	wg      sync.WaitGroup
+}
+
+func newUDPGraphite(relay, name string, writer *graphiteWriter) *udpGraphite {
+	return &udpGraphite{
+		relay:  relay,
+		name:   name,
+		writer: writer,
+		queue:  make(chan udpGraphiteWrite, udpGraphiteQueueSize),
+	}
+}
+
+func (g *udpGraphite) start() {
+	g.wg.Add(1)
+	go g.run()
+}
+
+// stop waits for the queued writes, dropping them if the backend does not
+// take them within retryDrainTimeout
+func (g *udpGraphite) stop() {
+	close(g.queue)
+	if waitTimeout(&g.wg, retryDrainTimeout) {
+		return
+	}
+
+	atomic.StoreInt32(&g.aborted, 1)
+	g.wg.Wait()
+}
+
+// add queues points for the backend
+func (g *udpGraphite) add(points models.Points, src graphiteSource) {
+	select {
+	case g.queue <- udpGraphiteWrite{points, src}:
+	default:
+		atomic.AddInt64(&g.dropped, 1)
+	}
+}
+
+func (g *udpGraphite) run() {
+	defer g.wg.Done()
+
+	t := time.NewTicker(udpDropReportInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case w, ok := <-g.queue:
+			if !ok {
+				g.reportDrops()
+				return
+			}
+			if atomic.LoadInt32(&g.aborted) != 0 {
+				atomic.AddInt64(&g.dropped, 1)
+				continue
+			}
+			if err := pushToGraphite(w.points, g.writer, w.src); err != nil {
+				log.Errorf("Problem writing to relay %q graphite backend %q: %v", g.relay, g.name, err)
+			}
+
+		case <-t.C:
+			g.reportDrops()
+		}
+	}
+}
+
+func (g *udpGraphite) reportDrops() {
+	if n := atomic.SwapInt64(&g.dropped, 0); n > 0 {
+		log.Warningf("Relay %q dropped %d writes for graphite backend %q, the queue was full or the relay stopped", g.relay, n, g.name)
+	}
+}
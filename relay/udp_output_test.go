@@ -0,0 +1,154 @@
+package relay
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// influxServer records the query and body of every write it is sent
+type influxServer struct {
+	mu     sync.Mutex
+	writes []string
+}
+
+func (s *influxServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body strings.Builder
+	bufio.NewReader(r.Body).WriteTo(&body)
+
+	s.mu.Lock()
+	s.writes = append(s.writes, r.URL.RawQuery+"\n"+body.String())
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func TestLineOutputsInfluxDB(t *testing.T) {
+	s := new(influxServer)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	o, err := newLineOutputs("udp", "s", "", []UDPOutputConfig{{
+		Name:            "influx",
+		BackendType:     "influxdb",
+		Location:        srv.URL + "/write",
+		Database:        "edge",
+		RetentionPolicy: "week",
+		BatchSizeKB:     1,
+		FlushInterval:   "1h",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.start()
+
+	// points of several packets end up in one batch, posted on stop
+	now := time.Unix(1600000000, 0)
+	o.write([]byte("cpu,host=a value=1 1600000001"), now)
+	o.write([]byte("cpu,host=b value=2\nbroken"), now)
+	o.stop()
+
+	want := "db=edge&precision=s&rp=week\ncpu,host=a value=1 1600000001\ncpu,host=b value=2 1600000000\n"
+	if len(s.writes) != 1 || s.writes[0] != want {
+		t.Errorf("got writes %q, want %q", s.writes, want)
+	}
+}
+
+func TestLineOutputsInfluxDBFullBatches(t *testing.T) {
+	s := new(influxServer)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	o, err := newLineOutputs("udp", "", "", []UDPOutputConfig{{
+		BackendType:   "influxdb",
+		Location:      srv.URL + "/write",
+		Database:      "edge",
+		BatchSizeKB:   1,
+		FlushInterval: "1h",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.start()
+
+	line := "m,host=" + strings.Repeat("x", 500) + " value=1 1600000000000000000"
+	for i := 0; i < 4; i++ {
+		o.write([]byte(line), time.Now())
+	}
+	o.stop()
+
+	// every second line fills a batch
+	if len(s.writes) != 2 {
+		t.Fatalf("got %d writes, want 2", len(s.writes))
+	}
+	for _, w := range s.writes {
+		if got := strings.Count(w, "\n"); got != 3 {
+			t.Errorf("write of %d lines, want 2", got-1)
+		}
+	}
+}
+
+func TestLineOutputsGraphite(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	lines := make(chan string, 10)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		scanner := bufio.NewScanner(c)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	o, err := newLineOutputs("udp", "", "", []UDPOutputConfig{{
+		Name:        "carbon",
+		BackendType: "graphite",
+		Location:    l.Addr().String(),
+		Mode:        graphiteModeTagged,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.start()
+	o.write([]byte("cpu,cpu=cpu0,machine_id=m1 usage_user=1.5 1600000000000000000"), time.Now())
+	o.stop()
+
+	select {
+	case got := <-lines:
+		if want := "bucky.cpu.usage_user;cpu=cpu0;machine_id=Unknown.m1 1.5 1600000000"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing written to graphite")
+	}
+}
+
+func TestLineOutputsConfig(t *testing.T) {
+	for _, cfg := range []UDPOutputConfig{
+		{Name: "influx", BackendType: "influxdb", Location: "http://127.0.0.1:8086/write"},
+		{Name: "influx", BackendType: "influxdb", Location: "http://127.0.0.1:8086/write", Database: "udp", FlushInterval: "soon"},
+		{Name: "carbon", BackendType: "graphite", Location: "127.0.0.1:2003", Mode: "json"},
+		{Name: "kafka", BackendType: "kafka", Location: "127.0.0.1:9092"},
+	} {
+		if o, err := newLineOutputs("udp", "", "", []UDPOutputConfig{cfg}); err == nil {
+			o.stop()
+			t.Errorf("newLineOutputs(%+v): expected an error", cfg)
+		}
+	}
+
+	if _, err := newLineOutputs("udp", "", "solaris", nil); err == nil {
+		t.Error("expected an error for an unknown default-source-type")
+	}
+}
@@ -0,0 +1,117 @@
+//go:build linux
+// +build linux
+
+package relay
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// reusePortSupported tells whether several sockets can share a UDP port
+const reusePortSupported = true
+
+// listenUDPReusePort opens a UDP socket with SO_REUSEPORT, so the kernel
+// spreads the packets to the port over every such socket
+func listenUDPReusePort(addr string) (*net.UDPConn, error) {
+	uaddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		family = unix.AF_INET6
+		sa     unix.Sockaddr
+	)
+	if ip4 := uaddr.IP.To4(); ip4 != nil {
+		family = unix.AF_INET
+		sa4 := &unix.SockaddrInet4{Port: uaddr.Port}
+		copy(sa4.Addr[:], ip4)
+		sa = sa4
+	} else {
+		// no address means every address, IPv4 included
+		sa6 := &unix.SockaddrInet6{Port: uaddr.Port}
+		copy(sa6.Addr[:], uaddr.IP.To16())
+		sa = sa6
+	}
+
+	fd, err := unix.Socket(family, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.IPPROTO_UDP)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := setupReusePort(fd, family); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	if err := unix.Bind(fd, sa); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	f := os.NewFile(uintptr(fd), "udp:"+addr)
+	defer f.Close()
+
+	c, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, err
+	}
+
+	uc, ok := c.(*net.UDPConn)
+	if !ok {
+		c.Close()
+		return nil, fmt.Errorf("problem listening for UDP on %s", addr)
+	}
+	return uc, nil
+}
+
+func setupReusePort(fd, family int) error {
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+		return err
+	}
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
+		return err
+	}
+	if family == unix.AF_INET6 {
+		return unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, 0)
+	}
+	return nil
+}
+
+// enableDropCounter asks the kernel to attach to every packet the number
+// of packets the socket dropped so far
+func enableDropCounter(c *net.UDPConn) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RXQ_OVFL, 1)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// droppedPackets reads the drop counter from the control messages of a packet
+func droppedPackets(oob []byte) (uint32, bool) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, false
+	}
+
+	for _, m := range msgs {
+		if m.Header.Level == unix.SOL_SOCKET && m.Header.Type == unix.SO_RXQ_OVFL && len(m.Data) >= 4 {
+			// the counter is in host byte order
+			return *(*uint32)(unsafe.Pointer(&m.Data[0])), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package relay
+
+import (
+	"errors"
+	"net"
+)
+
+// reusePortSupported tells whether several sockets can share a UDP port
+const reusePortSupported = false
+
+func listenUDPReusePort(addr string) (*net.UDPConn, error) {
+	return nil, errors.New("SO_REUSEPORT is only supported on linux")
+}
+
+func enableDropCounter(c *net.UDPConn) error {
+	return errors.New("kernel drop counters are only supported on linux")
+}
+
+func droppedPackets(oob []byte) (uint32, bool) {
+	return 0, false
+}
@@ -0,0 +1,169 @@
+package relay
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// udpSink listens for the packets a relay forwards
+func udpSink(t *testing.T) *net.UDPConn {
+	t.Helper()
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// readLines reads packets from c until it got n lines or times out
+func readLines(t *testing.T, c *net.UDPConn, n int) []string {
+	t.Helper()
+
+	var lines []string
+	buf := make([]byte, 65536)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(lines) < n {
+		size, _, err := c.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("got %d of %d lines: %v", len(lines), n, err)
+		}
+		lines = append(lines, strings.Split(strings.TrimSuffix(string(buf[:size]), "\n"), "\n")...)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func startUDP(t *testing.T, cfg UDPConfig) (*UDP, chan error) {
+	t.Helper()
+	r, err := NewUDP(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := r.(*UDP)
+
+	done := make(chan error, 1)
+	go func() { done <- u.Run() }()
+	return u, done
+}
+
+func sendUDP(t *testing.T, addr net.Addr, packets ...string) {
+	t.Helper()
+	c, err := net.DialUDP("udp", nil, addr.(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for _, p := range packets {
+		if _, err := c.Write([]byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUDPRelayForwardsPackets(t *testing.T) {
+	sink := udpSink(t)
+	defer sink.Close()
+
+	u, done := startUDP(t, UDPConfig{
+		Name:      "udp",
+		Addr:      "127.0.0.1:0",
+		Precision: "s",
+		Readers:   2,
+		Workers:   3,
+		Outputs:   []UDPOutputConfig{{Location: sink.LocalAddr().String()}},
+	})
+
+	if reusePortSupported && len(u.conns) != 2 {
+		t.Errorf("got %d sockets for 2 readers", len(u.conns))
+	}
+
+	// the readers share the port, send to the one every socket listens on
+	sendUDP(t, u.conns[0].LocalAddr(),
+		"cpu,host=a value=1 1600000000",
+		"cpu,host=b value=2 1600000001\ncpu,host=c value=3 1600000002",
+		"not line protocol",
+	)
+
+	checkLines(t, readLines(t, sink, 3),
+		"cpu,host=a value=1 1600000000",
+		"cpu,host=b value=2 1600000001",
+		"cpu,host=c value=3 1600000002",
+	)
+
+	if err := u.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run returned %v after Stop", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after Stop")
+	}
+}
+
+func TestUDPCountsQueueDrops(t *testing.T) {
+	r, err := NewUDP(UDPConfig{Name: "udp", Addr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := r.(*UDP)
+	defer u.out.stop()
+
+	// nothing drains the queue, so only the first packet fits
+	queue := make(chan packet, 1)
+	read := make(chan error, 1)
+	go func() { read <- u.read(0, queue) }()
+
+	sendUDP(t, u.conns[0].LocalAddr(), "a v=1", "b v=2", "c v=3")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&u.queueDrops) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("counted %d dropped packets, want 2", atomic.LoadInt64(&u.queueDrops))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	u.Stop()
+	if err := <-read; err == nil {
+		t.Error("read returned no error for a closed socket")
+	}
+
+	p := <-queue
+	if got := p.data.String(); got != "a v=1" {
+		t.Errorf("queued %q, want the first packet", got)
+	}
+}
+
+func TestListenUDPReusePort(t *testing.T) {
+	if !reusePortSupported {
+		t.Skip("SO_REUSEPORT is not supported")
+	}
+
+	first, err := listenUDPReusePort("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	// a second socket binds to the same port
+	second, err := listenUDPReusePort(first.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	if err := enableDropCounter(first); err != nil {
+		t.Errorf("enableDropCounter: %v", err)
+	}
+	if _, ok := droppedPackets(nil); ok {
+		t.Error("found a drop counter without control messages")
+	}
+}
@@ -1,94 +1,218 @@
 package relay
 
 import (
-	"regexp"
-	"time"
+	"strings"
 
 	"github.com/influxdata/telegraf"
-	"github.com/influxdata/telegraf/metric"
 )
 
-// GraphiteMetric transforms a BeringeiPoint to Graphite compatible format
+// GraphiteWindowsMetric transforms a point from a windows host to Graphite compatible format.
+// Both the gopsutil based plugins (cpu, disk, diskio, net, ...) and the
+// win_perf_counters measurements are mapped to the collectd layout
+// GraphiteMetric produces for linux hosts, so dashboards work the same.
+// Note that perf counters ending in _persec are rates, not counters.
 func GraphiteWindowsMetric(metricName string, tags map[string]string, timestamp int64, value interface{}, field string) telegraf.Metric {
 
 	var parsedMetric map[string]interface{}
 
 	switch metricName {
 	case "cpu":
-		parsedMetric, metricName = parseWindowsCPU(tags, field, metricName, value)
+		parsedMetric, metricName = parseCPU(tags, field, metricName, value)
 	case "disk":
+		metricName = "df." + windowsDevice(tags["device"]) + ".df_complex"
 		parsedMetric = map[string]interface{}{field: value}
-		metricName = "disk." + tags["device"]
 	case "diskio":
-		parsedMetric = map[string]interface{}{field: value}
-		metricName = "diskio." + tags["name"]
+		tags = withTag(tags, "name", windowsDevice(tags["name"]))
+		parsedMetric, metricName = parseDiskio(tags, field, metricName, value)
 	case "net":
-		parsedMetric = map[string]interface{}{field: value}
-		metricName = "net." + tags["interface"]
+		parsedMetric, metricName = parseNet(tags, field, metricName, value)
 	case "mem":
 		parsedMetric, metricName = parseMem(tags, field, metricName, value)
 	case "system":
 		parsedMetric, metricName = parseSystem(tags, field, metricName, value)
 	case "swap":
 		parsedMetric = parseSwap(tags, field, value)
+	case "win_cpu":
+		parsedMetric, metricName = parseWinCPU(tags, field, value)
+	case "win_disk":
+		parsedMetric, metricName = parseWinDisk(tags, field, value)
+	case "win_diskio":
+		parsedMetric, metricName = parseWinDiskio(tags, field, value)
+	case "win_net":
+		parsedMetric, metricName = parseWinNet(tags, field, value)
+	case "win_mem":
+		parsedMetric, metricName = parseWinMem(tags, field, value)
 	default:
 		parsedMetric = map[string]interface{}{field: value}
 	}
 
-	if parsedMetric != nil {
-		m1, _ := metric.New(
-			metricName,
-			map[string]string{"id": tags["machine_id"]},
-			parsedMetric,
-			time.Unix(timestamp/1000000000, 0).UTC(),
-		)
+	return newGraphiteMetric(metricName, tags, timestamp, parsedMetric)
+}
+
+// windowsDevice turns drive letters like "C:" into path friendly names
+func windowsDevice(name string) string {
+	return strings.TrimSuffix(strings.TrimSpace(name), ":")
+}
+
+// withTag returns a copy of tags with key set to value
+func withTag(tags map[string]string, key, value string) map[string]string {
+	out := make(map[string]string, len(tags)+1)
+	for k, v := range tags {
+		out[k] = v
+	}
+	out[key] = value
+	return out
+}
+
+// parseWinCPU maps the Processor perf counters to cpu.<core> and cpu_extra.total
+func parseWinCPU(tags map[string]string, field string, value interface{}) (parsedMetric map[string]interface{}, metricNameFixed string) {
+	instance := tags["instance"]
+
+	metricNameFixed = "cpu." + instance
+	if instance == "_Total" {
+		metricNameFixed = "cpu_extra.total"
+	}
 
-		return m1
+	fieldFix := field
+	switch field {
+	case "Percent_Idle_Time":
+		fieldFix = "idle"
+	case "Percent_Interrupt_Time":
+		fieldFix = "interrupt"
+	case "Percent_Privileged_Time":
+		fieldFix = "system"
+	case "Percent_User_Time":
+		fieldFix = "user"
+	default:
+		metricNameFixed = "cpu_extra"
 	}
 
-	return nil
+	parsedMetric = map[string]interface{}{fieldFix: value}
+	return parsedMetric, metricNameFixed
 }
 
-func parseWindowsCPU(tags map[string]string, field, metricName string, value interface{}) (parsedMetric map[string]interface{}, metricNameFixed string) {
+// parseWinDisk maps the LogicalDisk perf counters to df.<device>
+func parseWinDisk(tags map[string]string, field string, value interface{}) (parsedMetric map[string]interface{}, metricNameFixed string) {
+	device := windowsDevice(tags["instance"])
 
-	metricNameFixed = "cpu_extra.total"
+	// the total over all drives has no df equivalent
+	if device == "_Total" {
+		metricNameFixed = "disk_extra.total"
+		parsedMetric = map[string]interface{}{field: value}
+		return parsedMetric, metricNameFixed
+	}
 
-	// We only accept cpu-total for windows (for now)
-	if tags["cpu"] != "cpu-total" {
-		return nil, ""
+	switch field {
+	case "Free_Megabytes":
+		metricNameFixed = "df." + device + ".df_complex"
+		parsedMetric = map[string]interface{}{"free": scaleValue(value, MB)}
+	case "Percent_Free_Space":
+		metricNameFixed = "df." + device + ".percent_bytes"
+		parsedMetric = map[string]interface{}{"free": value}
+	default:
+		metricNameFixed = "disk_extra." + device
+		parsedMetric = map[string]interface{}{field: value}
 	}
 
-	r, _ := regexp.Compile(`usage_(.*[a-zA-Z0-9])`)
-	match := r.FindStringSubmatch(field)
-	var fieldFix string
-	if len(match) > 0 {
-		fieldFix = match[len(match)-1]
-	} else {
-		fieldFix = field
+	return parsedMetric, metricNameFixed
+}
+
+// parseWinDiskio maps the PhysicalDisk perf counters to disk.<device>
+func parseWinDiskio(tags map[string]string, field string, value interface{}) (parsedMetric map[string]interface{}, metricNameFixed string) {
+	// instances look like "0 C:", keep the drive letters
+	device := tags["instance"]
+	if i := strings.IndexByte(device, ' '); i >= 0 {
+		device = device[i+1:]
+	}
+	device = windowsDevice(strings.Replace(device, " ", "_", -1))
+	if device == "_Total" {
+		device = "total"
 	}
 
-	// transform fields to collectd compatible ones
-	switch fieldFix {
-	case "iowait":
-		fieldFix = "wait"
-	case "irq":
-		fieldFix = "interrupt"
+	metricNameFixed = "disk." + device
+	fieldFix := field
 
+	switch field {
+	case "Disk_Read_Bytes_persec":
+		metricNameFixed += ".disk_octets"
+		fieldFix = "read"
+	case "Disk_Write_Bytes_persec":
+		metricNameFixed += ".disk_octets"
+		fieldFix = "write"
+	case "Disk_Reads_persec":
+		metricNameFixed += ".disk_ops"
+		fieldFix = "read"
+	case "Disk_Writes_persec":
+		metricNameFixed += ".disk_ops"
+		fieldFix = "write"
+	case "Percent_Disk_Read_Time":
+		metricNameFixed += ".disk_time"
+		fieldFix = "read"
+	case "Percent_Disk_Write_Time":
+		metricNameFixed += ".disk_time"
+		fieldFix = "write"
+	default:
+		metricNameFixed = "disk_extra." + device
 	}
+
 	parsedMetric = map[string]interface{}{fieldFix: value}
+	return parsedMetric, metricNameFixed
+}
 
-	switch fieldFix {
-	case "idle",
-		"interrupt",
-		"nice",
-		"softirq",
-		"steal",
-		"system",
-		"user",
-		"wait":
-		return parsedMetric, metricNameFixed
+// parseWinNet maps the Network Interface perf counters to interface.<name>
+func parseWinNet(tags map[string]string, field string, value interface{}) (parsedMetric map[string]interface{}, metricNameFixed string) {
+	metricNameFixed = "interface." + tags["instance"]
+	fieldFix := field
+
+	switch field {
+	case "Bytes_Received_persec":
+		metricNameFixed += ".if_octets"
+		fieldFix = "rx"
+	case "Bytes_Sent_persec":
+		metricNameFixed += ".if_octets"
+		fieldFix = "tx"
+	case "Packets_Received_persec":
+		metricNameFixed += ".if_packets"
+		fieldFix = "rx"
+	case "Packets_Sent_persec":
+		metricNameFixed += ".if_packets"
+		fieldFix = "tx"
+	case "Packets_Received_Errors":
+		metricNameFixed += ".if_errors"
+		fieldFix = "rx"
+	case "Packets_Outbound_Errors":
+		metricNameFixed += ".if_errors"
+		fieldFix = "tx"
+	case "Packets_Received_Discarded":
+		metricNameFixed += ".if_dropped"
+		fieldFix = "rx"
+	case "Packets_Outbound_Discarded":
+		metricNameFixed += ".if_dropped"
+		fieldFix = "tx"
 	default:
-		metricNameFixed = "cpu_extra"
-		return parsedMetric, metricNameFixed
+		metricNameFixed = "interface_extra." + tags["instance"]
+	}
+
+	parsedMetric = map[string]interface{}{fieldFix: value}
+	return parsedMetric, metricNameFixed
+}
+
+// parseWinMem maps the Memory perf counters to memory
+func parseWinMem(tags map[string]string, field string, value interface{}) (parsedMetric map[string]interface{}, metricNameFixed string) {
+	if field == "Available_Bytes" {
+		return map[string]interface{}{"free": value}, "memory"
+	}
+
+	return map[string]interface{}{field: value}, "memory_extra"
+}
+
+// scaleValue multiplies a numeric field value
+func scaleValue(value interface{}, factor int64) interface{} {
+	switch v := value.(type) {
+	case int64:
+		return v * factor
+	case float64:
+		return v * float64(factor)
 	}
+	return value
 }
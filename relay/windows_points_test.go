@@ -0,0 +1,77 @@
+package relay
+
+import "testing"
+
+// windowsPath maps one field with GraphiteWindowsMetric and returns the
+// metric name and field the way they end up in the graphite path
+func windowsPath(metricName string, tags map[string]string, field string, value interface{}) (string, interface{}) {
+	m := GraphiteWindowsMetric(metricName, tags, 1600000000e9, value, field)
+	if m == nil {
+		return "", nil
+	}
+	for k, v := range m.Fields() {
+		return m.Name() + "." + k, v
+	}
+	return m.Name(), nil
+}
+
+func TestGraphiteWindowsPerfCounters(t *testing.T) {
+	check := func(metricName, instance, field, want string) {
+		t.Helper()
+		tags := map[string]string{}
+		if instance != "" {
+			tags["instance"] = instance
+		}
+		if got, _ := windowsPath(metricName, tags, field, 1.0); got != want {
+			t.Errorf("%s,instance=%s %s mapped to %q, want %q", metricName, instance, field, got, want)
+		}
+	}
+
+	check("win_cpu", "0", "Percent_User_Time", "cpu.0.user")
+	check("win_cpu", "1", "Percent_Privileged_Time", "cpu.1.system")
+	check("win_cpu", "_Total", "Percent_Idle_Time", "cpu_extra.total.idle")
+	check("win_cpu", "0", "Percent_DPC_Time", "cpu_extra.Percent_DPC_Time")
+
+	check("win_disk", "C:", "Percent_Free_Space", "df.C.percent_bytes.free")
+	check("win_disk", "_Total", "Free_Megabytes", "disk_extra.total.Free_Megabytes")
+	check("win_disk", "D:", "Current_Disk_Queue_Length", "disk_extra.D.Current_Disk_Queue_Length")
+
+	check("win_diskio", "0 C:", "Disk_Read_Bytes_persec", "disk.C.disk_octets.read")
+	check("win_diskio", "1 D: E:", "Disk_Writes_persec", "disk.D:_E.disk_ops.write")
+	check("win_diskio", "_Total", "Percent_Disk_Write_Time", "disk.total.disk_time.write")
+
+	check("win_net", "Intel[R] Ethernet", "Bytes_Sent_persec", "interface.Intel[R] Ethernet.if_octets.tx")
+	check("win_net", "eth", "Packets_Received_Discarded", "interface.eth.if_dropped.rx")
+	check("win_net", "eth", "Bytes_Total_persec", "interface_extra.eth.Bytes_Total_persec")
+
+	check("win_mem", "", "Available_Bytes", "memory.free")
+	check("win_mem", "", "Pages_persec", "memory_extra.Pages_persec")
+}
+
+func TestGraphiteWindowsFreeMegabytes(t *testing.T) {
+	tags := map[string]string{"instance": "C:"}
+
+	if path, v := windowsPath("win_disk", tags, "Free_Megabytes", int64(100)); path != "df.C.df_complex.free" || v != int64(100*MB) {
+		t.Errorf("integer megabytes mapped to %q %v", path, v)
+	}
+	if _, v := windowsPath("win_disk", tags, "Free_Megabytes", 0.5); v != float64(MB)/2 {
+		t.Errorf("float megabytes scaled to %v", v)
+	}
+}
+
+func TestGraphiteWindowsGopsutil(t *testing.T) {
+	// the gopsutil plugins report drive letters as devices
+	if got, _ := windowsPath("disk", map[string]string{"device": "C:"}, "used", int64(1)); got != "df.C.df_complex.used" {
+		t.Errorf("disk mapped to %q", got)
+	}
+
+	checkLines(t, translateLines(t, TranslateConfig{MachineID: "m1", SourceType: "windows"},
+		"win_cpu,instance=0 Percent_User_Time=3 1600000000000000000",
+		"win_disk,instance=C: Free_Megabytes=100 1600000000000000000",
+		"win_mem Available_Bytes=1000 1600000000000000000",
+	),
+		"bucky.m1.cpu.0.user 3 1600000000",
+		"bucky.m1.df.C.df_complex.free 104857600 1600000000",
+		"bucky.m1.memory.free 1000 1600000000",
+	)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/mistio/gocky/relay"
+)
+
+// translate prints the graphite lines the points read on stdin map to
+func translate(args []string) int {
+	var cfg relay.TranslateConfig
+
+	fs := flag.NewFlagSet("translate", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s translate [options] < points.txt\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Reads line protocol on stdin and prints the graphite lines it maps to.")
+		fmt.Fprintln(os.Stderr)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&cfg.SourceType, "source-type", "", "Source type used to pick the mapping profile")
+	fs.StringVar(&cfg.MachineID, "machine-id", "", "Machine ID, as sent in X-Gocky-Tag-Machine-Id")
+	fs.StringVar(&cfg.OrgID, "org-id", "Unauthorized", "Organization ID, as sent in X-Gocky-Tag-Org-Id")
+	fs.StringVar(&cfg.Precision, "precision", "", "Precision of the input timestamps")
+	fs.StringVar(&cfg.Output.Prefix, "prefix", relay.DefaultGraphitePrefix, "Prefix of the graphite paths")
+	fs.StringVar(&cfg.Output.Mode, "mode", "", "Graphite naming mode: path or tagged")
+	fs.StringVar(&cfg.Output.Sanitize, "sanitize", "", "Sanitize policy: none, underscore or strict")
+	fs.StringVar(&cfg.Output.Precision, "output-precision", "", "Precision of the output timestamps: s or ms")
+	fs.Parse(args)
+
+	cfg.Output.Name = "translate"
+	cfg.Output.Location = "stdout"
+
+	if err := relay.TranslateGraphite(os.Stdin, os.Stdout, cfg); err != nil {
+		fmt.Fprintln(os.Stderr, "Problem translating points:", err)
+		return 1
+	}
+
+	return 0
+}